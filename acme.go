@@ -0,0 +1,58 @@
+package grove
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"errors"
+	"golang.org/x/crypto/acme/autocert"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// defaultACMERedirect is the address on which HTTP-01 challenges
+	// are answered when ACMEHosts is set and RedirectHTTP is not.
+	defaultACMERedirect = ":80"
+)
+
+var (
+	// certManager obtains and renews the certificates for ACMEHosts,
+	// or is nil if they are not set.
+	certManager *autocert.Manager
+)
+
+// newCertManager makes the manager which obtains certificates for the
+// ACMEHosts from Let's Encrypt, agreeing to its terms of service, and
+// keeps them in the ACMECacheDir, so that they are reused rather than
+// obtained again every time Grove starts.
+func newCertManager(c *Config) (m *autocert.Manager, err error) {
+	dir := c.ACMECacheDir
+	if len(dir) == 0 {
+		cache, err := os.UserCacheDir()
+		if err != nil {
+			return nil, errors.New("ACMEHosts requires ACMECacheDir: " + err.Error())
+		}
+		dir = filepath.Join(cache, "grove", "acme")
+	}
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	l.Infof("Obtaining certificates for %q, cached in %q\n", c.ACMEHosts, dir)
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(dir),
+		HostPolicy: autocert.HostWhitelist(c.ACMEHosts...),
+		Email:      c.ACMEEmail,
+	}, nil
+}
+
+// acmeChallengeHandler wraps a handler for plain HTTP so that it
+// answers the HTTP-01 challenges by which Let's Encrypt checks that
+// Grove serves the ACMEHosts, if they are set.
+func acmeChallengeHandler(h http.Handler) http.Handler {
+	if certManager == nil {
+		return h
+	}
+	return certManager.HTTPHandler(h)
+}
@@ -0,0 +1,222 @@
+package grove
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	activityWeeks = 52 // Number of weeks of activity to count
+	week          = 7 * 24 * time.Hour
+)
+
+var (
+	// activityCache caches the results of Activity. Entries are keyed
+	// by the tip SHA and the current week, so they never need to be
+	// invalidated, but it is cleared when it reaches activityCacheMax
+	// entries to bound its size.
+	activityCache    = make(map[string]*Activity)
+	activityCacheMu  sync.Mutex
+	activityCacheMax = 256
+)
+
+// Activity counts the commits in a repository in each of the past
+// activityWeeks weeks, both in total and for each author. It is
+// encoded as the response of the activity API.
+type Activity struct {
+	Tip     string            `json:"tip"`     // Full SHA of HEAD
+	Weeks   []*ActivityWeek   `json:"weeks"`   // Oldest week first
+	Authors []*AuthorActivity `json:"authors"` // Most commits first
+}
+
+// ActivityWeek is the number of commits made in the week beginning
+// at Start, which is midnight UTC on a Sunday, in seconds since the
+// epoch.
+type ActivityWeek struct {
+	Start int64 `json:"week"`
+	Total int   `json:"total"`
+}
+
+// AuthorActivity is the number of commits an author made in each
+// week, in the same order as Activity.Weeks.
+type AuthorActivity struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+	Total int    `json:"total"`
+	Weeks []int  `json:"weeks"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// weekStart returns the beginning of the week containing t, which is
+// midnight UTC on the Sunday before it.
+func weekStart(t time.Time) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	return day.AddDate(0, 0, -int(day.Weekday()))
+}
+
+// Activity counts the commits reachable from HEAD which were made in
+// each of the past activityWeeks weeks, including this one. Results
+// are cached per tip SHA.
+func (g *git) Activity() *Activity {
+	tip := g.FullSHA("HEAD")
+	if len(tip) == 0 {
+		return nil
+	}
+	first := weekStart(time.Now()).AddDate(0, 0, -7*(activityWeeks-1))
+	key := g.Path + "\x00" + tip + "\x00" + strconv.FormatInt(first.Unix(), 10)
+	activityCacheMu.Lock()
+	a, ok := activityCache[key]
+	activityCacheMu.Unlock()
+	if ok {
+		return a
+	}
+
+	a = &Activity{Tip: tip, Weeks: make([]*ActivityWeek, activityWeeks)}
+	for i := range a.Weeks {
+		a.Weeks[i] = &ActivityWeek{Start: first.AddDate(0, 0, 7*i).Unix()}
+	}
+	output, err := g.execute("log", "--format=%at%x00%aN%x00%aE",
+		"--since="+strconv.FormatInt(first.Unix(), 10), tip)
+	if err != nil {
+		return nil
+	}
+	authors := make(map[string]*AuthorActivity)
+	for _, line := range strings.Split(strings.TrimRight(output, "\n"), "\n") {
+		fields := strings.Split(line, "\x00")
+		if len(fields) != 3 {
+			continue
+		}
+		unix, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		n := int(time.Unix(unix, 0).Sub(first) / week)
+		if n < 0 || n >= activityWeeks {
+			continue
+		}
+		a.Weeks[n].Total++
+
+		author, ok := authors[fields[2]]
+		if !ok {
+			author = &AuthorActivity{Name: fields[1], Email: fields[2],
+				Weeks: make([]int, activityWeeks)}
+			authors[fields[2]] = author
+			a.Authors = append(a.Authors, author)
+		}
+		author.Total++
+		author.Weeks[n]++
+	}
+	sort.SliceStable(a.Authors, func(i, j int) bool {
+		return a.Authors[i].Total > a.Authors[j].Total
+	})
+
+	activityCacheMu.Lock()
+	if len(activityCache) >= activityCacheMax {
+		activityCache = make(map[string]*Activity)
+	}
+	activityCache[key] = a
+	activityCacheMu.Unlock()
+	return a
+}
+
+// HandleActivity serves the commit activity of a repository as JSON,
+// at /api/v1/<repo>/activity.
+func HandleActivity(w http.ResponseWriter, req *http.Request) {
+	reqLog(req).Debugf("Activity request %q from %q\n",
+		req.URL.Path, req.RemoteAddr)
+	rest := strings.TrimPrefix(req.URL.Path, prefix+"/api/v1")
+	if !strings.HasSuffix(rest, "/activity") {
+		apiRespond(w, http.StatusNotFound, nil)
+		return
+	}
+	repoURL := strings.TrimSuffix(rest, "/activity")
+
+	toplevel, p := locate(repoURL)
+	repository, file, _, status := SplitRepository(toplevel, p)
+	if status != http.StatusOK {
+		apiRespond(w, status, nil)
+		return
+	}
+	if git, _ := isGit(repository); !git || len(file) != 0 {
+		apiRespond(w, http.StatusNotFound, nil)
+		return
+	}
+
+	g := &git{Path: repository, ctx: req.Context()}
+	a := g.Activity()
+	if a == nil {
+		apiRespond(w, http.StatusNotFound, nil)
+		return
+	}
+	// Activity is cached, so the authors are copied before their
+	// email addresses are hidden.
+	if privacy := conf().RepoEmailPrivacy(repoURL); emailsHidden(privacy) {
+		hidden := *a
+		hidden.Authors = make([]*AuthorActivity, len(a.Authors))
+		for n, author := range a.Authors {
+			copied := *author
+			copied.Email = hideEmail(privacy, author.Email)
+			hidden.Authors[n] = &copied
+		}
+		a = &hidden
+	}
+	apiRespond(w, http.StatusOK, a)
+}
+
+// apiRespond writes v as the JSON encoded response. If v is nil, an
+// error message is written in its place.
+func apiRespond(w http.ResponseWriter, status int, v interface{}) {
+	if v == nil {
+		v = &apiError{Error: http.StatusText(status)}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		l.Errf("API response failed to encode: %s\n", err)
+	}
+}
+
+// activityBar is a bar in the sparkline of a repository's activity
+// which is shown on its main page.
+type activityBar struct {
+	Height int    // Height as a percentage of the busiest week
+	Title  string // Description of the week
+}
+
+// activityBars prepares the weeks of activity for display as a
+// sparkline. If there were no commits in any of them, there are no
+// bars.
+func activityBars(a *Activity) (bars []*activityBar) {
+	if a == nil {
+		return nil
+	}
+	max := 0
+	for _, w := range a.Weeks {
+		if w.Total > max {
+			max = w.Total
+		}
+	}
+	if max == 0 {
+		return nil
+	}
+	bars = make([]*activityBar, len(a.Weeks))
+	for i, w := range a.Weeks {
+		bars[i] = &activityBar{
+			Height: w.Total * 100 / max,
+			Title: strconv.Itoa(w.Total) + " commits in the week of " +
+				time.Unix(w.Start, 0).UTC().Format("Jan 2, 2006"),
+		}
+	}
+	return bars
+}
@@ -0,0 +1,167 @@
+package grove
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxReflogEntries = 50 // Most entries shown from each reflog
+)
+
+// reflogEntry is an entry in the reflog of HEAD or a branch, recording
+// a commit which the ref pointed to.
+type reflogEntry struct {
+	SHA      string    // Full SHA the ref was set to
+	Selector string    // Selector of the entry, such as "master@{...}"
+	Who      string    // Name of the person who updated the ref
+	Message  string    // Reason given, such as "push" or "commit: ..."
+	Time     time.Time // Time of the update
+}
+
+// reflogGroup is the reflog of a single ref, as shown on the reflog
+// page.
+type reflogGroup struct {
+	Name    string         // Branch name, or "HEAD"
+	Current string         // Full SHA the branch points to now, if any
+	Entries []*reflogEntry // Entries, most recent first
+}
+
+// isAdmin checks whether the request carries the AdminPassword setting
+// with HTTP basic authentication, under any user name. It is always
+// false if there is none.
+func isAdmin(req *http.Request) bool {
+	if len(conf().AdminPassword) == 0 {
+		return false
+	}
+	_, password, ok := req.BasicAuth()
+	return ok && subtle.ConstantTimeCompare([]byte(password),
+		[]byte(conf().AdminPassword)) == 1
+}
+
+// sameOrigin checks that a request which changes something was made
+// from one of Grove's own pages, rather than by another site in the
+// administrator's browser, using the Sec-Fetch-Site and Origin headers
+// where the browser sends them.
+func sameOrigin(req *http.Request) bool {
+	switch req.Header.Get("Sec-Fetch-Site") {
+	case "", "same-origin", "none":
+	default:
+		return false
+	}
+	if origin := req.Header.Get("Origin"); len(origin) > 0 {
+		u, err := url.Parse(origin)
+		return err == nil && u.Host == req.Host
+	}
+	return true
+}
+
+// Reflog lists the most recent entries, up to max, in the reflog of
+// the given ref, such as "HEAD" or "refs/heads/master".
+func (g *git) Reflog(ref string, max int) (entries []*reflogEntry) {
+	output, _ := g.execute("reflog", "show", "--date=unix",
+		"--format=%H%x00%gd%x00%gn%x00%gs", "-n", strconv.Itoa(max),
+		ref, "--")
+	for _, line := range strings.Split(strings.TrimRight(output, "\n"), "\n") {
+		fields := strings.SplitN(line, "\x00", 4)
+		if len(fields) != 4 {
+			continue
+		}
+		entry := &reflogEntry{SHA: fields[0], Selector: fields[1],
+			Who: fields[2], Message: fields[3]}
+		// The selector holds the time of the entry, as in
+		// "master@{1700000000}", because of --date=unix.
+		if i := strings.LastIndex(fields[1], "@{"); i >= 0 {
+			unix, err := strconv.ParseInt(
+				strings.TrimSuffix(fields[1][i+2:], "}"), 10, 64)
+			if err == nil {
+				entry.Time = time.Unix(unix, 0)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return
+}
+
+// MakeReflogPage shows the reflogs of HEAD and each branch to
+// administrators, so that commits lost to a force push or a deleted
+// branch can be found, and restores a branch to one of the entries
+// when the form is posted. Visitors without the AdminPassword are
+// asked for it, and if it is not set, the page does not exist.
+func MakeReflogPage(w http.ResponseWriter, req *http.Request, pageinfo *gitPage, g *git) (err error, status int) {
+	if len(conf().AdminPassword) == 0 {
+		return notFound, http.StatusNotFound
+	}
+	if !isAdmin(req) {
+		reqLog(req).Noticef("Reflog request to %q from %q denied\n",
+			req.URL.Path, req.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", `Basic realm="Grove admin", charset="UTF-8"`)
+		Error(w, http.StatusUnauthorized)
+		return nil, http.StatusUnauthorized
+	}
+
+	switch req.Method {
+	case "GET", "HEAD":
+	case "POST":
+		return restoreBranch(w, req, pageinfo, g)
+	default:
+		return methodNotAllowed, http.StatusMethodNotAllowed
+	}
+
+	pageinfo.Reflogs = append(pageinfo.Reflogs, &reflogGroup{
+		Name:    defaultRef,
+		Entries: g.Reflog(defaultRef, maxReflogEntries),
+	})
+	for _, ref := range g.Refs("refs/heads/") {
+		pageinfo.Reflogs = append(pageinfo.Reflogs, &reflogGroup{
+			Name:    strings.TrimPrefix(ref.Name, "refs/heads/"),
+			Current: ref.SHA,
+			Entries: g.Reflog(ref.Name, maxReflogEntries),
+		})
+	}
+
+	// We return 500 here because the error will only be reported
+	// if executeTemplate() results in an error.
+	return executeTemplate(w, "reflog.html", pageinfo),
+		http.StatusInternalServerError
+}
+
+// restoreBranch points the branch given in the posted form at the
+// given commit, if the branch still points at the old SHA given, or
+// creates it if the old SHA is empty and the branch does not exist.
+// It then redirects back to the reflog page.
+func restoreBranch(w http.ResponseWriter, req *http.Request, pageinfo *gitPage, g *git) (err error, status int) {
+	if !sameOrigin(req) {
+		return forbidden, http.StatusForbidden
+	}
+	branch, sha, old := req.PostFormValue("branch"),
+		req.PostFormValue("sha"), req.PostFormValue("old")
+	ref := "refs/heads/" + branch
+	if len(branch) == 0 || strings.HasPrefix(branch, "-") ||
+		g.ResolveCommit(sha) != sha {
+		return badRequest, http.StatusBadRequest
+	}
+	if _, err := g.execute("check-ref-format", ref); err != nil {
+		return badRequest, http.StatusBadRequest
+	}
+
+	// An empty old value requires that the branch not exist, so that
+	// a branch which was changed since the page was loaded is not
+	// overwritten.
+	if _, err := g.execute("update-ref", "-m",
+		"grove: restored from reflog by "+req.RemoteAddr,
+		ref, sha, old); err != nil {
+		return err, http.StatusConflict
+	}
+	reqLog(req).Noticef("Branch %q of %q restored to %s by %q\n",
+		branch, g.Path, sha, req.RemoteAddr)
+	http.Redirect(w, req, prefix+pageinfo.Path+"reflog/",
+		http.StatusSeeOther)
+	return nil, http.StatusSeeOther
+}
@@ -1,4 +1,4 @@
-package main
+package grove
 
 // Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
 
@@ -28,7 +28,23 @@ var (
 	InvalidEncodingError = errors.New("api: invalid encoding requested")
 )
 
-func ServeAPI(w http.ResponseWriter, req *http.Request, g *git, ref string, maxCommits int) (err error) {
+// HandleAPIv1 serves the JSON API under /api/v1/, passing each request
+// to the handler for the kind of resource it names.
+func HandleAPIv1(w http.ResponseWriter, req *http.Request) {
+	rest := strings.TrimPrefix(req.URL.Path, prefix+"/api/v1")
+	switch {
+	case strings.HasSuffix(rest, "/activity"):
+		HandleActivity(w, req)
+	case strings.Contains(rest, "/blame/"):
+		HandleBlame(w, req)
+	case strings.HasSuffix(rest, "/list"):
+		HandleList(w, req)
+	default:
+		apiRespond(w, http.StatusNotFound, nil)
+	}
+}
+
+func ServeAPI(w http.ResponseWriter, req *http.Request, g *git, ref string, maxCommits int, pickaxe Pickaxe) (err error) {
 	// First, determine the encoding and error if it isn't appropriate
 	// or supported. To do this, we need to check the api value and
 	// Accept header. We also want to include the Content-Type.
@@ -77,7 +93,15 @@ func ServeAPI(w http.ResponseWriter, req *http.Request, g *git, ref string, maxC
 		GroveOwner:  gitVarUser(),
 		HEAD:        g.SHA("HEAD"),
 		Description: g.GetBranchDescription(ref),
-		Commits:     g.Commits(ref, maxCommits),
+	}
+	if pickaxe.Active() {
+		r.Commits = g.CommitsPickaxe(ref, maxCommits, pickaxe)
+	} else {
+		r.Commits = g.Commits(ref, maxCommits)
+	}
+	privacy := conf().RepoEmailPrivacy(relPath(g.Path))
+	for _, c := range r.Commits {
+		c.Email = hideEmail(privacy, c.Email)
 	}
 	// Set the Content-Type appropriately in the header.
 	w.Header().Set("Content-Type", c)
@@ -0,0 +1,174 @@
+package grove
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+var (
+	// realmAPIs are the prefixes of URLs which name a repository after
+	// them, such as /api/v1/<repo>/activity, and which are matched
+	// against realms as though they were the repository's own pages.
+	realmAPIs = []string{"/api/v1", "/api/github/repos", "/s"}
+)
+
+// RealmConfig is a part of the site which requires a user name and
+// password, given with HTTP basic authentication.
+type RealmConfig struct {
+	// Pattern is a glob matched against URL paths, such as
+	// "/private/**". As in .editorconfig files, * matches anything
+	// but a slash, ** matches anything, and {a,b} matches either.
+	Pattern string
+
+	// Name is the name of the realm shown when visitors are asked to
+	// log in. If it is not set, the pattern is used.
+	Name string
+
+	// Users maps user names to their passwords. If there are none,
+	// paths matching the realm are open to anyone.
+	Users map[string]string
+
+	re *regexp.Regexp // Compiled Pattern
+}
+
+// compile prepares the realm's pattern for matching.
+func (r *RealmConfig) compile() (err error) {
+	r.re, err = regexp.Compile("^" +
+		globPattern(path.Clean("/"+r.Pattern)) + "$")
+	if len(r.Name) == 0 {
+		r.Name = r.Pattern
+	}
+	return
+}
+
+// Allows checks whether the request carries the name and password of
+// one of the realm's users.
+func (r *RealmConfig) Allows(req *http.Request) bool {
+	user, password, ok := req.BasicAuth()
+	if !ok {
+		return false
+	}
+	expected, ok := r.Users[user]
+	return ok && subtle.ConstantTimeCompare([]byte(password),
+		[]byte(expected)) == 1
+}
+
+// Realm finds the realm which applies to the URL path p, relative to
+// the prefix. It is the first whose pattern matches p, or p as a
+// directory, so that "/private/**" applies to "/private" too. It is
+// nil if that realm has no users, or if there is none.
+func (c *Config) Realm(p string) *RealmConfig {
+	p = path.Clean("/" + p)
+	for n := range c.Realms {
+		r := &c.Realms[n]
+		if r.re == nil || !(r.re.MatchString(p) || r.re.MatchString(p+"/")) {
+			continue
+		}
+		if len(r.Users) == 0 {
+			return nil
+		}
+		return r
+	}
+	return nil
+}
+
+// realmPath finds the path which realms are matched against for a
+// request URL path, which is the path without the prefix, or the path
+// of the repository which an API request names.
+func realmPath(u string) string {
+	u = strings.TrimPrefix(u, prefix)
+	for _, api := range realmAPIs {
+		if strings.HasPrefix(u, api+"/") {
+			return strings.TrimPrefix(u, api)
+		}
+	}
+	return u
+}
+
+// realmPaths finds the URL paths, relative to the prefix, at which the
+// file or directory at the filesystem path p is served. These are its
+// path within the served directory containing it, if any, and its path
+// under the alias whose repository contains it, if any.
+func realmPaths(p string) (paths []string) {
+	p = path.Clean(p)
+	if root := rootOf(p); isWithin(root, p) {
+		paths = append(paths, strings.TrimPrefix(p, root))
+	}
+	if alias, target, ok := conf().Unalias(p); ok {
+		paths = append(paths, alias+strings.TrimPrefix(p, target))
+	}
+	return
+}
+
+// pathRealms finds the realms which apply to the file or directory at
+// the filesystem path p, through any of the URL paths at which it is
+// served.
+func pathRealms(p string) (realms []*RealmConfig) {
+	for _, u := range realmPaths(p) {
+		if realm := conf().Realm(u); realm != nil {
+			realms = append(realms, realm)
+		}
+	}
+	return
+}
+
+// urlRealms finds the realms which apply to the URL path u, relative to
+// the prefix. These are the realm of u itself and those of the file or
+// directory it names, so that a repository in a realm can't be reached
+// without logging in through an alias, nor one under an aliased URL in
+// a realm through its own URL.
+func urlRealms(u string) (realms []*RealmConfig) {
+	if realm := conf().Realm(u); realm != nil {
+		realms = append(realms, realm)
+	}
+	_, p := locate(u)
+	return append(realms, pathRealms(p)...)
+}
+
+// realmHandler wraps a handler so that requests to paths in a realm,
+// whether for web pages or git, are refused unless they carry the name
+// and password of one of its users, and visitors are asked to log in.
+// Where more than one realm applies, the visitor must be a user of
+// each.
+func realmHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for _, realm := range urlRealms(realmPath(req.URL.Path)) {
+			if realm.Allows(req) {
+				continue
+			}
+			reqLog(req).Noticef("Request to %q from %q denied without login to realm %q\n",
+				req.URL.Path, req.RemoteAddr, realm.Name)
+			w.Header().Set("WWW-Authenticate", `Basic realm="`+
+				strings.Replace(realm.Name, `"`, "'", -1)+`", charset="UTF-8"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized),
+				http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// listable checks whether the repository may be listed on a page
+// about the directory, such as a directory listing. Repositories in a
+// realm are only listed on pages in the same realm, which the visitor
+// must have logged in to, and so feeds and listings of the whole site
+// leave them out. Realms are found through aliases as well as through
+// the served directories.
+func listable(directory, repo string) bool {
+	dirRealms := pathRealms(directory)
+	for _, realm := range pathRealms(repo) {
+		found := false
+		for _, r := range dirRealms {
+			found = found || r == realm
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,75 @@
+package grove
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"html/template"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	AvatarsGravatar   = "gravatar"   // Use gravatar.com
+	AvatarsLibravatar = "libravatar" // Use libravatar.org
+	AvatarsLocal      = "local"      // Use images from conf.AvatarDir
+
+	avatarSize   = "40"    // Size of remote avatars in pixels
+	avatarMaxAge = "86400" // Seconds for which clients may cache avatars
+)
+
+var (
+	avatarExts = []string{".png", ".jpg", ".jpeg", ".gif"}
+)
+
+// avatarHash returns the hexadecimal MD5 hash of the normalized email
+// address, which is how Gravatar and Libravatar identify avatars. It
+// is also used to name images in the local avatar directory.
+func avatarHash(email string) string {
+	sum := md5.Sum([]byte(strings.ToLower(strings.TrimSpace(email))))
+	return hex.EncodeToString(sum[:])
+}
+
+// avatarURL returns the URL of the avatar for the given email address
+// according to the Avatars setting, or an empty URL if avatars are
+// disabled.
+func avatarURL(email string) template.URL {
+	if len(email) == 0 {
+		return ""
+	}
+	hash := avatarHash(email)
+	switch conf().Avatars {
+	case AvatarsGravatar:
+		return template.URL("https://www.gravatar.com/avatar/" + hash +
+			"?s=" + avatarSize + "&d=identicon")
+	case AvatarsLibravatar:
+		return template.URL("https://seccdn.libravatar.org/avatar/" + hash +
+			"?s=" + avatarSize + "&d=identicon")
+	case AvatarsLocal:
+		return template.URL(prefix + "/avatar/" + hash)
+	}
+	return ""
+}
+
+// HandleAvatar serves avatars from the local avatar directory. Images
+// are named by the hash of the email address they belong to, such as
+// <hash>.png, and may be cached by clients.
+func HandleAvatar(w http.ResponseWriter, req *http.Request) {
+	hash := path.Base(req.URL.Path)
+	if _, err := hex.DecodeString(hash); err != nil || len(hash) != 32 {
+		http.NotFound(w, req)
+		return
+	}
+	for _, ext := range avatarExts {
+		file := path.Join(conf().AvatarDir, hash+ext)
+		if _, err := os.Stat(file); err == nil {
+			w.Header().Set("Cache-Control", "public, max-age="+avatarMaxAge)
+			http.ServeFile(w, req, file)
+			return
+		}
+	}
+	http.NotFound(w, req)
+}
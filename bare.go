@@ -0,0 +1,69 @@
+package grove
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"os"
+	"path"
+	"strings"
+)
+
+// isBare reports whether p is a bare repository, which has HEAD, its
+// objects, and its refs directly inside of it rather than in a .git
+// directory. The .git directories of other repositories look the same,
+// so they are not counted.
+func isBare(p string) bool {
+	if path.Base(p) == ".git" {
+		return false
+	}
+	for _, name := range []string{"HEAD", "objects", "refs"} {
+		if _, err := os.Stat(path.Join(p, name)); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// gitDirOf returns the git directory of the repository at p, which is
+// its .git directory, or p itself if it is bare. It is empty if p is
+// not a repository.
+func gitDirOf(p string) string {
+	if _, err := os.Stat(path.Join(p, ".git")); err == nil {
+		return path.Join(p, ".git")
+	}
+	if isBare(p) {
+		return p
+	}
+	return ""
+}
+
+// splitGitURL splits a URL path which git clients request over HTTP
+// into the path of the git directory and the file within it, such as
+// "/proj/.git" and "info/refs". Every path within a .git directory is
+// one, but the web interface of a bare repository whose name ends in
+// .git is served under the same paths as the repository itself, so
+// only the files which git clients request there are. It is not ok if
+// the path is not a request from git.
+func splitGitURL(u string) (gitURL, file string, ok bool) {
+	for i := 0; ; {
+		n := strings.Index(u[i:], ".git/")
+		if n < 0 {
+			return "", "", false
+		}
+		i += n + len(".git")
+		gitURL, file = u[:i], u[i+1:]
+		if path.Base(gitURL) == ".git" || isGitFile(file) {
+			return gitURL, file, true
+		}
+	}
+}
+
+// isGitFile reports whether file, within a git directory, is one which
+// git clients request over HTTP.
+func isGitFile(file string) bool {
+	switch file {
+	case "HEAD", uploadPack, receivePack:
+		return true
+	}
+	return strings.HasPrefix(file, "info/") || strings.HasPrefix(file, "objects/")
+}
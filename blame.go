@@ -0,0 +1,188 @@
+package grove
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"errors"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// BlameLine is a line of a file, along with the commit which last
+// changed it, as found by git blame. It is encoded in the response of
+// the blame API.
+type BlameLine struct {
+	Line    int    `json:"line"`    // Line number, starting at 1
+	SHA     string `json:"commit"`  // Full SHA of the commit which last changed the line
+	Author  string `json:"author"`  // Name of the author of that commit
+	Email   string `json:"email"`   // Email address of the author
+	Time    int64  `json:"time"`    // Author time, in seconds since the epoch
+	Summary string `json:"summary"` // Subject of the commit
+	Text    string `json:"text"`    // Contents of the line, without the newline
+}
+
+// BlameResponse is the response of the blame API.
+type BlameResponse struct {
+	Commit string       `json:"commit"` // Full SHA of the commit blamed
+	Path   string       `json:"path"`   // Path of the file in the repository
+	Lines  []*BlameLine `json:"lines"`  // Lines of the file, in order
+}
+
+// blameRow is a line shown on the blame page. Only the first of a run
+// of lines from the same commit shows the commit.
+type blameRow struct {
+	*BlameLine
+	Start bool // Whether the line begins a run from a new commit
+}
+
+// Blame finds the commit which last changed each line of the file at
+// the given ref, using git blame's porcelain format.
+func (g *git) Blame(ref, file string) (lines []*BlameLine, err error) {
+	output, err := g.execute("blame", "--porcelain", ref, "--", file)
+	if err != nil {
+		return nil, err
+	}
+
+	// Each line is introduced by a header of
+	//    <sha> <original line> <final line> [<lines in group>]
+	// and the details of the commit follow the first header naming
+	// it, before the line itself, which begins with a tab.
+	commits := make(map[string]*BlameLine)
+	var commit *BlameLine
+	var number int
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasPrefix(line, "\t") {
+			if commit != nil {
+				l := *commit
+				l.Line, l.Text = number, line[1:]
+				lines = append(lines, &l)
+				commit = nil
+			}
+			continue
+		}
+		key, value, _ := strings.Cut(line, " ")
+		if commit == nil {
+			fields := strings.Fields(value)
+			if len(key) < 40 || len(fields) < 2 {
+				continue
+			}
+			number, _ = strconv.Atoi(fields[1])
+			if commit = commits[key]; commit == nil {
+				commit = &BlameLine{SHA: key}
+				commits[key] = commit
+			}
+			continue
+		}
+		switch key {
+		case "author":
+			commit.Author = value
+		case "author-mail":
+			commit.Email = strings.Trim(value, "<>")
+		case "author-time":
+			commit.Time, _ = strconv.ParseInt(value, 10, 64)
+		case "summary":
+			commit.Summary = value
+		}
+	}
+	if len(lines) == 0 {
+		return nil, errors.New("blame: no lines in " + file)
+	}
+	return
+}
+
+// MakeBlamePage shows each line of a file within a git project along
+// with the commit which last changed it.
+func MakeBlamePage(w http.ResponseWriter, pageinfo *gitPage, g *git, ref, file string) (err error, status int) {
+	if _, objType := g.ObjectAt(ref, file); objType != "blob" {
+		return notFound, http.StatusNotFound
+	}
+	lines, err := g.Blame(ref, file)
+	if err != nil {
+		return notFound, http.StatusNotFound
+	}
+
+	pageinfo.Blame = make([]*blameRow, len(lines))
+	for n, line := range lines {
+		pageinfo.Blame[n] = &blameRow{
+			BlameLine: line,
+			Start:     n == 0 || lines[n-1].SHA != line.SHA,
+		}
+	}
+
+	// We return 500 here because the error will only be reported
+	// if executeTemplate() results in an error.
+	return executeTemplate(w, "blame.html", pageinfo),
+		http.StatusInternalServerError
+}
+
+// HandleBlame serves the blame of a file as JSON, at
+// /api/v1/<repo>/blame/<ref>/<path>. Because both the ref and the path
+// may contain slashes, the shortest leading part which names a commit
+// containing the rest as a file is taken as the ref.
+func HandleBlame(w http.ResponseWriter, req *http.Request) {
+	reqLog(req).Debugf("Blame request %q from %q\n",
+		req.URL.Path, req.RemoteAddr)
+	rest := strings.TrimPrefix(req.URL.Path, prefix+"/api/v1")
+	i := strings.Index(rest, "/blame/")
+	if i < 0 {
+		apiRespond(w, http.StatusNotFound, nil)
+		return
+	}
+	repoURL, spec := rest[:i], rest[i+len("/blame/"):]
+
+	toplevel, p := locate(repoURL)
+	repository, inRepo, _, status := SplitRepository(toplevel, p)
+	if status != http.StatusOK {
+		apiRespond(w, status, nil)
+		return
+	}
+	if git, _ := isGit(repository); !git || len(inRepo) != 0 {
+		apiRespond(w, http.StatusNotFound, nil)
+		return
+	}
+
+	g := &git{Path: repository, ctx: req.Context()}
+	sha, file := g.splitRefPath(spec)
+	if len(sha) == 0 {
+		apiRespond(w, http.StatusNotFound, nil)
+		return
+	}
+	lines, err := g.Blame(sha, file)
+	if err != nil {
+		apiRespond(w, http.StatusNotFound, nil)
+		return
+	}
+	privacy := conf().RepoEmailPrivacy(repoURL)
+	for _, line := range lines {
+		line.Email = hideEmail(privacy, line.Email)
+	}
+	apiRespond(w, http.StatusOK, &BlameResponse{
+		Commit: sha,
+		Path:   file,
+		Lines:  lines,
+	})
+}
+
+// splitRefPath splits "<ref>/<path>" where the ref names a commit in
+// which the path is a file, resolving the ref to the commit's full SHA.
+// The SHA is empty if there is no such split.
+func (g *git) splitRefPath(spec string) (sha, file string) {
+	for i := strings.IndexByte(spec, '/'); i >= 0; {
+		ref, file := spec[:i], path.Clean(spec[i+1:])
+		if len(ref) > 0 && !strings.HasPrefix(ref, "-") {
+			if sha := g.FullSHA(ref); len(sha) > 0 {
+				if _, objType := g.ObjectAt(sha, file); objType == "blob" {
+					return sha, file
+				}
+			}
+		}
+		next := strings.IndexByte(spec[i+1:], '/')
+		if next < 0 {
+			break
+		}
+		i += next + 1
+	}
+	return "", ""
+}
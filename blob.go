@@ -0,0 +1,162 @@
+package grove
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"html/template"
+	"path"
+	"strconv"
+	"strings"
+)
+
+var (
+	// languages maps file extensions, and the names of files which
+	// have none, to the language they are written in.
+	languages = map[string]string{
+		".c": "C", ".h": "C", ".cc": "C++", ".cpp": "C++", ".cxx": "C++",
+		".hh": "C++", ".hpp": "C++", ".cs": "C#", ".go": "Go",
+		".rs": "Rust", ".java": "Java", ".kt": "Kotlin", ".scala": "Scala",
+		".swift": "Swift", ".m": "Objective-C", ".py": "Python",
+		".rb": "Ruby", ".pl": "Perl", ".pm": "Perl", ".php": "PHP",
+		".lua": "Lua", ".js": "JavaScript", ".mjs": "JavaScript",
+		".jsx": "JavaScript", ".ts": "TypeScript", ".tsx": "TypeScript",
+		".sh": "Shell", ".bash": "Shell", ".zsh": "Shell", ".fish": "Fish",
+		".hs": "Haskell", ".ml": "OCaml", ".erl": "Erlang", ".ex": "Elixir",
+		".exs": "Elixir", ".clj": "Clojure", ".el": "Emacs Lisp",
+		".lisp": "Common Lisp", ".scm": "Scheme", ".r": "R", ".jl": "Julia",
+		".sql": "SQL", ".html": "HTML", ".htm": "HTML", ".css": "CSS",
+		".scss": "SCSS", ".xml": "XML", ".json": "JSON", ".yaml": "YAML",
+		".yml": "YAML", ".toml": "TOML", ".ini": "INI", ".md": "Markdown",
+		".markdown": "Markdown", ".rst": "reStructuredText",
+		".tex": "TeX", ".proto": "Protocol Buffers", ".vim": "Vim script",
+		".diff": "Diff", ".patch": "Diff", ".1": "Roff", ".txt": "Text",
+		"Makefile": "Makefile", "GNUmakefile": "Makefile",
+		"Dockerfile": "Dockerfile", "CMakeLists.txt": "CMake",
+		"Rakefile": "Ruby", "Gemfile": "Ruby", "go.mod": "Go module",
+	}
+
+	// fileModes describes the modes which git records for files.
+	fileModes = map[string]string{
+		"100644": "regular file",
+		"100755": "executable",
+		"120000": "symbolic link",
+		"160000": "submodule",
+	}
+)
+
+// blobInfo describes a file shown on its page, in a header above its
+// contents.
+type blobInfo struct {
+	Size      int64        // Size in bytes
+	Lines     int          // Number of lines, if the file is text
+	Mode      string       // File mode, such as "100644"
+	ModeName  string       // Description of the mode, if known
+	Language  string       // Language the file is written in, if known
+	Last      *gitLog      // Last commit which changed the file
+	Raw       template.URL // Link to the raw file
+	Blame     template.URL // Link to the blame of the file
+	History   template.URL // Link to the log of the file
+	Permalink template.URL // Link to the file at the current commit
+	Replaced  string       // SHA of the blob replacing this one, if any
+	Charset   string       // Charset the file was found to be in, if text
+}
+
+// Entry retrieves the tree entry for the file at the given path in the
+// given commit, including its mode and size. It is nil if there is
+// none.
+func (g *git) Entry(commit, file string) *TreeEntry {
+	output, _ := g.execute("ls-tree", "-l", "-z", commit, "--", file)
+	// The line looks like
+	//    <mode> <type> <sha> <size><tab><name>
+	parts := strings.SplitN(strings.TrimRight(output, "\x00"), "\t", 2)
+	if len(parts) != 2 {
+		return nil
+	}
+	fields := strings.Fields(parts[0])
+	if len(fields) != 4 {
+		return nil
+	}
+	size, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		size = -1
+	}
+	return &TreeEntry{
+		Mode: fields[0],
+		Type: fields[1],
+		SHA:  fields[2],
+		Size: size,
+		Name: parts[1],
+	}
+}
+
+// LastCommit retrieves the most recent commit reachable from ref which
+// changed the file, or nil if there is none.
+func (g *git) LastCommit(ref, file string) *Commit {
+	commits := g.parseLog(ref, 1, "--", file)
+	if len(commits) == 0 || len(commits[0].SHA) == 0 {
+		return nil
+	}
+	return commits[0]
+}
+
+// language guesses the language a file is written in from its name,
+// or returns an empty string.
+func language(file string) string {
+	base := path.Base(file)
+	if lang, ok := languages[base]; ok {
+		return lang
+	}
+	return languages[strings.ToLower(path.Ext(base))]
+}
+
+// tipOf finds the ref at which a file is shown, which for a range is
+// its end.
+func tipOf(ref string) string {
+	if i := strings.LastIndex(ref, ".."); i >= 0 {
+		return ref[i+2:]
+	}
+	return ref
+}
+
+// makeBlobInfo gathers the information about a file shown above its
+// contents, and the links to its other views. Those keep the query of
+// the page, except for options which only apply to the file page, and
+// the permalink names the commit rather than ref. A range is shown at
+// its end, which the permalink pins.
+func makeBlobInfo(pageinfo *gitPage, g *git, ref, file string, contents []byte) *blobInfo {
+	tip := tipOf(ref)
+	info := &blobInfo{
+		Size:     int64(len(contents)),
+		Language: language(file),
+	}
+	if entry := g.Entry(tip, file); entry != nil {
+		// The contents may have been converted from another charset,
+		// so the size is that which git records.
+		if entry.Size >= 0 {
+			info.Size = entry.Size
+		}
+		info.Mode = entry.Mode
+		info.ModeName = fileModes[entry.Mode]
+		info.Replaced = g.Replacements()[entry.SHA]
+	}
+	if !isBinary(contents) && len(contents) > 0 {
+		info.Lines = strings.Count(string(contents), "\n")
+		if contents[len(contents)-1] != '\n' {
+			info.Lines++
+		}
+	}
+
+	q := withQuery(pageinfo.Query, "render", "", "hex", "")
+	base := template.URL(prefix + pageinfo.Path)
+	info.Raw = base + template.URL("raw/"+escapePath(file)) + q
+	info.Blame = base + template.URL("blame/"+escapePath(file)) + q
+	info.History = base + withQuery(q, "path", file)
+	if c := g.LastCommit(ref, file); c != nil {
+		info.Last = makeLog(c, pageinfo.Owner)
+	}
+	if sha := g.FullSHA(tip); len(sha) > 0 {
+		info.Permalink = base + template.URL("blob/"+escapePath(file)) +
+			withQuery(q, "ref", sha, "since", "", "until", "")
+	}
+	return info
+}
@@ -0,0 +1,110 @@
+package grove
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"html/template"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	// repoLogoFile is the file, within a repository at HEAD, which is
+	// shown as its logo and used as the favicon of its pages.
+	repoLogoFile = ".grove/logo.png"
+)
+
+// BrandingConfig holds the settings which change how Grove presents
+// the site as a whole, on every page.
+type BrandingConfig struct {
+	// Title is the name of the site, shown in page titles in place
+	// of the owner's name and "[Grove]".
+	Title string
+
+	// Logo and Favicon are image files shown at the top of every
+	// page and as the icon of pages. The logo is only shown if it is
+	// set, and the favicon in the resources directory is used
+	// otherwise.
+	Logo    string
+	Favicon string
+
+	// Footer is text shown at the bottom of every page.
+	Footer string
+
+	// HeadFile and FooterFile are files of HTML, such as analytics
+	// scripts or announcements, which are added to the end of the
+	// <head> and to the footer of every page. They are read when the
+	// configuration is loaded. "{nonce}" in them is replaced with the
+	// nonce of the page, so that inline scripts and styles are
+	// allowed by the Content-Security-Policy.
+	HeadFile   string
+	FooterFile string
+
+	head, footer string // Contents of HeadFile and FooterFile
+}
+
+// load reads the HeadFile and FooterFile, if they are set.
+func (b *BrandingConfig) load() error {
+	for _, f := range []struct {
+		file     string
+		contents *string
+	}{{b.HeadFile, &b.head}, {b.FooterFile, &b.footer}} {
+		if len(f.file) == 0 {
+			continue
+		}
+		contents, err := os.ReadFile(f.file)
+		if err != nil {
+			return err
+		}
+		*f.contents = string(contents)
+	}
+	return nil
+}
+
+// HeadHTML returns the contents of the HeadFile for a page with the
+// given nonce.
+func (b BrandingConfig) HeadHTML(nonce string) template.HTML {
+	return template.HTML(strings.Replace(b.head, "{nonce}", nonce, -1))
+}
+
+// FooterHTML returns the contents of the FooterFile for a page with
+// the given nonce.
+func (b BrandingConfig) FooterHTML(nonce string) template.HTML {
+	return template.HTML(strings.Replace(b.footer, "{nonce}", nonce, -1))
+}
+
+// siteBranding returns the branding settings, for use by templates as
+// the site function.
+func siteBranding() BrandingConfig {
+	return conf().Branding
+}
+
+// HandleIcon serves the favicon, which is the Favicon of the branding
+// settings, or the one in the resources.
+func HandleIcon(w http.ResponseWriter, req *http.Request) {
+	if len(conf().Branding.Favicon) > 0 {
+		http.ServeFile(w, req, conf().Branding.Favicon)
+		return
+	}
+	serveResource(w, req, "favicon.png")
+}
+
+// HandleLogo serves the Logo of the branding settings, or the logo in
+// the resources if it is not set.
+func HandleLogo(w http.ResponseWriter, req *http.Request) {
+	if len(conf().Branding.Logo) > 0 {
+		http.ServeFile(w, req, conf().Branding.Logo)
+		return
+	}
+	serveResource(w, req, "logo.png")
+}
+
+// repoLogo links to the repository's own logo, which is the
+// repoLogoFile at HEAD, or is empty if it has none.
+func repoLogo(pageinfo *gitPage, g *git) template.URL {
+	if _, objType := g.ObjectAt("HEAD", repoLogoFile); objType != "blob" {
+		return ""
+	}
+	return template.URL(prefix + pageinfo.Path + "raw/" + repoLogoFile)
+}
@@ -0,0 +1,204 @@
+package grove
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// catFiles holds a long-lived "git cat-file --batch-command"
+	// process for each repository whose objects were recently read,
+	// keyed by its path, so that reading a file or looking up an
+	// object does not fork a new git. Processes which have not been
+	// used for catFileIdle are stopped, and no more than catFileMax
+	// are kept at once.
+	catFiles     = make(map[string]*catFile)
+	catFilesMu   sync.Mutex
+	catFileIdle  = 2 * time.Minute
+	catFileMax   = 64
+	catFilesReap sync.Once
+
+	// errCatFileBusy is returned when the repository's process is
+	// serving another request, or there is no room for another.
+	errCatFileBusy = errors.New("cat-file: no process available")
+)
+
+// catFile is a running "git cat-file --batch-command" process. It
+// answers one command at a time, so mu must be held while one is
+// written and its reply read.
+type catFile struct {
+	mu     sync.Mutex
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+	used   time.Time // Time of the last command, guarded by catFilesMu
+}
+
+// catFileFor returns the process for the repository at dir, locked,
+// starting one if there is none. If the process is busy, or the pool
+// is full, errCatFileBusy is returned, so that the caller may run git
+// itself rather than wait.
+func catFileFor(dir string) (c *catFile, err error) {
+	catFilesReap.Do(func() { go reapCatFiles() })
+
+	catFilesMu.Lock()
+	defer catFilesMu.Unlock()
+	if c = catFiles[dir]; c != nil {
+		if !c.mu.TryLock() {
+			return nil, errCatFileBusy
+		}
+		c.used = time.Now()
+		return c, nil
+	}
+	if len(catFiles) >= catFileMax {
+		return nil, errCatFileBusy
+	}
+
+	cmd := exec.Command(conf().GitBin, "cat-file", "--batch-command")
+	cmd.Dir = dir
+	cmd.Env = gitEnv()
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+	c = &catFile{
+		cmd:    cmd,
+		stdin:  stdin,
+		stdout: bufio.NewReader(stdout),
+		used:   time.Now(),
+	}
+	c.mu.Lock()
+	catFiles[dir] = c
+	return c, nil
+}
+
+// close stops the process and removes it from the pool, if it is still
+// there.
+func (c *catFile) close(dir string) {
+	catFilesMu.Lock()
+	if catFiles[dir] == c {
+		delete(catFiles, dir)
+	}
+	catFilesMu.Unlock()
+	c.stdin.Close()
+	c.cmd.Process.Kill()
+	c.cmd.Wait()
+}
+
+// reapCatFiles periodically stops the processes which have been idle
+// for longer than catFileIdle. Processes in use are left alone.
+func reapCatFiles() {
+	for range time.Tick(catFileIdle / 2) {
+		var idle []*catFile
+		var dirs []string
+		catFilesMu.Lock()
+		for dir, c := range catFiles {
+			if time.Since(c.used) > catFileIdle && c.mu.TryLock() {
+				idle = append(idle, c)
+				dirs = append(dirs, dir)
+			}
+		}
+		catFilesMu.Unlock()
+		for n, c := range idle {
+			l.Debugf("Stopping idle cat-file for %q\n", dirs[n])
+			c.close(dirs[n])
+		}
+	}
+}
+
+// catFileObject asks the repository's cat-file process about the
+// object named by name, such as "<commit>:<path>". The command is
+// either "info", for only the SHA and type of the object, or
+// "contents", for those and its contents. The type is empty if there
+// is no such object. If the process fails, it is stopped, and an error
+// is returned, so that the caller may run git itself instead.
+func (g *git) catFileObject(command, name string) (sha, objType string, contents []byte, err error) {
+	// Names are sent one per line, and so can't contain newlines.
+	if len(g.Path) == 0 || strings.ContainsAny(name, "\n") {
+		return "", "", nil, errCatFileBusy
+	}
+	c, err := catFileFor(g.Path)
+	if err != nil {
+		return "", "", nil, err
+	}
+	span := g.startSpan([]string{"cat-file", "--batch-command", command, name})
+	sha, objType, contents, err = c.object(command, name)
+	endSpan(span, err)
+	if err != nil {
+		l.Errf("cat-file for %q failed: %s\n", g.Path, err)
+		c.close(g.Path)
+		return "", "", nil, err
+	}
+	c.mu.Unlock()
+	return
+}
+
+// object writes a command to the process and reads its reply, which
+// begins with a line of the form "<sha> <type> <size>", followed, for
+// "contents", by the object and a newline, or is "<name> missing" if
+// there is no such object.
+func (c *catFile) object(command, name string) (sha, objType string, contents []byte, err error) {
+	if _, err = fmt.Fprintf(c.stdin, "%s %s\n", command, name); err != nil {
+		return
+	}
+	header, err := c.stdout.ReadString('\n')
+	if err != nil {
+		return
+	}
+	fields := strings.Fields(strings.TrimSuffix(header, "\n"))
+	if n := len(fields); n > 0 && (fields[n-1] == "missing" || fields[n-1] == "ambiguous") {
+		return "", "", nil, nil
+	}
+	if len(fields) != 3 {
+		return "", "", nil, fmt.Errorf("unexpected reply %q", header)
+	}
+	size, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return
+	}
+	if command == "contents" {
+		contents = make([]byte, size+1)
+		if _, err = io.ReadFull(c.stdout, contents); err != nil {
+			return
+		}
+		contents = contents[:size]
+	}
+	return fields[0], fields[1], contents, nil
+}
+
+// treeNames lists the names in the contents of a tree object, in
+// order, with a "/" after those which are trees. Each entry is the
+// mode, a space, the name, a NUL, and the SHA in hashLen bytes.
+func treeNames(tree []byte, hashLen int) (names []string) {
+	for len(tree) > 0 {
+		sp := bytes.IndexByte(tree, ' ')
+		nul := bytes.IndexByte(tree, 0)
+		if sp < 0 || nul < sp || len(tree) < nul+1+hashLen {
+			break
+		}
+		name := string(tree[sp+1 : nul])
+		if string(tree[:sp]) == "40000" {
+			name += "/"
+		}
+		names = append(names, name)
+		tree = tree[nul+1+hashLen:]
+	}
+	return
+}
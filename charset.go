@@ -0,0 +1,126 @@
+package grove
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"bytes"
+	"golang.org/x/text/encoding/htmlindex"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	// guessedCharsets are the charsets which text that is not UTF-8
+	// is tried in, in order, when the repository does not declare
+	// one. The first which decodes without errors is used, and the
+	// last, which accepts any bytes, is the fallback.
+	guessedCharsets = []string{"shift_jis", "euc-jp", "windows-1252"}
+
+	// byteOrderMarks maps the byte order marks which may begin a
+	// file to the charset they indicate.
+	byteOrderMarks = []struct {
+		mark    []byte
+		charset string
+	}{
+		{[]byte{0xef, 0xbb, 0xbf}, "utf-8"},
+		{[]byte{0xff, 0xfe}, "utf-16le"},
+		{[]byte{0xfe, 0xff}, "utf-16be"},
+	}
+)
+
+// TextAttributes retrieves the encoding and working-tree-encoding
+// attributes which the .gitattributes files at the given ref set for
+// the file, or empty strings for those which are not set. Reading the
+// attributes from a ref requires git 2.40 or later, and with older
+// versions, neither is ever set.
+func (g *git) TextAttributes(ref, file string) (enc, workingTree string) {
+	output, err := g.execute("check-attr", "-z", "--source="+ref,
+		"encoding", "working-tree-encoding", "--", file)
+	if err != nil {
+		return "", ""
+	}
+	// The output is a series of
+	//    <path> NUL <attribute> NUL <value> NUL
+	fields := strings.Split(output, "\x00")
+	for n := 0; n+2 < len(fields); n += 3 {
+		value := fields[n+2]
+		switch value {
+		case "unspecified", "unset", "set":
+			continue
+		}
+		switch fields[n+1] {
+		case "encoding":
+			enc = value
+		case "working-tree-encoding":
+			workingTree = value
+		}
+	}
+	return
+}
+
+// decodeText converts the contents of a file to UTF-8 for display, and
+// returns the name of the charset they were found to be in. A byte
+// order mark is honored first, then the declared charset, if any. Text
+// which is valid UTF-8 is left as it is, and otherwise the hint, which
+// may be empty, and then each of the guessedCharsets is tried. Binary
+// contents are returned unchanged, with no charset.
+func decodeText(contents []byte, declared, hint string) (text []byte, charset string) {
+	for _, bom := range byteOrderMarks {
+		if bytes.HasPrefix(contents, bom.mark) {
+			if text, ok := decodeAs(contents[len(bom.mark):], bom.charset); ok {
+				return text, strings.ToUpper(bom.charset)
+			}
+		}
+	}
+	if isBinary(contents) {
+		return contents, ""
+	}
+
+	if len(declared) > 0 {
+		if text, ok := decodeAs(contents, declared); ok {
+			return text, charsetName(declared)
+		}
+	}
+	if utf8.Valid(contents) {
+		return contents, "UTF-8"
+	}
+
+	candidates := guessedCharsets
+	if len(hint) > 0 {
+		candidates = append([]string{hint}, candidates...)
+	}
+	for n, name := range candidates {
+		text, ok := decodeAs(contents, name)
+		// Decoders replace invalid sequences rather than failing,
+		// so those which produced a replacement character are
+		// passed over, except for the fallback.
+		if ok && (n == len(candidates)-1 ||
+			!bytes.ContainsRune(text, utf8.RuneError)) {
+			return text, charsetName(name)
+		}
+	}
+	return contents, ""
+}
+
+// decodeAs converts contents in the named charset to UTF-8. It is not
+// ok if the charset is not known.
+func decodeAs(contents []byte, name string) (text []byte, ok bool) {
+	enc, err := htmlindex.Get(name)
+	if err != nil {
+		return nil, false
+	}
+	text, err = enc.NewDecoder().Bytes(contents)
+	return text, err == nil
+}
+
+// charsetName finds the canonical name of a charset, such as
+// "WINDOWS-1252" for "latin1", or returns the name given, uppercased,
+// if it is not known.
+func charsetName(name string) string {
+	if enc, err := htmlindex.Get(name); err == nil {
+		if canonical, err := htmlindex.Name(enc); err == nil {
+			name = canonical
+		}
+	}
+	return strings.ToUpper(name)
+}
@@ -0,0 +1,224 @@
+package grove
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ChatSlack      = "slack"      // Slack incoming webhooks
+	ChatMattermost = "mattermost" // Mattermost incoming webhooks
+	ChatMatrix     = "matrix"     // Matrix rooms, via the client API
+
+	chatCommits = 10 // Most commits of each ref listed in a message
+)
+
+var (
+	// chatClient is used to post messages, so that an unresponsive
+	// chat server can't hold on to a push notification forever.
+	chatClient = &http.Client{Timeout: 30 * time.Second}
+)
+
+// ChatConfig holds the settings for posting messages about pushes to
+// a chat system.
+type ChatConfig struct {
+	// Format is the chat system the message is formatted for, which
+	// is one of ChatSlack, ChatMattermost, or ChatMatrix.
+	Format string
+
+	// URL is the incoming webhook URL for Slack and Mattermost, or
+	// the URL of the homeserver for Matrix, such as
+	// "https://matrix.example.com".
+	URL string
+
+	// Channel overrides the channel of a Slack or Mattermost webhook,
+	// if it is set. For Matrix, it is the ID of the room to post in,
+	// such as "!abcdef:example.com", and Token is the access token of
+	// the user to post as.
+	Channel string
+	Token   string
+
+	// Repos is a list of glob patterns, (as understood by
+	// path.Match,) which are matched against paths relative to the
+	// served directory. If it is not empty, only pushes to matching
+	// repositories are posted.
+	Repos []string
+}
+
+// Matches checks whether pushes to the repository at the URL path
+// repo should be posted.
+func (c ChatConfig) Matches(repo string) bool {
+	if len(c.Repos) == 0 {
+		return true
+	}
+	repo = strings.Trim(repo, "/")
+	for _, pattern := range c.Repos {
+		if matchPath(pattern, repo) {
+			return true
+		}
+	}
+	return false
+}
+
+// postChat posts a message about the push to each of the configured
+// chat systems which want it. Errors are logged.
+func postChat(event *pushEvent) {
+	for _, c := range conf().Chat {
+		if !c.Matches(event.Repo) {
+			continue
+		}
+		if err := c.Post(event); err != nil {
+			l.Errf("Could not post push to %q to %s: %s\n", event.Repo,
+				c.Format, err)
+		}
+	}
+}
+
+// Post formats a message about the push and sends it.
+func (c ChatConfig) Post(event *pushEvent) error {
+	var method, u string
+	var message interface{}
+	switch c.Format {
+	case ChatSlack, ChatMattermost:
+		msg := map[string]string{"text": chatText(event, c.Format)}
+		if len(c.Channel) > 0 {
+			msg["channel"] = c.Channel
+		}
+		method, u, message = "POST", c.URL, msg
+	case ChatMatrix:
+		// Each message is sent with a new transaction ID, so that the
+		// homeserver does not ignore it as a retry.
+		method = "PUT"
+		u = strings.TrimRight(c.URL, "/") + "/_matrix/client/v3/rooms/" +
+			url.PathEscape(c.Channel) + "/send/m.room.message/grove" +
+			strconv.FormatInt(time.Now().UnixNano(), 36)
+		message = map[string]string{
+			"msgtype":        "m.notice",
+			"body":           chatText(event, ""),
+			"format":         "org.matrix.custom.html",
+			"formatted_body": chatText(event, ChatMatrix),
+		}
+	default:
+		return fmt.Errorf("unknown chat format %q", c.Format)
+	}
+
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.Format == ChatMatrix {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	resp, err := chatClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("server responded %s", resp.Status)
+	}
+	return nil
+}
+
+// chatText formats a summary of the push, with links in the markup of
+// the given chat format. If the format is empty, it is plain text.
+func chatText(event *pushEvent, format string) string {
+	repoURL := event.Root + event.Repo + "/"
+	link := func(text, u string) string {
+		switch format {
+		case ChatSlack:
+			return "<" + u + "|" + slackEscape(text) + ">"
+		case ChatMattermost:
+			return "[" + text + "](" + u + ")"
+		case ChatMatrix:
+			return `<a href="` + html.EscapeString(u) + `">` +
+				html.EscapeString(text) + "</a>"
+		}
+		return text
+	}
+	escape := func(text string) string {
+		switch format {
+		case ChatSlack:
+			return slackEscape(text)
+		case ChatMatrix:
+			return html.EscapeString(text)
+		}
+		return text
+	}
+	newline := "\n"
+	if format == ChatMatrix {
+		newline = "<br/>\n"
+	}
+
+	var b strings.Builder
+	repo := link(strings.Trim(event.Repo, "/"), repoURL)
+	for n, u := range event.Updates {
+		if n > 0 {
+			b.WriteString(newline)
+		}
+		ref := link(u.ShortName(),
+			repoURL+"?ref="+url.QueryEscape(u.ShortName()))
+		switch {
+		case u.Deleted():
+			fmt.Fprintf(&b, "[%s] %s %s deleted", repo, u.Kind(),
+				escape(u.ShortName()))
+			continue
+		case u.Created():
+			fmt.Fprintf(&b, "[%s] %s %s created", repo, u.Kind(), ref)
+		default:
+			fmt.Fprintf(&b, "[%s] %s pushed to %s (%s)", repo,
+				pluralCommits(len(u.Commits), u.More), ref,
+				link("compare", repoURL+"compare/"+u.Old+"..."+u.New))
+		}
+		for i, c := range u.Commits {
+			if i == chatCommits {
+				fmt.Fprintf(&b, "%s… and %d more", newline,
+					len(u.Commits)-chatCommits)
+				break
+			}
+			fmt.Fprintf(&b, "%s%s: %s - %s", newline,
+				link(fmt.Sprintf("%.7s", c.SHA), repoURL+"commit/"+c.SHA),
+				escape(c.Subject),
+				escape(c.Author))
+		}
+	}
+	if len(format) == 0 {
+		// Links are left out of plain text, so add one to the
+		// repository for the reader to follow.
+		b.WriteString("\n" + repoURL)
+	}
+	return b.String()
+}
+
+// pluralCommits describes a number of new commits, such as "3 new
+// commits". If more is set, there are more than n.
+func pluralCommits(n int, more bool) string {
+	s := strconv.Itoa(n)
+	if more {
+		s += "+"
+	}
+	if n == 1 && !more {
+		return s + " new commit"
+	}
+	return s + " new commits"
+}
+
+// slackEscape escapes the characters which Slack treats as markup
+// within message text.
+func slackEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
@@ -0,0 +1,193 @@
+// Grove - Git self-hosting for developers
+//
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (GPLv3)
+package main
+
+import (
+	"flag"
+	"github.com/SashaCrofter/grove"
+	"github.com/inhies/go-utils/log"
+	_ "log"
+	"os"
+	"path"
+	"strings"
+)
+
+var (
+	l *log.Logger
+)
+
+const (
+	usage = "usage: %s [repositorydir ...]\n"
+)
+
+var (
+	fQuiet = flag.Bool("q", false, "disable logging output")
+	//	fVerbose = flag.Bool("v", false, "enable verbose output")
+	fDebug = flag.Bool("debug", false, "enable debugging output")
+
+	fBinds  bindList // Addresses given with --bind
+	fPort   = flag.String("port", grove.Port, "port to listen on")
+	fRes    = flag.String("res", grove.Resources, "directory of resources overriding the built-in ones")
+	fHost   = flag.String("host", grove.BaseURL, "hostname and prefix to use in links")
+	fBase   = flag.String("base-url", "", "URL at which grove is reached, such as https://example.com/grove")
+	fACME   = flag.String("acme-host", "", "comma-separated hostnames for which to obtain certificates from Let's Encrypt")
+	fWeb    = flag.Bool("web", true, "enable web browsing")
+	fConf   = flag.String("conf", "", "configuration file")
+	fFollow = flag.Bool("follow-symlinks", false, "serve symlinks to repositories outside of the served directory")
+	fPerms  = flag.Uint("perms", grove.Perms, "required readability: 0 global, 1 group, 2 owner")
+	fDev    = flag.Bool("dev", false, "re-read templates on every request and disable caching, for template development")
+	fGitBin = flag.String("git-bin", grove.DefaultConfig().GitBin, "git executable to run")
+
+	fDebugHandlers = flag.Bool("debug-handlers", false, "serve pprof and expvar under /debug/")
+	fProxyProtocol = flag.Bool("proxy-protocol", false, "require a PROXY protocol header on every connection")
+	fH2C           = flag.Bool("h2c", false, "accept HTTP/2 without TLS, for use behind reverse proxies")
+	fSocketMode    = flag.Uint("socket-mode", 0, "permissions of Unix sockets listened on, such as 0660 (default from umask)")
+
+	fShowVersion  = flag.Bool("version", false, "print major version and exit")
+	fShowFVersion = flag.Bool("version-full", false, "print full version and exit")
+	fShowBind     = flag.Bool("show-bind", false, "print default bind interface and exit")
+	fShowPort     = flag.Bool("show-port", false, "print default port and exit")
+	fShowRes      = flag.Bool("show-res", false, "print default resources directory and exit")
+)
+
+// bindList is a flag.Value which collects the address given with each
+// use of --bind.
+type bindList []string
+
+func (b *bindList) String() string {
+	return strings.Join(*b, ",")
+}
+
+func (b *bindList) Set(s string) error {
+	*b = append(*b, s)
+	return nil
+}
+
+func init() {
+	flag.Var(&fBinds, "bind", "interface or address to listen on, which may be given more than once (default "+grove.Bind+")")
+	flag.Var(&fBinds, "listen", "same as --bind")
+}
+
+func main() {
+	flag.Parse()
+	if len(fBinds) == 0 {
+		fBinds = bindList{grove.Bind}
+	}
+
+	// Open a new logger with an appropriate log level.
+	level := grove.LogLevel
+	if *fQuiet {
+		level = -1 // Disable ALL output
+		//	} else if *fVerbose {
+		//		level = log.INFO
+	} else if *fDebug {
+		level = log.DEBUG
+	}
+	l, _ = log.NewLevel(level, true, os.Stdout, "", log.Ltime)
+	grove.SetLogger(l)
+
+	// If any of the 'show' flags are set, print the relevant variable
+	// and exit.
+	switch {
+	case *fShowVersion:
+		l.Println(grove.Version)
+		return
+	case *fShowFVersion:
+		l.Println(grove.Version)
+		return
+	case *fShowBind:
+		l.Println(grove.Bind)
+		return
+	case *fShowPort:
+		l.Println(grove.Port)
+		return
+	case *fShowRes:
+		l.Println(grove.Resources)
+		return
+	}
+
+	l.Infof("Starting Grove version %s\n", grove.Version)
+
+	conf, err := loadConfig()
+	if err != nil {
+		l.Fatalf("Error loading configuration: %s\n", err)
+	}
+
+	// Every directory given is served, or else the working directory.
+	wd, err := os.Getwd()
+	if err != nil {
+		l.Fatalf("Error getting working directory: %s\n", err)
+	}
+	repodirs := []string{wd}
+	if flag.NArg() > 0 {
+		repodirs = repodirs[:0]
+		for _, repodir := range flag.Args() {
+			if !path.IsAbs(repodir) {
+				repodir = path.Join(wd, repodir)
+			}
+			repodirs = append(repodirs, path.Clean(repodir))
+		}
+	}
+
+	grove.Serve(conf, loadConfig, repodirs...)
+}
+
+// loadConfig loads the configuration file, if one was given, or else
+// the defaults, and overrides it with the flags which were given
+// explicitly. The flags which are not settings in the file are always
+// used.
+func loadConfig() (c *grove.Config, err error) {
+	c = grove.DefaultConfig()
+	if len(*fConf) > 0 {
+		if c, err = grove.LoadConfig(*fConf); err != nil {
+			return nil, err
+		}
+		l.Debugf("Loaded configuration from %q\n", *fConf)
+	}
+
+	// Flags which were given explicitly override the configuration.
+	if flagSet("perms") {
+		c.Perms = *fPerms
+	}
+	if flagSet("follow-symlinks") {
+		c.FollowSymlinks = *fFollow
+	}
+	if flagSet("git-bin") {
+		c.GitBin = *fGitBin
+	}
+	if flagSet("base-url") {
+		c.ExternalURL = *fBase
+	}
+	if flagSet("acme-host") {
+		c.ACMEHosts = nil
+		for _, host := range strings.Split(*fACME, ",") {
+			if host = strings.TrimSpace(host); len(host) > 0 {
+				c.ACMEHosts = append(c.ACMEHosts, host)
+			}
+		}
+	}
+
+	c.Web = *fWeb
+	c.Host = *fHost
+	c.Resources = *fRes
+	c.Dev = *fDev
+	c.DebugHandlers = *fDebugHandlers
+	c.Binds = fBinds
+	c.Port = *fPort
+	c.SocketMode = *fSocketMode
+	c.ProxyProtocol = *fProxyProtocol
+	c.H2C = *fH2C
+	return c, nil
+}
+
+// flagSet reports whether the flag with the given name was set on the
+// command line, rather than left at its default.
+func flagSet(name string) (set bool) {
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return
+}
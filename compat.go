@@ -0,0 +1,234 @@
+package grove
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"net/url"
+	"strings"
+)
+
+// cgitViews lists the cgit page names which can be translated to
+// Grove URLs.
+var cgitViews = map[string]bool{
+	"about": true, "summary": true, "log": true, "tree": true,
+	"plain": true, "commit": true, "diff": true, "refs": true,
+	"tag": true, "snapshot": true,
+}
+
+// findRepoURL splits the URL path u at the first element which is in
+// the given set of view names and follows the path of a repository.
+// It returns the repository's URL path, the view name, and the
+// remainder of the path.
+func findRepoURL(u string, views map[string]bool) (repo, view, rest string, ok bool) {
+	parts := strings.Split(strings.Trim(u, "/"), "/")
+	for n, part := range parts {
+		if n == 0 || !views[part] {
+			continue
+		}
+		repo = "/" + strings.Join(parts[:n], "/")
+		_, p := locate(repo)
+		if git, _ := isGit(p); git {
+			return repo, part, strings.Join(parts[n+1:], "/"), true
+		}
+	}
+	return "", "", "", false
+}
+
+// cgitRedirect translates a cgit URL, made up of the path u and the
+// query, into the equivalent Grove URL. It returns false if the URL
+// is not a cgit URL, including if it is already a Grove URL.
+func cgitRedirect(u string, query url.Values) (target string, ok bool) {
+	repo, view, rest, ok := findRepoURL(u, cgitViews)
+	if !ok {
+		return "", false
+	}
+
+	// cgit selects the branch with h, and the commit with id.
+	ref := query.Get("id")
+	if len(ref) == 0 {
+		ref = query.Get("h")
+	}
+	refQuery := ""
+	if len(ref) > 0 {
+		refQuery = "?ref=" + url.QueryEscape(ref)
+	}
+
+	switch view {
+	case "about", "summary":
+		return repo + "/" + refQuery, true
+	case "log":
+		if len(rest) > 0 {
+			// Logs of individual files are not supported, so show
+			// the file instead.
+			return repo + "/blob/" + escapePath(rest) + refQuery, true
+		}
+		return repo + "/" + refQuery, true
+	case "tree":
+		// Grove also uses /tree/, so only URLs with cgit's query
+		// parameters are redirected.
+		if len(ref) == 0 || len(query.Get("ref")) > 0 {
+			return "", false
+		}
+		return repo + "/tree/" + escapePath(rest) + refQuery, true
+	case "plain":
+		return repo + "/raw/" + escapePath(rest) + refQuery, true
+	case "commit":
+		if len(rest) > 0 || len(query.Get("id")) == 0 {
+			return "", false
+		}
+		return repo + "/commit/" + query.Get("id"), true
+	case "diff":
+		if len(query.Get("id")) == 0 {
+			return "", false
+		}
+		if from := query.Get("id2"); len(from) > 0 {
+			return repo + "/compare/" + from + ".." + query.Get("id"), true
+		}
+		return repo + "/commit/" + query.Get("id"), true
+	case "refs":
+		return repo + "/branches/", true
+	case "tag":
+		if len(rest) > 0 || len(query.Get("h")) == 0 {
+			return "", false
+		}
+		return repo + "/tag/" + query.Get("h"), true
+	case "snapshot":
+		// cgit snapshots are named <repo>-<ref>.<ext>, while Grove
+		// archives are named <ref>.<ext>.
+		name := repo[strings.LastIndex(repo, "/")+1:]
+		return repo + "/archive/" + strings.TrimPrefix(rest, name+"-"), true
+	}
+	return "", false
+}
+
+// gitwebSnapshots maps gitweb snapshot formats to the archive
+// extensions Grove serves.
+var gitwebSnapshots = map[string]string{
+	"tgz": ".tar.gz", "tar": ".tar", "zip": ".zip",
+}
+
+// parseGitwebQuery parses a gitweb query string, in which parameters
+// may be separated by either ';' or '&'. The standard library no
+// longer accepts ';' as a separator.
+func parseGitwebQuery(raw string) url.Values {
+	query := make(url.Values)
+	for _, pair := range strings.FieldsFunc(raw, func(r rune) bool {
+		return r == ';' || r == '&'
+	}) {
+		kv := strings.SplitN(pair, "=", 2)
+		key, err := url.QueryUnescape(kv[0])
+		if err != nil {
+			continue
+		}
+		value := ""
+		if len(kv) == 2 {
+			if value, err = url.QueryUnescape(kv[1]); err != nil {
+				continue
+			}
+		}
+		query.Add(key, value)
+	}
+	return query
+}
+
+// findGitwebRepo finds the URL path of the repository named by a gitweb
+// project parameter, which is relative to the served directory and
+// usually ends with ".git", even for repositories with working trees.
+func findGitwebRepo(project string) (repo string, ok bool) {
+	candidates := []string{"/" + strings.Trim(project, "/")}
+	if strings.HasSuffix(candidates[0], ".git") {
+		candidates = append(candidates, strings.TrimSuffix(candidates[0], ".git"))
+	}
+	for _, repo := range candidates {
+		_, p := locate(repo)
+		if git, _ := isGit(p); git {
+			return repo, true
+		}
+	}
+	return "", false
+}
+
+// gitwebRedirect translates the raw query of a gitweb URL into the
+// equivalent Grove URL. It returns false if the query is not a gitweb
+// query, or names a repository which does not exist.
+func gitwebRedirect(raw string) (target string, ok bool) {
+	query := parseGitwebQuery(raw)
+	project, action := query.Get("p"), query.Get("a")
+	if len(project) == 0 {
+		if action == "project_list" || action == "project_index" {
+			return "/", true
+		}
+		return "", false
+	}
+	repo, ok := findGitwebRepo(project)
+	if !ok {
+		return "", false
+	}
+
+	// gitweb names the object being viewed with h, and the commit it
+	// belongs to with hb.
+	hash, base, file := query.Get("h"), query.Get("hb"), query.Get("f")
+	if len(base) == 0 {
+		base = hash
+	}
+	refQuery := ""
+	if len(base) > 0 {
+		refQuery = "?ref=" + url.QueryEscape(base)
+	}
+
+	switch action {
+	case "", "summary", "log", "shortlog":
+		return repo + "/" + refQuery, true
+	case "commit", "commitdiff":
+		if len(hash) == 0 {
+			return repo + "/", true
+		}
+		if parent := query.Get("hp"); action == "commitdiff" && len(parent) > 0 {
+			return repo + "/compare/" + parent + ".." + hash, true
+		}
+		return repo + "/commit/" + hash, true
+	case "tree":
+		if len(file) == 0 {
+			return repo + "/tree/" + refQuery, true
+		}
+		return repo + "/tree/" + escapePath(file) + refQuery, true
+	case "blob", "history":
+		if len(file) == 0 {
+			if len(hash) == 0 {
+				return "", false
+			}
+			// Without a file name, h is the hash of the blob, which
+			// the short URL handler can find.
+			return "/s" + repo + "/" + hash, true
+		}
+		if len(query.Get("hb")) == 0 {
+			refQuery = ""
+		}
+		return repo + "/blob/" + escapePath(file) + refQuery, true
+	case "blob_plain":
+		if len(file) == 0 {
+			return "", false
+		}
+		if len(query.Get("hb")) == 0 {
+			refQuery = ""
+		}
+		return repo + "/raw/" + escapePath(file) + refQuery, true
+	case "tag":
+		if len(hash) == 0 {
+			return "", false
+		}
+		return repo + "/tag/" + hash, true
+	case "heads", "tags", "remotes":
+		return repo + "/branches/", true
+	case "snapshot":
+		ext, ok := gitwebSnapshots[query.Get("sf")]
+		if !ok {
+			ext = ".tar.gz"
+		}
+		if len(hash) == 0 {
+			hash = "HEAD"
+		}
+		return repo + "/archive/" + hash + ext, true
+	}
+	return "", false
+}
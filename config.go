@@ -0,0 +1,651 @@
+package grove
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/microcosm-cc/bluemonday"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	PolicyPerms = "perms" // Serve based on filesystem permission bits
+	PolicyList  = "list"  // Serve based on the Allow and Deny lists
+)
+
+// Config holds the settings which can be read from a configuration
+// file with LoadConfig. The file is JSON encoded, and keys are
+// matched against the field names without regard to case.
+type Config struct {
+	// Policy determines how Grove decides which repositories and
+	// directories may be served. It is either PolicyPerms (the
+	// default) or PolicyList.
+	Policy string
+
+	// Allow and Deny are lists of glob patterns, (as understood by
+	// path.Match,) which are matched against paths relative to the
+	// served directory. When using PolicyList, a path is only served
+	// if it or one of its parents matches an Allow pattern and
+	// neither it nor any of its parents matches a Deny pattern.
+	Allow []string
+	Deny  []string
+
+	// Perms is the level at which files and directories must be
+	// readable in order to be served with PolicyPerms. It is 0 for
+	// globally readable, 1 for readable by group, and 2 for readable
+	// by owner.
+	Perms uint
+
+	// Hidden is a list of glob patterns naming hidden files and
+	// directories, (those beginning with a '.',) which may be served
+	// regardless. For example, "*/.dotfiles" allows repositories
+	// named .dotfiles to be browsed and cloned.
+	Hidden []string
+
+	// FollowSymlinks allows symlinks within the served directory to
+	// point to repositories elsewhere on disk. Paths which resolve
+	// outside of both the served directory and the linked repository
+	// are never served.
+	FollowSymlinks bool
+
+	// Aliases maps URL paths, such as "/linux", to the filesystem
+	// paths of the repositories they should serve, such as
+	// "/srv/mirrors/kernel/linux.git". Aliased repositories need not
+	// be within the served directory.
+	Aliases map[string]string
+
+	// Renames maps the old URL paths of repositories which have been
+	// moved or renamed to their new URL paths. Requests to an old
+	// path, including clone URLs, are permanently redirected.
+	Renames map[string]string
+
+	// Avatars selects where avatars shown beside commits come from.
+	// It is either AvatarsGravatar, AvatarsLibravatar, AvatarsLocal,
+	// or empty to disable avatars.
+	Avatars string
+
+	// AvatarDir is the directory from which to serve avatars with
+	// AvatarsLocal. Images are named by the MD5 hash of the lowercase
+	// email address, such as <hash>.png.
+	AvatarDir string
+
+	// GitBin is the git executable which is run, either a path or a
+	// name which is looked up in $PATH. The --git-bin flag overrides
+	// it.
+	GitBin string
+
+	// AllowedHosts lists the hosts, such as "git.example.com", which
+	// requests may name in their Host header. Those naming another
+	// are refused. A host may include a port, which must then match,
+	// and one beginning with "*." allows any of its subdomains. If
+	// the list is empty, any host is allowed.
+	AllowedHosts []string
+
+	// ExternalURL is the URL at which Grove is reached by visitors,
+	// such as "https://git.example.com/grove", which may also be
+	// given with --base-url. It is used to build links and clone
+	// URLs, and its path is expected at the start of every request,
+	// as a reverse proxy passes them on. If it is not set, the URL is
+	// guessed from the --host flag or the request.
+	ExternalURL string
+
+	// SSHHost is the user and host to show in SSH clone URLs, such as
+	// "git@example.com". SSH clone URLs are only shown if it is set.
+	SSHHost string
+
+	// SSHRoot is the path of the served directory on SSHHost, if it
+	// differs from the path Grove serves.
+	SSHRoot string
+
+	// CgitCompat enables redirects from cgit style URLs, such as
+	// /repo/log/?h=branch, to their Grove equivalents.
+	CgitCompat bool
+
+	// GitwebCompat enables redirects from gitweb style query URLs,
+	// such as /gitweb.cgi?p=repo.git;a=commit;h=<sha>, to their Grove
+	// equivalents.
+	GitwebCompat bool
+
+	// Renderers maps file extensions, such as ".adoc", to commands
+	// which render files of that type to HTML, such as
+	// "asciidoctor -o - -". The file is given on standard input, and
+	// the sanitized output is shown in place of the source.
+	Renderers map[string]string
+
+	// Markdown holds the settings for rendering Markdown, such as
+	// which extensions are enabled. Settings which are not given keep
+	// their defaults.
+	Markdown MarkdownConfig
+
+	// Sanitize extends the allowlist of HTML which may appear in
+	// rendered Markdown and the output of Renderers. Anything else,
+	// such as scripts, is removed.
+	Sanitize SanitizeConfig
+
+	// CSP is the Content-Security-Policy header sent with every
+	// response, in which {nonce} is replaced by a new nonce for each
+	// request. ReferrerPolicy is the Referrer-Policy header, and
+	// FrameAncestors is the value of the frame-ancestors directive,
+	// which is added to the CSP. Any of them may be set to an empty
+	// string to leave them out.
+	CSP            string
+	ReferrerPolicy string
+	FrameAncestors string
+
+	// OTLPEndpoint is the URL to which traces are exported over
+	// OTLP/HTTP, such as "http://localhost:4318/v1/traces". If it is
+	// not set, the standard OTEL_EXPORTER_OTLP_ENDPOINT environment
+	// variables are used, and if those are not set, tracing is
+	// disabled.
+	OTLPEndpoint string
+
+	// DebugToken allows the handlers enabled by --debug-handlers to
+	// be reached, by sending it as a bearer token in the Authorization
+	// header. It is required unless ProxyProtocol is set, in which
+	// case they may also be reached from the loopback interface.
+	DebugToken string
+
+	// AdminPassword is the password, given with HTTP basic
+	// authentication under any user name, which grants access to the
+	// reflog pages of repositories, from which branches can be
+	// restored. If it is not set, those pages are disabled.
+	AdminPassword string
+
+	// Realms lists the parts of the site which require a user name
+	// and password. The first realm whose pattern matches a request's
+	// URL path applies to it, so that a realm with no users listed
+	// before another can leave part of it open. Paths which match no
+	// realm are open to anyone.
+	Realms []RealmConfig
+
+	// NoReplaceObjects stops replacement objects, which are made by
+	// git replace and recorded under ReplaceRefBase, (refs/replace/ by
+	// default,) from being shown in place of the commits and files
+	// they replace. Otherwise they are, as git shows them, and
+	// replaced commits and files are marked.
+	NoReplaceObjects bool
+	ReplaceRefBase   string
+
+	// DefaultCommits is the number of commits shown in the log when
+	// the c parameter is not given, and MaxCommits is the most which
+	// may be asked for with it, so that a single request can't force
+	// an arbitrarily long git log.
+	DefaultCommits int
+	MaxCommits     int
+
+	// WarmJobs is the number of repositories whose caches are filled
+	// at once when Grove starts, or 0 to only fill them as pages are
+	// requested.
+	WarmJobs int
+
+	// ShutdownTimeout is the number of seconds for which requests in
+	// progress, such as clones, are waited for when Grove is stopped
+	// with SIGINT or SIGTERM, before they are cut off.
+	ShutdownTimeout int
+
+	// TLSCert and TLSKey are the files holding the certificate and
+	// private key with which to serve HTTPS. If neither they nor
+	// TLSCertDir are set, plain HTTP is served.
+	TLSCert string
+	TLSKey  string
+
+	// TLSCertDir is a directory of certificates, named <name>.crt,
+	// and their private keys, named <name>.key, which are chosen by
+	// the server name that clients send, so that several domains can
+	// be served over HTTPS. It may be used alone, or alongside
+	// TLSCert and TLSKey, which are then used when no certificate
+	// matches.
+	TLSCertDir string
+
+	// ACMEHosts are the hostnames, such as "git.example.com", for
+	// which certificates are obtained from Let's Encrypt and renewed
+	// automatically, which agrees to its terms of service. They are
+	// kept in ACMECacheDir, which defaults to a directory in the
+	// user's cache, and ACMEEmail is given to Let's Encrypt to be
+	// told of problems with them. ACMEHosts can't be used with
+	// TLSCert, TLSKey, or TLSCertDir.
+	ACMEHosts    []string
+	ACMECacheDir string
+	ACMEEmail    string
+
+	// ClientAuth requires clients to present a certificate signed by
+	// the CA in the ClientCA file. With ClientAuthAll, every request
+	// needs one, and with ClientAuthPush, only pushes and requests to
+	// /debug/ do. It requires TLSCert and TLSKey.
+	ClientAuth string
+	ClientCA   string
+
+	// RedirectHTTP is an address, such as ":80", on which to listen
+	// for plain HTTP and permanently redirect every request to HTTPS.
+	// HSTSMaxAge is the number of seconds for which browsers are told
+	// with the Strict-Transport-Security header to only use HTTPS, or
+	// 0 to not send it. Both require TLSCert and TLSKey.
+	RedirectHTTP string
+	HSTSMaxAge   int
+
+	// HTTPEnv is additional environment, such as GIT_NAMESPACE, for
+	// the git commands which serve clones, fetches, and pushes over
+	// HTTP. RepoHTTPEnv maps glob patterns, (as understood by
+	// path.Match,) which are matched against paths relative to the
+	// served directory, to environment for matching repositories,
+	// which overrides HTTPEnv.
+	HTTPEnv     map[string]string
+	RepoHTTPEnv map[string]map[string]string
+
+	// FetchRefs maps glob patterns, (as understood by path.Match,)
+	// which are matched against paths relative to the served
+	// directory, to the only refs, such as "refs/tags" or
+	// "refs/heads/master", which may be fetched from matching
+	// repositories, along with those below them. Others are neither
+	// advertised nor served to clients, and the dumb protocol, which
+	// can't hide them, is refused.
+	FetchRefs map[string][]string
+
+	// RateLimit is the most bytes per second at which each clone,
+	// fetch, or archive is sent, and TotalRateLimit is the most for
+	// all of them together. Either may be 0 for no limit.
+	RateLimit      int
+	TotalRateLimit int
+
+	// RequestLimits limits the rate of requests from each remote
+	// address to the web interface, the API, and git over HTTP, so
+	// that a single client, such as a crawler, can't run many git
+	// commands at once.
+	RequestLimits RequestLimitConfig
+
+	// ArchiveName is the template from which downloadable archives,
+	// and the directory within them, are named. {repo}, {ref}, {tag},
+	// {sha}, and {shortsha} are replaced with the name of the
+	// repository, the ref requested, the tag or description of the
+	// commit, and its full and abbreviated SHA. If an archive is of
+	// a single directory, the directory is appended.
+	ArchiveName string
+
+	// Topics maps glob patterns, (as understood by path.Match,) which
+	// are matched against paths relative to the served directory, to
+	// lists of topics given to matching repositories, in addition to
+	// those in their grove.topics setting.
+	Topics map[string][]string
+
+	// Pinned is a list of repositories, given by their paths relative
+	// to the served directory, which are shown first on the index, in
+	// the order given.
+	Pinned []string
+
+	// EmailPrivacy is how the email addresses of authors, committers,
+	// and taggers are shown in pages, feeds, and API responses: either
+	// EmailsShow, (the default,) EmailsMask, or EmailsOmit.
+	// RepoEmails maps glob patterns, (as understood by path.Match,)
+	// which are matched against paths relative to the served
+	// directory, to the setting for matching repositories, which
+	// overrides EmailPrivacy.
+	EmailPrivacy string
+	RepoEmails   map[string]string
+
+	// Branding holds the title, logo, favicon, and footer of the
+	// site.
+	Branding BrandingConfig
+
+	// Email holds the settings for emailing summaries of pushes to
+	// the served repositories.
+	Email EmailConfig
+
+	// Chat is a list of chat systems, such as Slack, to which
+	// messages about pushes to the served repositories are posted.
+	Chat []ChatConfig
+
+	// Tor holds the settings for publishing Grove as a Tor onion
+	// service.
+	Tor TorConfig
+
+	// The remaining settings are given by the grove command from its
+	// flags, which are named after them, rather than being read from
+	// the configuration file.
+	Web           bool     // Serve the web interface, and not only clones
+	Host          string   // Hostname and prefix to use in links, from --host
+	Resources     string   // Directory of resources overriding the built-in ones
+	Dev           bool     // Re-read templates on every request and disable caching
+	DebugHandlers bool     // Serve pprof and expvar under /debug/
+	Binds         []string // Addresses to listen on, as given with --bind
+	Port          string   // Port added to addresses to listen on without one
+	SocketMode    uint     // Permissions of Unix sockets listened on, or 0 for the umask
+	ProxyProtocol bool     // Require a PROXY protocol header on every connection
+	H2C           bool     // Accept HTTP/2 without TLS
+
+	htmlPolicy *bluemonday.Policy // Policy built from Sanitize
+}
+
+// DefaultConfig returns a Config with all settings at their defaults.
+func DefaultConfig() *Config {
+	return &Config{
+		Policy:     PolicyPerms,
+		Perms:      Perms,
+		Markdown:   defaultMarkdown(),
+		htmlPolicy: newHTMLPolicy(SanitizeConfig{}),
+
+		CSP:            defaultCSP,
+		ReferrerPolicy: defaultReferrerPolicy,
+		FrameAncestors: defaultFrameAncestors,
+
+		DefaultCommits:  defaultCommits,
+		MaxCommits:      defaultMaxCommits,
+		ShutdownTimeout: defaultShutdownTimeout,
+
+		GitBin: defaultGitBin,
+
+		EmailPrivacy: EmailsShow,
+
+		ArchiveName:    defaultArchiveName,
+		ReplaceRefBase: defaultReplaceRefBase,
+
+		Tor: TorConfig{Port: defaultOnionPort},
+
+		Web:   true,
+		Binds: []string{Bind},
+		Port:  Port,
+	}
+}
+
+// LoadConfig reads and parses the configuration file at the given
+// path. Settings which are not present in the file are left at their
+// defaults.
+func LoadConfig(file string) (c *Config, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c = DefaultConfig()
+	if err = json.NewDecoder(f).Decode(c); err != nil {
+		return nil, err
+	}
+	if err = c.normalize(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// normalize puts the settings in the form in which they are used, such
+// as by lowercasing names and cleaning paths, and fills in defaults for
+// those which are not set. It reports settings which are invalid. It
+// may be called more than once.
+func (c *Config) normalize() (err error) {
+	c.Policy = strings.ToLower(c.Policy)
+	c.Avatars = strings.ToLower(c.Avatars)
+	c.Markdown.Links = strings.ToLower(c.Markdown.Links)
+	c.ClientAuth = strings.ToLower(c.ClientAuth)
+	for n := range c.AllowedHosts {
+		c.AllowedHosts[n] = strings.ToLower(c.AllowedHosts[n])
+	}
+	for n := range c.ACMEHosts {
+		c.ACMEHosts[n] = strings.ToLower(c.ACMEHosts[n])
+	}
+	for n := range c.Chat {
+		c.Chat[n].Format = strings.ToLower(c.Chat[n].Format)
+	}
+
+	// Clean the aliases and renames so that they can be compared
+	// directly with request and filesystem paths.
+	aliases := make(map[string]string, len(c.Aliases))
+	for alias, target := range c.Aliases {
+		aliases[path.Clean("/"+alias)] = path.Clean(target)
+	}
+	c.Aliases = aliases
+	renames := make(map[string]string, len(c.Renames))
+	for old, renamed := range c.Renames {
+		renames[path.Clean("/"+old)] = path.Clean("/" + renamed)
+	}
+	c.Renames = renames
+	renderers := make(map[string]string, len(c.Renderers))
+	for ext, command := range c.Renderers {
+		renderers["."+strings.TrimPrefix(strings.ToLower(ext), ".")] = command
+	}
+	c.Renderers = renderers
+	c.htmlPolicy = newHTMLPolicy(c.Sanitize)
+	if err = c.Branding.load(); err != nil {
+		return err
+	}
+	for n := range c.Realms {
+		if err = c.Realms[n].compile(); err != nil {
+			return err
+		}
+	}
+	if c.MaxCommits < 1 {
+		c.MaxCommits = defaultMaxCommits
+	}
+	if c.DefaultCommits < 1 {
+		c.DefaultCommits = defaultCommits
+	}
+	if c.ShutdownTimeout < 1 {
+		c.ShutdownTimeout = defaultShutdownTimeout
+	}
+	if len(c.ReplaceRefBase) == 0 {
+		c.ReplaceRefBase = defaultReplaceRefBase
+	}
+	c.ReplaceRefBase = strings.TrimSuffix(c.ReplaceRefBase, "/") + "/"
+	if c.Tor.Port < 1 {
+		c.Tor.Port = defaultOnionPort
+	}
+	if len(c.GitBin) == 0 {
+		c.GitBin = defaultGitBin
+	}
+	c.EmailPrivacy = strings.ToLower(c.EmailPrivacy)
+	if len(c.EmailPrivacy) == 0 {
+		c.EmailPrivacy = EmailsShow
+	}
+	for pattern, privacy := range c.RepoEmails {
+		c.RepoEmails[pattern] = strings.ToLower(privacy)
+	}
+	if len(c.ArchiveName) == 0 {
+		c.ArchiveName = defaultArchiveName
+	}
+	if c.DefaultCommits > c.MaxCommits {
+		c.DefaultCommits = c.MaxCommits
+	}
+	if c.Perms > 2 {
+		return fmt.Errorf("invalid permission level %d; must be 0, 1, or 2",
+			c.Perms)
+	}
+	if len(c.ExternalURL) > 0 {
+		u, err := url.Parse(c.ExternalURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			return fmt.Errorf("invalid base URL %q; must be such as https://example.com/grove",
+				c.ExternalURL)
+		}
+	}
+	if c.SocketMode > 0777 {
+		return fmt.Errorf("invalid socket mode %#o; must be at most 0777", c.SocketMode)
+	}
+	if c.DebugHandlers && len(c.DebugToken) == 0 && !c.ProxyProtocol {
+		return errors.New("--debug-handlers requires DebugToken to be set, unless --proxy-protocol is used")
+	}
+	if len(c.Port) == 0 {
+		c.Port = Port
+	}
+	return nil
+}
+
+// Commits parses the number of commits requested by the c parameter,
+// s. If it is missing or invalid, fallback is used instead, and the
+// result is never more than MaxCommits.
+func (c *Config) Commits(s string, fallback int) int {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 {
+		n = fallback
+	}
+	if n > c.MaxCommits {
+		n = c.MaxCommits
+	}
+	return n
+}
+
+// Alias finds the longest alias which is a prefix of the URL path u,
+// and returns it along with the filesystem path it maps to.
+func (c *Config) Alias(u string) (alias, target string, ok bool) {
+	return longestPrefix(c.Aliases, path.Clean("/"+u))
+}
+
+// Rename checks whether the URL path u is within a repository which
+// has been renamed, and if so, returns the path it has moved to.
+func (c *Config) Rename(u string) (renamed string, ok bool) {
+	old, renamed, ok := longestPrefix(c.Renames, path.Clean("/"+u))
+	if !ok {
+		return "", false
+	}
+	return renamed + strings.TrimPrefix(path.Clean("/"+u), old), true
+}
+
+// longestPrefix finds the longest key in m which is a path prefix of
+// p, and returns it along with its value.
+func longestPrefix(m map[string]string, p string) (key, value string, ok bool) {
+	for k, v := range m {
+		if isWithin(k, p) && len(k) > len(key) {
+			key, value, ok = k, v, true
+		}
+	}
+	return
+}
+
+// Unalias finds the alias whose repository contains the filesystem
+// path p, and returns it along with the filesystem path it maps to.
+func (c *Config) Unalias(p string) (alias, target string, ok bool) {
+	for a, t := range c.Aliases {
+		if isWithin(t, p) && len(t) > len(target) {
+			alias, target, ok = a, t, true
+		}
+	}
+	return
+}
+
+// Listed checks the path p, which must be relative to the served
+// directory, against the Allow and Deny lists. Ancestors of paths
+// matching an Allow pattern are considered listed, so that visitors
+// can navigate to them.
+func (c *Config) Listed(p string) bool {
+	p = strings.Trim(path.Clean("/"+p), "/")
+	if len(p) == 0 {
+		// The top level directory is always listable.
+		return true
+	}
+	for _, pattern := range c.Deny {
+		if matchPath(pattern, p) {
+			return false
+		}
+	}
+	for _, pattern := range c.Allow {
+		if matchPath(pattern, p) || matchParent(pattern, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// RepoTopics lists the topics which the Topics setting gives to the
+// repository at p, which must be relative to the served directory.
+func (c *Config) RepoTopics(p string) (topics []string) {
+	p = strings.Trim(path.Clean("/"+p), "/")
+	for pattern, t := range c.Topics {
+		if matchPath(pattern, p) {
+			topics = append(topics, t...)
+		}
+	}
+	return
+}
+
+// RepoFetchRefs lists the refs which the FetchRefs setting allows to
+// be fetched from the repository at p, which must be relative to the
+// served directory. If it lists none, every ref may be fetched.
+func (c *Config) RepoFetchRefs(p string) (refs []string) {
+	p = strings.Trim(path.Clean("/"+p), "/")
+	for pattern, r := range c.FetchRefs {
+		if matchPath(pattern, p) {
+			refs = append(refs, r...)
+		}
+	}
+	return
+}
+
+// RepoEnv lists the environment, as "KEY=value" pairs, given by
+// HTTPEnv and RepoHTTPEnv to the git commands serving the repository
+// at p, which must be relative to the served directory. Where several
+// patterns of RepoHTTPEnv match, they are applied in sorted order, so
+// that the result does not depend on the order of the map.
+func (c *Config) RepoEnv(p string) (env []string) {
+	p = strings.Trim(path.Clean("/"+p), "/")
+	vars := make(map[string]string, len(c.HTTPEnv))
+	for k, v := range c.HTTPEnv {
+		vars[k] = v
+	}
+	patterns := make([]string, 0, len(c.RepoHTTPEnv))
+	for pattern := range c.RepoHTTPEnv {
+		if matchPath(pattern, p) {
+			patterns = append(patterns, pattern)
+		}
+	}
+	sort.Strings(patterns)
+	for _, pattern := range patterns {
+		for k, v := range c.RepoHTTPEnv[pattern] {
+			vars[k] = v
+		}
+	}
+	for k, v := range vars {
+		env = append(env, k+"="+v)
+	}
+	sort.Strings(env)
+	return
+}
+
+// Visible checks whether every hidden element of the path p, which
+// must be relative to the served directory, is permitted by the Hidden
+// list. .git directories are not considered hidden here.
+func (c *Config) Visible(p string) bool {
+	parts := strings.Split(strings.Trim(path.Clean("/"+p), "/"), "/")
+	for n, part := range parts {
+		if !strings.HasPrefix(part, ".") || part == ".git" {
+			continue
+		}
+		visible := false
+		for _, pattern := range c.Hidden {
+			if ok, _ := path.Match(pattern, strings.Join(parts[:n+1], "/")); ok {
+				visible = true
+				break
+			}
+		}
+		if !visible {
+			return false
+		}
+	}
+	return true
+}
+
+// matchPath reports whether the pattern matches p or any of its
+// parent directories.
+func matchPath(pattern, p string) bool {
+	for ; p != "." && p != "/"; p = path.Dir(p) {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matchParent reports whether p could be a parent directory of a path
+// matched by the pattern, by matching p against the same number of
+// leading elements of the pattern.
+func matchParent(pattern, p string) bool {
+	patterns := strings.Split(strings.Trim(pattern, "/"), "/")
+	parts := strings.Split(p, "/")
+	if len(parts) >= len(patterns) {
+		return false
+	}
+	ok, _ := path.Match(strings.Join(patterns[:len(parts)], "/"), p)
+	return ok
+}
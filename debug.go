@@ -0,0 +1,70 @@
+package grove
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"crypto/subtle"
+	"expvar"
+	"net"
+	"net/http"
+	"net/http/pprof"
+)
+
+func init() {
+	expvar.NewString("version").Set(Version)
+}
+
+// registerDebug registers the pprof and expvar handlers on the mux,
+// under /debug/, guarded by debugHandler.
+func registerDebug(mux *http.ServeMux) {
+	mux.Handle(prefix+"/debug/pprof/", debugHandler(http.HandlerFunc(pprof.Index)))
+	mux.Handle(prefix+"/debug/pprof/cmdline", debugHandler(http.HandlerFunc(pprof.Cmdline)))
+	mux.Handle(prefix+"/debug/pprof/profile", debugHandler(http.HandlerFunc(pprof.Profile)))
+	mux.Handle(prefix+"/debug/pprof/symbol", debugHandler(http.HandlerFunc(pprof.Symbol)))
+	mux.Handle(prefix+"/debug/pprof/trace", debugHandler(http.HandlerFunc(pprof.Trace)))
+	mux.Handle(prefix+"/debug/vars", debugHandler(expvar.Handler()))
+	l.Infof("Debug handlers enabled under %s/debug/\n", prefix)
+}
+
+// debugHandler wraps a debugging handler so that it is only served to
+// clients which send the DebugToken setting as a bearer token. With
+// --proxy-protocol, clients connecting over the loopback interface are
+// served as well. Without it, they can't be told from those whose
+// requests are passed on by a reverse proxy on the same host, which
+// may be anyone. Others are told that the handler does not exist.
+func debugHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		local := conf().ProxyProtocol && isLoopback(req.RemoteAddr)
+		if !local && !validDebugToken(req) {
+			reqLog(req).Noticef("Debug request to %q from %q denied\n",
+				req.URL.Path, req.RemoteAddr)
+			Error(w, http.StatusNotFound)
+			return
+		}
+		// pprof.Index expects the path to begin with /debug/pprof/.
+		req.URL.Path = req.URL.Path[prefixLength:]
+		h.ServeHTTP(w, req)
+	})
+}
+
+// isLoopback checks whether the remote address of a request, in the
+// form host:port, is on the loopback interface.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// validDebugToken checks whether the request carries the DebugToken
+// setting as a bearer token. It is always false if there is none.
+func validDebugToken(req *http.Request) bool {
+	if len(conf().DebugToken) == 0 {
+		return false
+	}
+	given := []byte(req.Header.Get("Authorization"))
+	want := []byte("Bearer " + conf().DebugToken)
+	return subtle.ConstantTimeCompare(given, want) == 1
+}
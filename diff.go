@@ -0,0 +1,395 @@
+package grove
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// DiffOptions alter how diffs are generated.
+type DiffOptions struct {
+	IgnoreWhitespace bool // Ignore all changes in whitespace (-w)
+	IgnoreBlankLines bool // Ignore added or removed blank lines
+}
+
+// DiffFile is the portion of a unified diff which applies to a single
+// file.
+type DiffFile struct {
+	OldPath   string      // Path before the change, or /dev/null
+	NewPath   string      // Path after the change, or /dev/null
+	Binary    bool        // Whether the file is binary
+	Hunks     []*DiffHunk // Hunks of changes to the file
+	Additions int         // Number of lines added
+	Deletions int         // Number of lines deleted
+	Combined  bool        // Whether this is a combined diff of a merge
+}
+
+// DiffHunk is a single hunk of changes within a file, beginning at the
+// "@@" header.
+type DiffHunk struct {
+	Header string      // The "@@ -a,b +c,d @@" header line
+	Lines  []*DiffLine // Lines of the hunk
+}
+
+// DiffLine is a single line of a hunk, which is either an addition,
+// deletion, or context.
+type DiffLine struct {
+	Type     byte           // One of '+', '-', or ' '
+	Text     string         // Contents of the line, without the type prefix
+	OldNum   int            // Line number before the change, or 0 if added
+	NewNum   int            // Line number after the change, or 0 if deleted
+	Segments []*DiffSegment // Text split by intraline changes, if known
+	Prefix   string         // Columns of a combined diff, one per parent
+}
+
+// DiffRow is a row of a side-by-side diff. Either side may be nil if
+// lines were only added or only deleted.
+type DiffRow struct {
+	Old *DiffLine // Deleted or context line, shown on the left
+	New *DiffLine // Added or context line, shown on the right
+}
+
+// DiffSegment is a portion of the text of a changed line, which is
+// marked if it differs from its counterpart line.
+type DiffSegment struct {
+	Text    string // Text of the segment
+	Changed bool   // Whether the segment was added or deleted
+}
+
+const (
+	// maxWordDiff is the largest product of the number of words in
+	// two lines for which an intraline diff will be computed, to
+	// bound its cost on very long lines.
+	maxWordDiff = 250000
+)
+
+// args returns the arguments to git diff, git show, or similar which
+// apply the options.
+func (o DiffOptions) args() (args []string) {
+	if o.IgnoreWhitespace {
+		args = append(args, "--ignore-all-space")
+	}
+	if o.IgnoreBlankLines {
+		args = append(args, "--ignore-blank-lines")
+	}
+	return
+}
+
+// parseDiff parses the output of git diff, (or any unified diff with
+// git's extended headers,) into a list of files.
+func parseDiff(patch string) (files []*DiffFile) {
+	var file *DiffFile
+	var hunk *DiffHunk
+	var oldNum, newNum, parents int
+	for _, line := range strings.Split(patch, "\n") {
+		switch {
+		case strings.HasPrefix(line, "diff --git "):
+			highlightHunk(hunk)
+			// Guess the paths from the header, in case the file is
+			// binary or only renamed, so there are no ---/+++ lines.
+			file = &DiffFile{}
+			file.OldPath, file.NewPath = diffHeaderPaths(line[len("diff --git "):])
+			files = append(files, file)
+			hunk = nil
+		case strings.HasPrefix(line, "diff --cc "),
+			strings.HasPrefix(line, "diff --combined "):
+			// Combined diffs of merges name only the merged file.
+			highlightHunk(hunk)
+			name := unquotePath(strings.TrimPrefix(strings.TrimPrefix(line,
+				"diff --cc "), "diff --combined "))
+			file = &DiffFile{OldPath: name, NewPath: name, Combined: true}
+			files = append(files, file)
+			hunk = nil
+		case file == nil:
+			// Skip anything before the first file.
+		case hunk == nil && strings.HasPrefix(line, "--- "):
+			file.OldPath = trimDiffPath(line[len("--- "):])
+		case hunk == nil && strings.HasPrefix(line, "+++ "):
+			file.NewPath = trimDiffPath(line[len("+++ "):])
+		case hunk == nil && strings.HasPrefix(line, "Binary files "):
+			file.Binary = true
+		case file.Combined && strings.HasPrefix(line, "@@@"):
+			// The header of a combined hunk has one more @ than the
+			// merge has parents, and a range for each of them.
+			highlightHunk(hunk)
+			hunk = &DiffHunk{Header: line}
+			parents = len(line) - len(strings.TrimLeft(line, "@")) - 1
+			newNum = parseCombinedHeader(line)
+			file.Hunks = append(file.Hunks, hunk)
+		case strings.HasPrefix(line, "@@"):
+			highlightHunk(hunk)
+			hunk = &DiffHunk{Header: line}
+			oldNum, newNum = parseHunkHeader(line)
+			file.Hunks = append(file.Hunks, hunk)
+		case hunk == nil || len(line) == 0:
+			// Skip extended headers, such as "index", and the blank
+			// line at the end of the output.
+		case file.Combined:
+			if len(line) < parents {
+				continue
+			}
+			hunk.Lines = append(hunk.Lines,
+				combinedLine(line[:parents], line[parents:], &newNum))
+			switch hunk.Lines[len(hunk.Lines)-1].Type {
+			case '+':
+				file.Additions++
+			case '-':
+				file.Deletions++
+			}
+		case line[0] == '+':
+			hunk.Lines = append(hunk.Lines,
+				&DiffLine{Type: '+', Text: line[1:], NewNum: newNum})
+			newNum++
+			file.Additions++
+		case line[0] == '-':
+			hunk.Lines = append(hunk.Lines,
+				&DiffLine{Type: '-', Text: line[1:], OldNum: oldNum})
+			oldNum++
+			file.Deletions++
+		case line[0] == ' ':
+			hunk.Lines = append(hunk.Lines, &DiffLine{Type: ' ',
+				Text: line[1:], OldNum: oldNum, NewNum: newNum})
+			oldNum++
+			newNum++
+		}
+	}
+	highlightHunk(hunk)
+	return
+}
+
+// combinedLine makes a line of a combined diff from the columns which
+// begin it, one for each parent, and the rest of the line. It is a
+// deletion if it was removed from any parent, an addition if it was
+// added relative to any parent, and context otherwise. Lines which are
+// in the merge are numbered from newNum, which is advanced past them.
+func combinedLine(prefix, text string, newNum *int) *DiffLine {
+	line := &DiffLine{Type: ' ', Text: text, Prefix: prefix}
+	switch {
+	case strings.Contains(prefix, "-"):
+		line.Type = '-'
+		return line
+	case strings.Contains(prefix, "+"):
+		line.Type = '+'
+	}
+	line.NewNum = *newNum
+	*newNum++
+	return line
+}
+
+// Split arranges the lines of the hunk into rows for a side-by-side
+// view. Context lines appear on both sides, and each block of deleted
+// lines is shown beside the block of added lines which follows it.
+func (h *DiffHunk) Split() (rows []*DiffRow) {
+	for i := 0; i < len(h.Lines); {
+		if h.Lines[i].Type == ' ' {
+			rows = append(rows, &DiffRow{Old: h.Lines[i], New: h.Lines[i]})
+			i++
+			continue
+		}
+		var dels, adds []*DiffLine
+		for ; i < len(h.Lines) && h.Lines[i].Type == '-'; i++ {
+			dels = append(dels, h.Lines[i])
+		}
+		for ; i < len(h.Lines) && h.Lines[i].Type == '+'; i++ {
+			adds = append(adds, h.Lines[i])
+		}
+		for n := 0; n < len(dels) || n < len(adds); n++ {
+			row := &DiffRow{}
+			if n < len(dels) {
+				row.Old = dels[n]
+			}
+			if n < len(adds) {
+				row.New = adds[n]
+			}
+			rows = append(rows, row)
+		}
+	}
+	return
+}
+
+// highlightHunk finds blocks of deleted lines immediately followed by
+// the same number of added lines, and pairs them up to mark the words
+// which changed within each line, in the manner of diff-highlight.
+func highlightHunk(hunk *DiffHunk) {
+	if hunk == nil {
+		return
+	}
+	lines := hunk.Lines
+	for i := 0; i < len(lines); {
+		if lines[i].Type != '-' {
+			i++
+			continue
+		}
+		dels := i
+		for i < len(lines) && lines[i].Type == '-' {
+			i++
+		}
+		adds := i
+		for i < len(lines) && lines[i].Type == '+' {
+			i++
+		}
+		if adds-dels != i-adds {
+			continue
+		}
+		for n := 0; n < adds-dels; n++ {
+			lines[dels+n].Segments, lines[adds+n].Segments =
+				wordDiff(lines[dels+n].Text, lines[adds+n].Text)
+		}
+	}
+}
+
+// wordDiff splits the before and after versions of a line into segments,
+// marking the words which are not common to both. Words are found with
+// splitWords, and the common words are the longest common subsequence
+// of the two. If the lines are too long, only the common prefix and
+// suffix are considered unchanged.
+func wordDiff(before, after string) (oldSegs, newSegs []*DiffSegment) {
+	a, b := splitWords(before), splitWords(after)
+
+	// Trim the common prefix and suffix, which is most of the line in
+	// the usual case, before finding the subsequence.
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre &&
+		a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+	midA, midB := a[pre:len(a)-suf], b[pre:len(b)-suf]
+
+	commonA := make([]bool, len(midA))
+	commonB := make([]bool, len(midB))
+	if len(midA)*len(midB) <= maxWordDiff {
+		// Compute the lengths of the longest common subsequences of
+		// the suffixes of each, then walk them to mark common words.
+		lcs := make([][]int, len(midA)+1)
+		for i := range lcs {
+			lcs[i] = make([]int, len(midB)+1)
+		}
+		for i := len(midA) - 1; i >= 0; i-- {
+			for j := len(midB) - 1; j >= 0; j-- {
+				if midA[i] == midB[j] {
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				} else if lcs[i+1][j] >= lcs[i][j+1] {
+					lcs[i][j] = lcs[i+1][j]
+				} else {
+					lcs[i][j] = lcs[i][j+1]
+				}
+			}
+		}
+		for i, j := 0, 0; i < len(midA) && j < len(midB); {
+			switch {
+			case midA[i] == midB[j]:
+				commonA[i], commonB[j] = true, true
+				i++
+				j++
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				i++
+			default:
+				j++
+			}
+		}
+	}
+
+	return makeSegments(a, pre, commonA), makeSegments(b, pre, commonB)
+}
+
+// makeSegments joins the words into segments of changed and unchanged
+// text. The first pre words and any after those marked in common are
+// unchanged.
+func makeSegments(words []string, pre int, common []bool) (segs []*DiffSegment) {
+	for n, word := range words {
+		changed := n >= pre && n < pre+len(common) && !common[n-pre]
+		if len(segs) > 0 && segs[len(segs)-1].Changed == changed {
+			segs[len(segs)-1].Text += word
+		} else {
+			segs = append(segs, &DiffSegment{Text: word, Changed: changed})
+		}
+	}
+	return
+}
+
+// splitWords splits the text into runs of letters, digits, and
+// underscores, runs of whitespace, and individual other characters.
+func splitWords(text string) (words []string) {
+	class := func(r rune) int {
+		switch {
+		case r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r):
+			return 1
+		case unicode.IsSpace(r):
+			return 2
+		}
+		return 0
+	}
+	start, last := 0, -1
+	for i, r := range text {
+		c := class(r)
+		if i > 0 && (c != last || c == 0) {
+			words = append(words, text[start:i])
+			start = i
+		}
+		last = c
+	}
+	if start < len(text) {
+		words = append(words, text[start:])
+	}
+	return
+}
+
+// diffHeaderPaths parses the old and new paths from the rest of a
+// "diff --git a/<old> b/<new>" header. git quotes either path if it
+// contains unusual characters, such as tabs, quotes, or non-ASCII
+// letters.
+func diffHeaderPaths(s string) (oldPath, newPath string) {
+	var rest string
+	if q, err := strconv.QuotedPrefix(s); err == nil {
+		oldPath, rest = unquotePath(q), strings.TrimPrefix(s[len(q):], " ")
+	} else if i := strings.Index(s, ` "b/`); i >= 0 {
+		oldPath, rest = s[:i], s[i+1:]
+	} else if i := strings.Index(s, " b/"); i >= 0 {
+		oldPath, rest = s[:i], s[i+1:]
+	} else {
+		return "", ""
+	}
+	return strings.TrimPrefix(oldPath, "a/"),
+		strings.TrimPrefix(unquotePath(rest), "b/")
+}
+
+// trimDiffPath removes the "a/" or "b/" prefix from a path in a ---
+// or +++ line, leaving /dev/null intact, and removes git's quoting.
+func trimDiffPath(p string) string {
+	p = unquotePath(strings.TrimRight(p, "\t"))
+	if strings.HasPrefix(p, "a/") || strings.HasPrefix(p, "b/") {
+		return p[2:]
+	}
+	return p
+}
+
+// parseHunkHeader retrieves the starting line numbers from a hunk
+// header of the form "@@ -a,b +c,d @@".
+func parseHunkHeader(header string) (oldStart, newStart int) {
+	fields := strings.Fields(header)
+	if len(fields) < 3 {
+		return 0, 0
+	}
+	oldStart, _ = strconv.Atoi(strings.SplitN(strings.TrimPrefix(fields[1], "-"), ",", 2)[0])
+	newStart, _ = strconv.Atoi(strings.SplitN(strings.TrimPrefix(fields[2], "+"), ",", 2)[0])
+	return
+}
+
+// parseCombinedHeader finds the line at which a hunk of a combined
+// diff begins in the merge, from its header, such as
+// "@@@ -a,b -c,d +e,f @@@", where e is the line.
+func parseCombinedHeader(header string) (newStart int) {
+	for _, field := range strings.Fields(header) {
+		if strings.HasPrefix(field, "+") {
+			newStart, _ = strconv.Atoi(strings.SplitN(field[1:], ",", 2)[0])
+			return
+		}
+	}
+	return 0
+}
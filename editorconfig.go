@@ -0,0 +1,182 @@
+package grove
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"bufio"
+	"bytes"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultTabWidth = 4  // Width of tabs when no .editorconfig sets one
+	maxTabWidth     = 16 // Widest tab which is honored
+)
+
+// TabWidth finds the width at which tabs in the file should be shown,
+// from the tab_width or indent_size properties in the .editorconfig
+// files of the repository at the given ref, as an editor would. Files
+// nearer to the file take precedence, and those above one with
+// root = true are ignored. It is 0 if none of them set a width.
+func (g *git) TabWidth(ref, file string) (width int) {
+	// Gather the .editorconfig files from the file's directory
+	// upward, and then apply them from the top down.
+	var dirs []string
+	var configs [][]byte
+	for dir := path.Dir(file); ; dir = path.Dir(dir) {
+		contents := g.GetFile(ref, path.Join(dir, ".editorconfig"))
+		if len(contents) > 0 {
+			dirs = append(dirs, dir)
+			configs = append(configs, contents)
+			if editorconfigRoot(contents) {
+				break
+			}
+		}
+		if dir == "." {
+			break
+		}
+	}
+
+	props := make(map[string]string)
+	for n := len(configs) - 1; n >= 0; n-- {
+		rel := file
+		if dirs[n] != "." {
+			rel = strings.TrimPrefix(file, dirs[n]+"/")
+		}
+		parseEditorconfig(configs[n], rel, props)
+	}
+
+	if w, err := strconv.Atoi(props["tab_width"]); err == nil {
+		width = w
+	} else if w, err := strconv.Atoi(props["indent_size"]); err == nil {
+		width = w
+	}
+	if width < 1 || width > maxTabWidth {
+		return 0
+	}
+	return width
+}
+
+// editorconfigRoot checks whether an .editorconfig file declares
+// itself the root, with root = true before any section.
+func editorconfigRoot(contents []byte) bool {
+	s := bufio.NewScanner(bytes.NewReader(contents))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if strings.HasPrefix(line, "[") {
+			return false
+		}
+		if key, value, ok := strings.Cut(line, "="); ok &&
+			strings.EqualFold(strings.TrimSpace(key), "root") {
+			return strings.EqualFold(strings.TrimSpace(value), "true")
+		}
+	}
+	return false
+}
+
+// parseEditorconfig reads an .editorconfig file and sets the
+// properties of each section whose glob matches the file, which is
+// relative to the directory of the .editorconfig, in props. Keys and
+// values are lowercased.
+func parseEditorconfig(contents []byte, file string, props map[string]string) {
+	var match bool
+	s := bufio.NewScanner(bytes.NewReader(contents))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		switch {
+		case len(line) == 0 || line[0] == '#' || line[0] == ';':
+		case line[0] == '[' && line[len(line)-1] == ']':
+			re, err := editorconfigGlob(line[1 : len(line)-1])
+			match = err == nil && re.MatchString(file)
+		case match:
+			if key, value, ok := strings.Cut(line, "="); ok {
+				props[strings.ToLower(strings.TrimSpace(key))] =
+					strings.ToLower(strings.TrimSpace(value))
+			}
+		}
+	}
+}
+
+// editorconfigGlob converts an .editorconfig section name into a
+// regular expression matching the paths it applies to. Globs without a
+// slash match files of that name in any directory.
+func editorconfigGlob(glob string) (*regexp.Regexp, error) {
+	if !strings.Contains(glob, "/") {
+		glob = "**/" + glob
+	}
+	glob = strings.TrimPrefix(glob, "/")
+	return regexp.Compile("^" + globPattern(glob) + "$")
+}
+
+// globPattern converts the glob syntax of .editorconfig into that of
+// regexp: * for anything but a slash, ** for anything, ? for a single
+// character, [...] for character classes, and {a,b} for alternatives.
+// Numeric ranges, such as {1..3}, match any integer.
+func globPattern(glob string) string {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch c {
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+			}
+		case '*':
+			if strings.HasPrefix(glob[i:], "**/") {
+				b.WriteString("(?:.*/)?")
+				i += 2
+			} else if strings.HasPrefix(glob[i:], "**") {
+				b.WriteString(".*")
+				i++
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case '{':
+			end := strings.IndexByte(glob[i+1:], '}')
+			if end < 0 {
+				b.WriteString(`\{`)
+				continue
+			}
+			inner := glob[i+1 : i+1+end]
+			i += end + 1
+			if lo, hi, ok := strings.Cut(inner, ".."); ok {
+				_, err1 := strconv.Atoi(lo)
+				_, err2 := strconv.Atoi(hi)
+				if err1 == nil && err2 == nil {
+					b.WriteString(`-?[0-9]+`)
+					continue
+				}
+			}
+			if !strings.Contains(inner, ",") {
+				b.WriteString(regexp.QuoteMeta("{" + inner + "}"))
+				continue
+			}
+			alternatives := strings.Split(inner, ",")
+			for n, alt := range alternatives {
+				alternatives[n] = globPattern(alt)
+			}
+			b.WriteString("(?:" + strings.Join(alternatives, "|") + ")")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,154 @@
+package grove
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// EmailConfig holds the settings for emailing summaries of pushes, in
+// the manner of git's post-receive-email script.
+type EmailConfig struct {
+	// SMTPHost is the address of the mail server, such as
+	// "mail.example.com:587". Emails are only sent if it is set.
+	// Username and Password are used to authenticate to it, if they
+	// are given.
+	SMTPHost string
+	Username string
+	Password string
+
+	// From is the address from which the emails are sent, and To is
+	// the list of addresses to which emails about every repository
+	// are sent.
+	From string
+	To   []string
+
+	// Repos maps glob patterns, (as understood by path.Match,) which
+	// are matched against paths relative to the served directory, to
+	// lists of addresses to which emails about matching repositories
+	// are also sent.
+	Repos map[string][]string
+
+	// Diffs includes the full diff of each update in the email, not
+	// just the list of commits.
+	Diffs bool
+}
+
+// Recipients lists the addresses to which emails about the repository
+// at the URL path repo should be sent.
+func (c EmailConfig) Recipients(repo string) (to []string) {
+	to = append(to, c.To...)
+	repo = strings.Trim(repo, "/")
+	for pattern, addrs := range c.Repos {
+		if matchPath(pattern, repo) {
+			to = append(to, addrs...)
+		}
+	}
+	return
+}
+
+// sendPushEmail sends an email summarizing each ref updated by the
+// push, if emails are enabled and anyone is to receive them.
+func sendPushEmail(g *git, event *pushEvent) error {
+	c := conf().Email
+	if len(c.SMTPHost) == 0 {
+		return nil
+	}
+	to := c.Recipients(event.Repo)
+	if len(to) == 0 {
+		return nil
+	}
+
+	var auth smtp.Auth
+	if len(c.Username) > 0 {
+		host, _, err := net.SplitHostPort(c.SMTPHost)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", c.Username, c.Password, host)
+	}
+	for _, u := range event.Updates {
+		msg := pushEmail(g, event, u, to)
+		if err := smtp.SendMail(c.SMTPHost, auth, c.From, to, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pushEmail composes the email about a single ref update.
+func pushEmail(g *git, event *pushEvent, u *refUpdate, to []string) []byte {
+	name := strings.Trim(event.Repo, "/")
+	subject := fmt.Sprintf("[%s] %s %s %s", name, u.Kind(), u.ShortName(),
+		u.Action())
+	if !u.Created() && !u.Deleted() {
+		subject += fmt.Sprintf(" (%.7s..%.7s)", u.Old, u.New)
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\n", conf().Email.From)
+	fmt.Fprintf(&b, "To: %s\n", strings.Join(to, ", "))
+	fmt.Fprintf(&b, "Subject: %s\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %s\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%d.%.12s@%s>\n", time.Now().UnixNano(),
+		u.New, emailDomain(conf().Email.From))
+	fmt.Fprintf(&b, "X-Git-Repo: %s\nX-Git-Refname: %s\n", name, u.Name)
+	fmt.Fprintf(&b, "X-Git-Oldrev: %s\nX-Git-Newrev: %s\n", u.Old, u.New)
+	b.WriteString("MIME-Version: 1.0\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\n\n")
+
+	fmt.Fprintf(&b, "The %s %s of %s has been %s by a push.\n\n",
+		u.Kind(), u.ShortName(), name, u.Action())
+	switch {
+	case u.Deleted():
+		fmt.Fprintf(&b, "       was  %s\n", u.Old)
+	case u.Created():
+		fmt.Fprintf(&b, "        at  %s\n", u.New)
+	default:
+		fmt.Fprintf(&b, "      from  %s\n        to  %s\n\n", u.Old, u.New)
+		fmt.Fprintf(&b, "%s%s/compare/%s...%s\n", event.Root, event.Repo,
+			u.Old, u.New)
+	}
+
+	if len(u.Commits) > 0 {
+		b.WriteString("\nCommits:\n\n")
+		for _, c := range u.Commits {
+			fmt.Fprintf(&b, "%.7s  %s\n", c.SHA, c.Subject)
+			fmt.Fprintf(&b, "         %s <%s>\n", c.Author, c.Email)
+			fmt.Fprintf(&b, "         %s%s/commit/%s\n\n", event.Root,
+				event.Repo, c.SHA)
+		}
+		if u.More {
+			fmt.Fprintf(&b, "... and more; only the last %d commits are shown.\n",
+				maxPushCommits)
+		}
+	}
+
+	if conf().Email.Diffs && !u.Created() && !u.Deleted() {
+		diff, _ := g.execute("--no-pager", "diff", "--no-color",
+			"--no-ext-diff", "--stat", "-p", u.Old+".."+u.New, "--")
+		if len(diff) > 0 {
+			b.WriteString("\nDiff:\n\n")
+			b.WriteString(diff)
+		}
+	}
+
+	// SMTP requires lines to end in CRLF.
+	return bytes.ReplaceAll(b.Bytes(), []byte("\n"), []byte("\r\n"))
+}
+
+// emailDomain returns the domain of an email address, for use in
+// Message-IDs.
+func emailDomain(addr string) string {
+	if i := strings.LastIndex(addr, "@"); i >= 0 {
+		return strings.TrimRight(addr[i+1:], ">")
+	}
+	return "grove"
+}
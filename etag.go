@@ -0,0 +1,126 @@
+package grove
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// notModified sets the ETag and Last-Modified headers of a page of a
+// repository, and answers with 304 Not Modified if the client already
+// has the page, as told by If-None-Match, or else by If-Modified-Since.
+// It reports whether it did. The page was last modified at the latest
+// of when the commit shown was made, when the git directory of the
+// repository, which holds its refs, last changed, and when the
+// configuration and templates were loaded, or when the age of the
+// commit, as it is shown on the page, last changed. None needs git
+// to be run: the git directory is watched by the index, or else its
+// modification times are used, and the commit is read through the
+// cat-file process. Pages of views which are Volatile, and those of
+// ranges, are left alone, as are all pages with --dev.
+func notModified(w http.ResponseWriter, req *http.Request, pageinfo *gitPage, g *git, route Route, repository, ref string) bool {
+	if conf().Dev || route.View.Volatile || (req.Method != "GET" && req.Method != "HEAD") ||
+		strings.Contains(ref, "..") || len(pageinfo.SHA) == 0 {
+		return false
+	}
+	var changed time.Time
+	if entry, ok := index.Lookup(repository); ok && entry.Repo != nil {
+		changed = entry.Repo.Changed
+	} else {
+		changed = gitDirChanged(path.Join(repository, pageinfo.GitDir))
+	}
+	modified := changed
+	if loadedAt := pageinfo.state.pagesChanged; loadedAt.After(modified) {
+		modified = loadedAt
+	}
+	var age string
+	if committed := g.CommitTime(pageinfo.SHA); !committed.IsZero() {
+		var since time.Time
+		age, since = describeAge(committed, time.Now())
+		if since.After(modified) {
+			modified = since
+		}
+	}
+	etag := pageETag(req, pageinfo, repository, ref, changed, age)
+
+	header := w.Header()
+	header.Set("ETag", etag)
+	if !modified.IsZero() {
+		header.Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+	if match := req.Header.Get("If-None-Match"); len(match) > 0 {
+		if !etagMatches(match, etag) {
+			return false
+		}
+	} else if since, err := http.ParseTime(req.Header.Get("If-Modified-Since")); err != nil ||
+		modified.IsZero() || modified.Truncate(time.Second).After(since) {
+		return false
+	}
+
+	// The cached page keeps the Content-Security-Policy it came with,
+	// whose nonce is the one in the page, rather than being given this
+	// one.
+	header.Del("Content-Security-Policy")
+	header.Del("Content-Encoding")
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// gitDirChanged finds when the refs, description, or settings in the
+// git directory last changed, from the modification times of the files
+// which hold them, for repositories which are not indexed.
+func gitDirChanged(gitDir string) (changed time.Time) {
+	latest := func(p string, info os.FileInfo, err error) error {
+		if err == nil && info.ModTime().After(changed) {
+			changed = info.ModTime()
+		}
+		return nil
+	}
+	for _, name := range []string{"HEAD", "packed-refs", "description", "config"} {
+		info, err := os.Stat(path.Join(gitDir, name))
+		latest(name, info, err)
+	}
+	filepath.Walk(path.Join(gitDir, "refs"), latest)
+	return
+}
+
+// pageETag computes the weak entity tag of a page of a repository at
+// ref. It changes whenever anything shown on the page may have, which
+// is the commit, the path and query of the page, the diff layout, the
+// git directory of the repository, which holds its refs, description,
+// and topics, and the configuration and templates. Times are shown
+// relative to now, and those of older commits change less often, so it
+// also changes when the age of the commit does. It is weak because the
+// page is sent compressed to some clients and not to others.
+func pageETag(req *http.Request, pageinfo *gitPage, repository, ref string, changed time.Time, age string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s\x00%s\x00%s\x00%d\x00%s\x00%d\x00%s\x00%s\x00",
+		repository, ref, pageinfo.SHA, req.URL.Path, req.URL.RawQuery, Version,
+		pageinfo.state.pagesChanged.UnixNano(), pageinfo.Branch, changed.UnixNano(),
+		age, strings.Join(pageinfo.Topics, ","))
+	if cookie, err := req.Cookie(diffCookie); err == nil {
+		fmt.Fprintf(h, "%s\x00", cookie.Value)
+	}
+	return `W/"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// etagMatches reports whether the If-None-Match header lists the
+// entity tag, comparing them weakly, as it requires.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" ||
+			strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
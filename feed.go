@@ -0,0 +1,222 @@
+package grove
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"encoding/xml"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	feedEntries = 50 // Number of events in the site-wide feed
+
+	feedCommit     = "commit"     // A commit was made
+	feedRepository = "repository" // A repository was started
+)
+
+var (
+	// feedCache caches the events of each repository. Entries are
+	// keyed by the tip of the repository, so they never need to be
+	// invalidated, but it is cleared when it reaches feedCacheMax
+	// entries to bound its size.
+	feedCache    = make(map[string][]*feedEvent)
+	feedCacheMu  sync.Mutex
+	feedCacheMax = 1024
+)
+
+// feedEvent is something which happened in one of the served
+// repositories, as shown in the site-wide feed.
+type feedEvent struct {
+	Kind   string    // feedCommit or feedRepository
+	Repo   string    // URL path of the repository, such as "/proj"
+	SHA    string    // Full SHA of the commit
+	Title  string    // Subject of the commit
+	Author string    // Name of the author
+	Email  string    // Email address of the author
+	Hidden bool      // Whether Email is masked or omitted
+	Time   time.Time // Commit time
+}
+
+// The following types are encoded as the Atom feed.
+
+type atomFeed struct {
+	XMLName xml.Name     `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string       `xml:"title"`
+	ID      string       `xml:"id"`
+	Links   []*atomLink  `xml:"link"`
+	Updated string       `xml:"updated"`
+	Entries []*atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomEntry struct {
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Link    *atomLink   `xml:"link"`
+	Updated string      `xml:"updated"`
+	Author  *atomAuthor `xml:"author"`
+}
+
+type atomAuthor struct {
+	Name  string `xml:"name"`
+	Email string `xml:"email,omitempty"`
+}
+
+// FeedEvents retrieves the most recent commits reachable from HEAD, and
+// the start of the repository, which is the time of its first commit.
+// The repository is named by the URL path repoURL in the events.
+// Results are cached per tip SHA.
+func (g *git) FeedEvents(repoURL string) (events []*feedEvent) {
+	tip := g.FullSHA("HEAD")
+	if len(tip) == 0 {
+		return nil
+	}
+	key := g.Path + "\x00" + tip
+	feedCacheMu.Lock()
+	events, ok := feedCache[key]
+	feedCacheMu.Unlock()
+	if ok {
+		return events
+	}
+
+	output, _ := g.execute("log", "-n", strconv.Itoa(feedEntries),
+		"--format=%H%x00%ct%x00%aN%x00%aE%x00%s", tip)
+	for _, line := range strings.Split(strings.TrimRight(output, "\n"), "\n") {
+		if event := parseFeedEvent(line); event != nil {
+			event.Kind, event.Repo = feedCommit, repoURL
+			events = append(events, event)
+		}
+	}
+	output, _ = g.execute("log", "--max-parents=0",
+		"--format=%H%x00%ct%x00%aN%x00%aE%x00%s", tip)
+	roots := strings.Split(strings.TrimRight(output, "\n"), "\n")
+	if event := parseFeedEvent(roots[len(roots)-1]); event != nil {
+		event.Kind, event.Repo = feedRepository, repoURL
+		events = append(events, event)
+	}
+
+	feedCacheMu.Lock()
+	if len(feedCache) >= feedCacheMax {
+		feedCache = make(map[string][]*feedEvent)
+	}
+	feedCache[key] = events
+	feedCacheMu.Unlock()
+	return events
+}
+
+// parseFeedEvent parses a line of git log output with the SHA, commit
+// time, author, email address, and subject of a commit.
+func parseFeedEvent(line string) *feedEvent {
+	fields := strings.SplitN(line, "\x00", 5)
+	if len(fields) != 5 {
+		return nil
+	}
+	unix, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return nil
+	}
+	return &feedEvent{SHA: fields[0], Time: time.Unix(unix, 0),
+		Author: fields[2], Email: fields[3], Title: fields[4]}
+}
+
+// siteFeed gathers the most recent events from every indexed
+// repository which may be served, newest first.
+func siteFeed(req *http.Request) (events []*feedEvent) {
+	for _, repo := range index.Repos() {
+		if _, _, _, status := SplitRepository(rootOf(repo), repo); status != http.StatusOK ||
+			!listable(rootOf(repo), repo) {
+			continue
+		}
+		g := &git{Path: repo, ctx: req.Context()}
+		privacy := conf().RepoEmailPrivacy(relPath(repo))
+		for _, event := range g.FeedEvents(relPath(repo)) {
+			// Events are cached, so they are copied before their
+			// email addresses are hidden.
+			if emailsHidden(privacy) {
+				hidden := *event
+				hidden.Email = hideEmail(privacy, event.Email)
+				hidden.Hidden = true
+				event = &hidden
+			}
+			events = append(events, event)
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time.After(events[j].Time)
+	})
+	if len(events) > feedEntries {
+		events = events[:feedEntries]
+	}
+	return events
+}
+
+// HandleActivityPage shows the most recent commits and new repositories
+// across all of the served repositories.
+func HandleActivityPage(w http.ResponseWriter, req *http.Request) {
+	pageinfo := &gitPage{
+		Prefix:   prefix,
+		Owner:    gitVarUser(),
+		Path:     "/",
+		RootLink: rootLink(req),
+		Version:  Version,
+		Nonce:    requestNonce(req),
+		Feed:     siteFeed(req),
+		ctx:      req.Context(),
+	}
+	if err := executeTemplate(w, "activity.html", pageinfo); err != nil {
+		reqLog(req).Errf("View of %q from %q caused error: %s",
+			req.URL.Path, req.RemoteAddr, err)
+		Error(w, http.StatusInternalServerError)
+	}
+}
+
+// HandleFeed serves the same events as HandleActivityPage as an Atom
+// feed.
+func HandleFeed(w http.ResponseWriter, req *http.Request) {
+	root := rootLink(req)
+	feed := &atomFeed{
+		Title: gitVarUser() + " [Grove]",
+		ID:    root + "/",
+		Links: []*atomLink{
+			{Href: root + "/activity"},
+			{Href: root + "/feed.atom", Rel: "self"},
+		},
+		Updated: time.Now().UTC().Format(time.RFC3339),
+	}
+	events := siteFeed(req)
+	if len(events) > 0 {
+		feed.Updated = events[0].Time.UTC().Format(time.RFC3339)
+	}
+	for _, event := range events {
+		entry := &atomEntry{
+			Updated: event.Time.UTC().Format(time.RFC3339),
+			Author:  &atomAuthor{Name: event.Author, Email: event.Email},
+		}
+		switch event.Kind {
+		case feedCommit:
+			entry.Title = strings.TrimPrefix(event.Repo, "/") + ": " + event.Title
+			entry.ID = root + event.Repo + "/commit/" + event.SHA
+			entry.Link = &atomLink{Href: entry.ID}
+		case feedRepository:
+			entry.Title = "New repository " + strings.TrimPrefix(event.Repo, "/")
+			entry.ID = root + event.Repo + "/"
+			entry.Link = &atomLink{Href: entry.ID}
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	if err := xml.NewEncoder(w).Encode(feed); err != nil {
+		reqLog(req).Errf("Feed failed to encode: %s\n", err)
+	}
+}
@@ -0,0 +1,62 @@
+package grove
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+var (
+	// fixtureEnv is the environment in which fixture repositories are
+	// committed to, so that their authors, dates, and therefore SHAs
+	// are the same every time, regardless of the user's settings.
+	fixtureEnv = []string{
+		"GIT_AUTHOR_NAME=Grove Fixture",
+		"GIT_AUTHOR_EMAIL=fixture@example.com",
+		"GIT_AUTHOR_DATE=2013-01-01T00:00:00Z",
+		"GIT_COMMITTER_NAME=Grove Fixture",
+		"GIT_COMMITTER_EMAIL=fixture@example.com",
+		"GIT_COMMITTER_DATE=2013-01-01T00:00:00Z",
+		"GIT_CONFIG_NOSYSTEM=1",
+		"HOME=" + os.DevNull,
+	}
+)
+
+// NewFixtureRepo creates a throwaway repository named name within dir,
+// such as a temporary directory, for serving with NewHandler in tests.
+// It has a single commit on master adding the given files, which map
+// paths within the repository to their contents, and its path is
+// returned. The commit is the same every time for the same files.
+func NewFixtureRepo(dir, name string, files map[string]string) (repo string, err error) {
+	repo = filepath.Join(dir, name)
+	if err = os.MkdirAll(repo, 0755); err != nil {
+		return "", err
+	}
+	if err = fixtureGit(repo, "init", "--quiet", "--initial-branch=master"); err != nil {
+		return "", err
+	}
+	for file, contents := range files {
+		p := filepath.Join(repo, filepath.FromSlash(file))
+		if err = os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return "", err
+		}
+		if err = os.WriteFile(p, []byte(contents), 0644); err != nil {
+			return "", err
+		}
+	}
+	if err = fixtureGit(repo, "add", "--all"); err != nil {
+		return "", err
+	}
+	return repo, fixtureGit(repo, "commit", "--quiet", "--allow-empty",
+		"--message=Initial commit")
+}
+
+// fixtureGit runs git in a fixture repository.
+func fixtureGit(repo string, args ...string) error {
+	cmd := exec.Command(conf().GitBin, args...)
+	cmd.Dir = repo
+	cmd.Env = append(os.Environ(), fixtureEnv...)
+	return cmd.Run()
+}
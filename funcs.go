@@ -0,0 +1,142 @@
+package grove
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"fmt"
+	"html/template"
+	"strconv"
+	"time"
+)
+
+// templateFuncs are the helper functions available to templates, so
+// that they can format values themselves rather than relying on
+// preformatted strings in gitPage.
+//
+//	reltime    Time since a time.Time, Unix timestamp, or RFC 3339
+//	           string, such as "3 hours ago"
+//	bytes      Size in bytes in human readable form, such as "1.2 KiB"
+//	shortsha   SHA abbreviated to the length Grove uses elsewhere
+//	query      Query, such as .Query, with pairs of keys and values
+//	           set, or removed if the value is empty
+//	avatarhash Hash of an email address, as used by Gravatar
+//	avatar     URL of the avatar for an email address, if enabled
+//	site       Branding settings, such as site.Title
+var templateFuncs = template.FuncMap{
+	"reltime":    relTime,
+	"bytes":      humanBytes,
+	"shortsha":   shortSHA,
+	"query":      withQuery,
+	"avatarhash": avatarHash,
+	"avatar":     avatarURL,
+	"site":       siteBranding,
+}
+
+const (
+	shortSHALength = 8 // Length of SHAs as abbreviated by git.SHA
+)
+
+// relTime describes how long ago the given time was. It accepts a
+// time.Time, a Unix timestamp as an integer or string, or an RFC 3339
+// string, and returns an empty string for anything else.
+func relTime(v interface{}) string {
+	var then time.Time
+	switch t := v.(type) {
+	case time.Time:
+		then = t
+	case int64:
+		then = time.Unix(t, 0)
+	case int:
+		then = time.Unix(int64(t), 0)
+	case string:
+		if unix, err := strconv.ParseInt(t, 10, 64); err == nil {
+			then = time.Unix(unix, 0)
+		} else if parsed, err := time.Parse(time.RFC3339, t); err == nil {
+			then = parsed
+		} else {
+			return ""
+		}
+	default:
+		return ""
+	}
+	description, _ := describeAge(then, time.Now())
+	return description
+}
+
+// describeAge describes how long before now the time then was, as
+// relTime does, and returns when that description began to apply, so
+// that pages showing it can tell when they last changed.
+func describeAge(then, now time.Time) (description string, since time.Time) {
+	d := now.Sub(then)
+	if d < 0 {
+		return "in the future", now
+	}
+	units := []struct {
+		name string
+		size time.Duration
+	}{
+		{"year", 365 * 24 * time.Hour},
+		{"month", 30 * 24 * time.Hour},
+		{"week", 7 * 24 * time.Hour},
+		{"day", 24 * time.Hour},
+		{"hour", time.Hour},
+		{"minute", time.Minute},
+		{"second", time.Second},
+	}
+	for _, unit := range units {
+		if n := int64(d / unit.size); n > 0 {
+			since = then.Add(time.Duration(n) * unit.size)
+			if n == 1 {
+				return "1 " + unit.name + " ago", since
+			}
+			return strconv.FormatInt(n, 10) + " " + unit.name + "s ago", since
+		}
+	}
+	return "just now", then
+}
+
+// humanBytes formats a size in bytes using binary prefixes, such as
+// "512 B" or "1.2 MiB".
+func humanBytes(v interface{}) string {
+	var size int64
+	switch n := v.(type) {
+	case int64:
+		size = n
+	case int:
+		size = int64(n)
+	case uint64:
+		size = int64(n)
+	default:
+		return ""
+	}
+	if size < 1024 {
+		return strconv.FormatInt(size, 10) + " B"
+	}
+	value, prefixes := float64(size), "KMGTPE"
+	for n := range prefixes {
+		value /= 1024
+		if value < 1024 || n == len(prefixes)-1 {
+			return fmt.Sprintf("%.1f %ciB", value, prefixes[n])
+		}
+	}
+	return ""
+}
+
+// shortSHA abbreviates a SHA to shortSHALength characters. Unlike
+// git.SHA, it does not check that the result is unambiguous.
+func shortSHA(sha string) string {
+	if len(sha) > shortSHALength {
+		return sha[:shortSHALength]
+	}
+	return sha
+}
+
+// withQuery sets each of the given pairs of keys and values in the
+// query, as with setQuery, so that links can change one parameter and
+// preserve the rest. An odd final key is ignored.
+func withQuery(q template.URL, pairs ...string) template.URL {
+	for n := 0; n+1 < len(pairs); n += 2 {
+		q = setQuery(q, pairs[n], pairs[n+1])
+	}
+	return q
+}
@@ -1,38 +1,152 @@
-package main
+package grove
 
 // Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
 	"os/exec"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 type Commit struct {
 	SHA     string // Full SHA of the commit
 	Author  string // Author of the commit
+	Email   string // Email address of the author
 	Time    string // Relative time of the commit
 	Subject string // Subject of the commit
 	Body    string // Body of the commit
 }
 
+// Tag is a tag in a repository. Lightweight tags point directly to a
+// commit, and so have no tagger, date, or annotation.
+type Tag struct {
+	Name       string // Name of the tag
+	Annotated  bool   // Whether the tag is an annotated tag object
+	SHA        string // Full SHA of the tag object, or commit
+	Target     string // Full SHA of the object the tag points to
+	Tagger     string // Name of the tagger
+	Email      string // Email address of the tagger
+	Time       string // Relative time the tag was made
+	Subject    string // Subject of the annotation
+	Body       string // Body of the annotation
+	Signature  string // PGP signature of the annotation, if present
+	SigStatus  string // One of the sig* constants
+	SigMessage string // Output from verifying the signature
+}
+
+// Branch is a branch in a repository, along with information about
+// the commit at its tip.
+type Branch struct {
+	Name    string // Short name of the branch
+	SHA     string // Full SHA of the tip commit
+	Author  string // Author of the tip commit
+	Time    string // Relative time of the tip commit
+	Unix    int64  // Time of the tip commit, in seconds since the epoch
+	Subject string // Subject of the tip commit
+	Merged  bool   // Whether the branch is merged into the default branch
+}
+
+// CommitDetail is a commit with the full information about its
+// author, committer, tree, and parents, as needed by the API.
+type CommitDetail struct {
+	SHA            string   // Full SHA of the commit
+	Tree           string   // Full SHA of the commit's tree
+	Parents        []string // Full SHAs of the parents
+	Author         string   // Name of the author
+	AuthorEmail    string   // Email address of the author
+	AuthorDate     string   // Author date, in strict ISO 8601 format
+	Committer      string   // Name of the committer
+	CommitterEmail string   // Email address of the committer
+	CommitterDate  string   // Commit date, in strict ISO 8601 format
+	Message        string   // Full commit message
+}
+
+// TreeEntry is an entry in a tree object, as listed by git ls-tree.
+type TreeEntry struct {
+	Mode string // File mode, such as "100644"
+	Type string // Object type: "blob", "tree", or "commit"
+	SHA  string // Full SHA of the object
+	Size int64  // Size of the blob, or -1 for other types
+	Name string // Name of the entry within the tree
+}
+
+// Ref is a ref in a repository, along with the object it points to.
+type Ref struct {
+	Name string // Full name of the ref, such as "refs/heads/master"
+	SHA  string // Full SHA of the object the ref points to
+	Type string // Type of that object, such as "commit" or "tag"
+}
+
+const (
+	sigNone = "unsigned" // The tag is not signed
+	sigGood = "good"     // The signature was verified
+	sigBad  = "bad"      // The signature could not be verified
+)
+
 const (
-	gitHttpBackend = "git-http-backend"
-	gitLogFmt      = "%H%n%cr%n%an%n%s%n%b"
-	gitLogSep      = "----GROVE-LOG-SEPARATOR----"
+	// Fields of the log formats are separated by NUL bytes, which
+	// can't appear in commit messages, and commits are too, with -z,
+	// so the output is split into groups of gitLogFields or
+	// gitDetailFields. %aN and %aE respect .mailmap.
+	gitLogFmt       = "%H%x00%cr%x00%aN%x00%aE%x00%s%x00%b"
+	gitLogFields    = 6
+	gitDetailFields = 10
+
+	gitBranchFmt = "%(refname:short)%00%(objectname)%00%(authorname)%00" +
+		"%(committerdate:relative)%00%(committerdate:unix)%00%(subject)"
+	gitTagFmt = "%(objecttype)%00%(objectname)%00%(*objectname)%00" +
+		"%(taggername)%00%(taggeremail)%00%(taggerdate:relative)%00" +
+		"%(contents:subject)%00%(contents:body)%00%(contents:signature)"
+	gitDetailFmt = "%H%x00%T%x00%P%x00%aN%x00%aE%x00%aI%x00%cN%x00%cE%x00%cI%x00%B"
+	gitRefFmt    = "%(refname)%00%(objectname)%00%(objecttype)"
+
+	defaultGitBin = "git" // git executable run unless GitBin is set
 )
 
 type git struct {
-	Path string // Directory path
+	Path string          // Directory path
+	ctx  context.Context // Context of the request, for tracing
 }
 
-// Set a number of git variables.
-func gitVarExecPath() (execPath string) {
-	// Use 'git --exec-path' to get the path of the git executables.
-	g := &git{}
-	execPath, _ = g.execute("--exec-path")
-	execPath = strings.TrimRight(execPath, "\n")
-	return
+var (
+	// aheadBehind caches the results of AheadBehind. Because it is
+	// keyed by SHAs, entries never need to be invalidated, but it is
+	// cleared when it reaches aheadBehindMax entries to bound its
+	// size.
+	aheadBehind    = make(map[string][2]int)
+	aheadBehindMu  sync.Mutex
+	aheadBehindMax = 4096
+
+	// totalCommits caches the results of TotalCommits. It is keyed by
+	// a hash of the SHAs of every ref, so a push invalidates an entry
+	// by changing its key. It is cleared when it reaches
+	// totalCommitsMax entries to bound its size.
+	totalCommits    = make(map[string]int)
+	totalCommitsMu  sync.Mutex
+	totalCommitsMax = 1024
+)
+
+// gitVersion runs the git executable given by bin, and returns the
+// version it reports, such as "git version 2.43.0", or an error if it
+// can't be run or does not appear to be git.
+func gitVersion(bin string) (version string, err error) {
+	out, err := exec.Command(bin, "--version").Output()
+	if err != nil {
+		return "", err
+	}
+	version = strings.TrimSpace(string(out))
+	if !strings.HasPrefix(version, "git version ") {
+		return "", fmt.Errorf("unexpected output %q from --version", version)
+	}
+	return version, nil
 }
 
 func gitVarUser() (user string) {
@@ -65,6 +179,10 @@ func (g *git) GetBranchDescription(branch string) (description string) {
 // GetFile retrives the contents of a file from the repository. The
 // commit is either a SHA or pointer (such as HEAD, or HEAD^).
 func (g *git) GetFile(commit, file string) (contents []byte) {
+	_, objType, contents, err := g.catFileObject("contents", commit+":"+file)
+	if err == nil && objType != "tree" {
+		return contents
+	}
 	contents, _ = g.executeB("--no-pager", "show", commit+":"+file)
 	return contents
 }
@@ -72,6 +190,13 @@ func (g *git) GetFile(commit, file string) (contents []byte) {
 // Retrieve a list of items in a directory from the repository. The
 // commit is either a SHA or a pointer (such as HEAD, or HEAD^).
 func (g *git) GetDir(commit, dir string) (files []string) {
+	sha, objType, contents, err := g.catFileObject("contents", commit+":"+dir)
+	if err == nil {
+		if objType != "tree" {
+			return nil
+		}
+		return treeNames(contents, len(sha)/2)
+	}
 	output, _ := g.execute("--no-pager", "show", "--name-only", commit+":"+dir)
 	parts := strings.SplitN(output, "\n\n", 2) // Split on the blank line
 	if len(parts) == 2 && strings.HasPrefix(parts[0], "tree") {
@@ -87,21 +212,335 @@ func (g *git) SHA(ref string) (sha string) {
 	return strings.TrimRight(commit, "\n")
 }
 
+// FullSHA retrieves the full SHA of the commit the given reference
+// points to.
+func (g *git) FullSHA(ref string) (sha string) {
+	commit, _ := g.execute("rev-parse", "--verify", "--quiet", ref+"^{commit}")
+	return strings.TrimRight(commit, "\n")
+}
+
+// ResolveCommit resolves any commit-ish, such as a branch, tag, or
+// abbreviated SHA, to the full SHA of the commit. Abbreviated SHAs are
+// disambiguated by considering only commits. It returns an empty
+// string if the name does not resolve to exactly one commit.
+func (g *git) ResolveCommit(name string) (sha string) {
+	if len(name) == 0 || strings.HasPrefix(name, "-") {
+		return ""
+	}
+	if len(name) >= 4 && len(name) < 40 && isHex(name) {
+		output, _ := g.execute("rev-parse", "--disambiguate="+name)
+		var commits []string
+		for _, candidate := range strings.Fields(output) {
+			t, _ := g.execute("cat-file", "-t", candidate)
+			if strings.TrimRight(t, "\n") == "commit" {
+				commits = append(commits, candidate)
+			}
+		}
+		switch len(commits) {
+		case 1:
+			return commits[0]
+		case 0:
+			// It may still be a ref which happens to look like a
+			// SHA, such as a branch named "cafe".
+		default:
+			return ""
+		}
+	}
+	return g.FullSHA(name)
+}
+
+// ResolveObject resolves an abbreviated SHA to the full SHA of the
+// single object it refers to, and that object's type, such as "commit"
+// or "blob". It returns empty strings if the abbreviation is invalid or
+// ambiguous.
+func (g *git) ResolveObject(abbrev string) (sha, objType string) {
+	if len(abbrev) < 4 || len(abbrev) > 40 || !isHex(abbrev) {
+		return "", ""
+	}
+	output, _ := g.execute("rev-parse", "--disambiguate="+abbrev)
+	candidates := strings.Fields(output)
+	if len(candidates) != 1 {
+		return "", ""
+	}
+	t, _ := g.execute("cat-file", "-t", candidates[0])
+	return candidates[0], strings.TrimRight(t, "\n")
+}
+
+// FindBlob finds a commit, reachable from any ref, which introduced
+// the blob with the given full SHA, along with the path at which it
+// was introduced. It returns empty strings if there is none.
+func (g *git) FindBlob(sha string) (commit, file string) {
+	output, _ := g.execute("log", "--all", "--find-object="+sha, "-n", "1",
+		"--format=%H", "--raw", "--no-abbrev")
+	lines := strings.Split(output, "\n")
+	for _, line := range lines[1:] {
+		// Raw lines look like
+		//    :100644 100644 <old sha> <new sha> M<tab><path>
+		if parts := strings.SplitN(line, "\t", 2); len(parts) == 2 {
+			fields := strings.Fields(parts[0])
+			if len(fields) >= 4 && fields[3] == sha {
+				return lines[0], unquotePath(parts[1])
+			}
+		}
+	}
+	return "", ""
+}
+
+// unquotePath removes the quoting which git applies to paths
+// containing unusual characters in its output, such as
+// "dir/\303\274.txt", unless -z is given. Other paths are returned as
+// they are.
+func unquotePath(p string) string {
+	if len(p) < 2 || p[0] != '"' {
+		return p
+	}
+	if unquoted, err := strconv.Unquote(p); err == nil {
+		return unquoted
+	}
+	return p
+}
+
+// escapePath escapes each segment of a path within a repository for
+// use in a URL, so that names containing characters such as "#", "?",
+// or "%" link to the right file. Slashes are kept.
+func escapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for n, s := range segments {
+		segments[n] = url.PathEscape(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+// isHex checks whether the string consists only of lowercase
+// hexadecimal digits.
+func isHex(s string) bool {
+	for _, r := range s {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
 // Tags retrieves a list of all tag names from the repository.
 func (g *git) Tags() (tags []string) {
 	t, _ := g.execute("tag", "--list")
 	return strings.Split(strings.TrimRight(t, "\n"), "\n")
 }
 
+// Branches retrieves all of the branches in the repository, ordered
+// from the most to the least recently committed to. Branches which are
+// merged into the given branch are marked as such.
+func (g *git) Branches(mergedInto string) (branches []*Branch) {
+	output, _ := g.execute("for-each-ref", "--sort=-committerdate",
+		"--format="+gitBranchFmt, "refs/heads")
+	merged := make(map[string]bool)
+	if len(mergedInto) > 0 {
+		m, _ := g.execute("for-each-ref", "--merged="+mergedInto,
+			"--format=%(refname:short)", "refs/heads")
+		for _, name := range strings.Split(m, "\n") {
+			merged[name] = true
+		}
+	}
+
+	for _, line := range strings.Split(strings.TrimRight(output, "\n"), "\n") {
+		fields := strings.Split(line, "\x00")
+		if len(fields) != 6 {
+			continue
+		}
+		unix, _ := strconv.ParseInt(fields[4], 10, 64)
+		branches = append(branches, &Branch{
+			Name:    fields[0],
+			SHA:     fields[1],
+			Author:  fields[2],
+			Time:    fields[3],
+			Unix:    unix,
+			Subject: fields[5],
+			Merged:  merged[fields[0]],
+		})
+	}
+	return
+}
+
+// AheadBehind counts the commits which are reachable from the SHA
+// branch but not base, (ahead,) and those which are reachable from
+// base but not branch, (behind.) Results are cached per pair of SHAs.
+func (g *git) AheadBehind(base, branch string) (ahead, behind int) {
+	key := g.Path + "\x00" + base + "\x00" + branch
+	aheadBehindMu.Lock()
+	counts, ok := aheadBehind[key]
+	aheadBehindMu.Unlock()
+	if ok {
+		return counts[0], counts[1]
+	}
+
+	output, err := g.execute("rev-list", "--left-right", "--count",
+		base+"..."+branch)
+	fields := strings.Fields(output)
+	if err != nil || len(fields) != 2 {
+		return 0, 0
+	}
+	behind, _ = strconv.Atoi(fields[0])
+	ahead, _ = strconv.Atoi(fields[1])
+
+	aheadBehindMu.Lock()
+	if len(aheadBehind) >= aheadBehindMax {
+		aheadBehind = make(map[string][2]int)
+	}
+	aheadBehind[key] = [2]int{ahead, behind}
+	aheadBehindMu.Unlock()
+	return
+}
+
+// Tag retrieves the tag with the given name, including its
+// annotation and whether its signature, if any, could be verified. It
+// returns nil if the tag does not exist.
+func (g *git) Tag(name string) (tag *Tag) {
+	output, err := g.execute("for-each-ref", "--format="+gitTagFmt,
+		"refs/tags/"+name)
+	fields := strings.Split(output, "\x00")
+	if err != nil || len(fields) != 9 {
+		return nil
+	}
+
+	tag = &Tag{
+		Name:      name,
+		Annotated: fields[0] == "tag",
+		SHA:       fields[1],
+		Target:    fields[2],
+		Tagger:    fields[3],
+		Email:     strings.Trim(fields[4], "<>"),
+		Time:      fields[5],
+		Subject:   fields[6],
+		Body:      strings.TrimRight(fields[7], "\n"),
+		Signature: strings.TrimRight(fields[8], "\n"),
+		SigStatus: sigNone,
+	}
+	if !tag.Annotated {
+		tag.Target = tag.SHA
+	}
+	if len(tag.Signature) > 0 {
+		// Older versions of git include the signature in the body,
+		// so remove it.
+		tag.Body = strings.TrimRight(
+			strings.TrimSuffix(tag.Body, tag.Signature), "\n")
+
+		// git verify-tag writes its results to stderr.
+		args := []string{"verify-tag", "--", name}
+		span := g.startSpan(args)
+		cmd := exec.Command(conf().GitBin, args...)
+		cmd.Dir = g.Path
+		out, err := cmd.CombinedOutput()
+		endSpan(span, err)
+		tag.SigMessage = strings.TrimRight(string(out), "\n")
+		if err == nil {
+			tag.SigStatus = sigGood
+		} else {
+			tag.SigStatus = sigBad
+		}
+	}
+	return
+}
+
+// Archive writes an archive of the tree at the given ref to w, in
+// the given format, (such as "tar.gz" or "zip",) with all paths
+// inside of the given prefix directory. If any paths are given, only
+// they are included.
+func (g *git) Archive(w io.Writer, ref, format, prefix string, paths ...string) (err error) {
+	args := append([]string{"archive", "--format=" + format,
+		"--prefix=" + prefix + "/", ref}, paths...)
+	span := g.startSpan(args)
+	cmd := exec.Command(conf().GitBin, args...)
+	cmd.Dir = g.Path
+	cmd.Env = gitEnv()
+	cmd.Stdout = w
+	err = cmd.Run()
+	endSpan(span, err)
+	return
+}
+
+// LastUpdated finds the commit time of the most recently updated
+// branch, which approximates the time of the last push. It is zero if
+// there are no branches.
+func (g *git) LastUpdated() (t time.Time) {
+	output, _ := g.execute("for-each-ref", "--sort=-committerdate",
+		"--count=1", "--format=%(committerdate:unix)", "refs/heads")
+	unix, err := strconv.ParseInt(strings.TrimSpace(output), 10, 64)
+	if err != nil {
+		return
+	}
+	return time.Unix(unix, 0)
+}
+
+// CommitTime retrieves the time at which the commit was committed, or
+// the zero time if there is no such commit. It is read through the
+// cat-file process if there is one available.
+func (g *git) CommitTime(commit string) (t time.Time) {
+	var output string
+	if _, objType, contents, err := g.catFileObject("contents", commit+"^{commit}"); err == nil {
+		if objType != "commit" {
+			return
+		}
+		for _, line := range strings.Split(string(contents), "\n") {
+			if len(line) == 0 {
+				break // The end of the header
+			}
+			if fields := strings.Fields(line); strings.HasPrefix(line, "committer ") && len(fields) > 2 {
+				output = fields[len(fields)-2]
+			}
+		}
+	} else {
+		output, _ = g.execute("log", "-1", "--format=%ct", commit+"^{commit}", "--")
+	}
+	unix, err := strconv.ParseInt(strings.TrimSpace(output), 10, 64)
+	if err != nil {
+		return
+	}
+	return time.Unix(unix, 0)
+}
+
+// TotalCommits counts the commits reachable from any ref. Counting is
+// proportional to the length of the history, so results are cached for
+// as long as no ref changes, and the bitmap index is used where the
+// repository has one.
 func (g *git) TotalCommits() (commits int) {
-	c, _ := g.execute("rev-list", "--all")
-	return len(strings.Split(strings.TrimRight(c, "\n"), "\n"))
+	refs, err := g.executeB("rev-parse", "--all")
+	if err != nil {
+		return 0
+	}
+	sum := sha256.Sum256(refs)
+	key := g.Path + "\x00" + hex.EncodeToString(sum[:])
+	totalCommitsMu.Lock()
+	commits, ok := totalCommits[key]
+	totalCommitsMu.Unlock()
+	if ok {
+		return commits
+	}
+
+	output, err := g.execute("rev-list", "--count", "--use-bitmap-index", "--all")
+	if err != nil {
+		return 0
+	}
+	commits, _ = strconv.Atoi(strings.TrimSpace(output))
+
+	totalCommitsMu.Lock()
+	if len(totalCommits) >= totalCommitsMax {
+		totalCommits = make(map[string]int)
+	}
+	totalCommits[key] = commits
+	totalCommitsMu.Unlock()
+	return
 }
 
 func (g *git) RefExists(ref string) (exists bool) {
 	// If the exit status of 'git rev-list -n 1 <ref>' is nonzero, the
-	// ref does not exist in the current repository.
-	_, err := g.execute("rev-list", "-n 1", ref)
+	// ref does not exist in the current repository. Refs beginning
+	// with a dash would be taken as options, some of which, such as
+	// --output, write files, so they never exist.
+	if strings.HasPrefix(ref, "-") {
+		return false
+	}
+	_, err := g.execute("rev-list", "-n 1", "--end-of-options", ref)
 	return err == nil
 }
 
@@ -111,74 +550,282 @@ func (g *git) Commits(ref string, max int) (commits []*Commit) {
 	return g.parseLog(ref, max)
 }
 
+// Pickaxe restricts a log to the commits which change the number of
+// occurrences of a string, as with git log -S, or which add or remove
+// lines matching a regular expression, as with git log -G. Either may
+// be limited to a path within the repository.
+type Pickaxe struct {
+	S    string // String whose occurrences were added or removed
+	G    string // Regular expression matching changed lines
+	Path string // Path to which the search is limited, if any
+}
+
+// Active reports whether the pickaxe restricts the log at all. A path
+// alone shows the history of that file or directory.
+func (p Pickaxe) Active() bool {
+	return len(p.S) > 0 || len(p.G) > 0 || len(p.Path) > 0
+}
+
+// args returns the arguments to git log which apply the pickaxe. The
+// path, if any, comes last.
+func (p Pickaxe) args() (args []string) {
+	if len(p.S) > 0 {
+		args = append(args, "-S"+p.S)
+	}
+	if len(p.G) > 0 {
+		args = append(args, "-G"+p.G)
+	}
+	if len(p.Path) > 0 {
+		args = append(args, "--", p.Path)
+	}
+	return
+}
+
+// CommitsPickaxe retrieves a list of commits which match the pickaxe,
+// up to the given maximum number of commits.
+func (g *git) CommitsPickaxe(ref string, max int, p Pickaxe) (commits []*Commit) {
+	return g.parseLog(ref, max, p.args()...)
+}
+
 // CommitsByFile retrieves a list of commits which modify or otherwise
 // affect a file, up to the given maximum number of commits.
 func (g *git) CommitsByFile(ref, file string, max int) (commits []*Commit) {
 	return g.parseLog(ref, max, "--follow", "--", file)
 }
 
-// parseLog is a low-level utility for calling `git log` and producing
-// a []*Commit with no phantom commits. It invokes gitParseCommit to
-// parse individual commits.
-func (g *git) parseLog(ref string, max int, arguments ...string) (commits []*Commit) {
-	// First, we have to go through the arduous process of creating
-	// the command.
-	command := []string{"--no-pager", "log", ref,
-		"--format=format:" + gitLogFmt + gitLogSep}
-	if max > 0 {
-		command = append(command, "-n "+strconv.Itoa(max))
-	}
-	command = append(command, arguments...)
+// CommitsByAuthor retrieves a list of commits by the author with the
+// given email address, up to the given maximum, after skipping the
+// given number of the most recent ones. Authors are matched as mapped
+// by .mailmap, as they are shown and linked.
+func (g *git) CommitsByAuthor(ref, email string, max, skip int) (commits []*Commit) {
+	return g.parseLog(ref, max, "--skip="+strconv.Itoa(skip),
+		"--use-mailmap", "--fixed-strings", "--author=<"+email+">")
+}
 
-	log, _ := g.execute(command...)
-	// Now we must parse the output of that command.
-	commitLogs := strings.Split(log, gitLogSep)
-	// We will have a phantom commit here, though, so we must remove
-	// it.
-	commitLogs = commitLogs[:len(commitLogs)-1]
+// authorCommits lists the SHAs of the commits reachable from the ref
+// which were made by the author with the given email address, as
+// mapped by .mailmap, most recent first. It runs git log, because
+// rev-list does not apply .mailmap.
+func (g *git) authorCommits(ref, email string) (shas []string) {
+	out, _ := g.execute("log", "--use-mailmap", "--format=%H",
+		"--fixed-strings", "--author=<"+email+">", ref)
+	return strings.Fields(out)
+}
+
+// CountByAuthor counts the commits reachable from the ref which were
+// made by the author with the given email address.
+func (g *git) CountByAuthor(ref, email string) (count int) {
+	return len(g.authorCommits(ref, email))
+}
+
+// FirstByAuthor retrieves the earliest commit reachable from the ref
+// which was made by the author with the given email address, or nil if
+// there is none.
+func (g *git) FirstByAuthor(ref, email string) (commit *Commit) {
+	shas := g.authorCommits(ref, email)
+	if len(shas) == 0 {
+		return nil
+	}
+	if commits := g.Commits(shas[len(shas)-1], 1); len(commits) > 0 {
+		return commits[0]
+	}
+	return nil
+}
 
-	commits = make([]*Commit, len(commitLogs))
-	for n, l := range commitLogs {
-		commits[n] = gitParseCommit(strings.Split(l, "\n"))
+// CommitDetails retrieves up to max commits reachable from ref, after
+// skipping the given number, with full detail. If file is not empty,
+// only commits which modify it are included.
+func (g *git) CommitDetails(ref, file string, max, skip int) (commits []*CommitDetail) {
+	args := []string{"--no-pager", "log", "-z", "--format=format:" + gitDetailFmt,
+		"-n", strconv.Itoa(max), "--skip=" + strconv.Itoa(skip), ref, "--"}
+	if len(file) > 0 {
+		args = append(args, file)
+	}
+	output, err := g.execute(args...)
+	if err != nil || len(output) == 0 {
+		return nil
+	}
+	all := strings.Split(output, "\x00")
+	if len(all)%gitDetailFields != 0 {
+		return nil
+	}
+	for n := 0; n < len(all); n += gitDetailFields {
+		fields := all[n : n+gitDetailFields]
+		commits = append(commits, &CommitDetail{
+			SHA:            fields[0],
+			Tree:           fields[1],
+			Parents:        strings.Fields(fields[2]),
+			Author:         fields[3],
+			AuthorEmail:    fields[4],
+			AuthorDate:     fields[5],
+			Committer:      fields[6],
+			CommitterEmail: fields[7],
+			CommitterDate:  fields[8],
+			Message:        strings.TrimRight(fields[9], "\n"),
+		})
 	}
 	return
 }
 
-// gitParseCommit is a low-level utility for parsing log formats of
-// the following format. They are generated like this by gitLogFmt.
-//    <full hash>
-//    <commit time relative>
-//    <author name>
-//    <nonwrapped commit message>
-func gitParseCommit(log []string) (commit *Commit) {
-	commit = new(Commit)
-	for _, l := range log {
-		if len(commit.SHA) == 0 {
-			// If l is empty, then this will be run again.
-			commit.SHA = l
+// TreeEntries lists the entries of the tree at the given path in the
+// given commit. The path must name a directory, or be empty for the
+// top level.
+func (g *git) TreeEntries(commit, dir string) (entries []*TreeEntry) {
+	tree := commit + "^{tree}"
+	if len(dir) > 0 {
+		tree = commit + ":" + dir
+	}
+	output, _ := g.execute("ls-tree", "-l", "-z", tree)
+	for _, line := range strings.Split(output, "\x00") {
+		// Lines look like
+		//    <mode> <type> <sha> <size><tab><name>
+		parts := strings.SplitN(line, "\t", 2)
+		if len(parts) != 2 {
 			continue
 		}
-		if len(commit.Time) == 0 {
-			commit.Time = l
+		fields := strings.Fields(parts[0])
+		if len(fields) != 4 {
 			continue
 		}
-		if len(commit.Author) == 0 {
-			commit.Author = l
-			continue
+		size, err := strconv.ParseInt(fields[3], 10, 64)
+		if err != nil {
+			size = -1
 		}
-		if len(commit.Subject) == 0 {
-			commit.Subject = l
+		entries = append(entries, &TreeEntry{
+			Mode: fields[0],
+			Type: fields[1],
+			SHA:  fields[2],
+			Size: size,
+			Name: parts[1],
+		})
+	}
+	return
+}
+
+// ObjectAt retrieves the full SHA and type of the object at the given
+// path in the given commit. It returns empty strings if there is none.
+func (g *git) ObjectAt(commit, file string) (sha, objType string) {
+	if sha, objType, _, err := g.catFileObject("info", commit+":"+file); err == nil {
+		return sha, objType
+	}
+	output, err := g.execute("rev-parse", "--verify", "--quiet", commit+":"+file)
+	if err != nil {
+		return "", ""
+	}
+	sha = strings.TrimRight(output, "\n")
+	t, _ := g.execute("cat-file", "-t", sha)
+	return sha, strings.TrimRight(t, "\n")
+}
+
+// Refs retrieves the branches and tags in the repository whose full
+// names begin with the given prefix, such as "refs/heads/".
+func (g *git) Refs(prefix string) (refs []*Ref) {
+	output, _ := g.execute("for-each-ref", "--format="+gitRefFmt,
+		"refs/heads", "refs/tags")
+	for _, line := range strings.Split(strings.TrimRight(output, "\n"), "\n") {
+		fields := strings.Split(line, "\x00")
+		if len(fields) != 3 || !strings.HasPrefix(fields[0], prefix) {
 			continue
 		}
+		refs = append(refs, &Ref{Name: fields[0], SHA: fields[1], Type: fields[2]})
+	}
+	return
+}
+
+// CommitDiff retrieves the changes introduced by the given commit. For
+// merges, this is the combined diff against all of the parents, which
+// leaves out files that match one of them.
+func (g *git) CommitDiff(sha string, opts DiffOptions) (files []*DiffFile) {
+	args := []string{"--no-pager", "show", "--format=", "--patch", "--cc",
+		"--no-color", "--no-ext-diff"}
+	args = append(args, opts.args()...)
+	output, _ := g.execute(append(args, sha, "--")...)
+	return parseDiff(output)
+}
+
+// Parents lists the full SHAs of the parents of the given commit, in
+// order. There are several if it is a merge.
+func (g *git) Parents(sha string) []string {
+	output, _ := g.execute("rev-parse", sha+"^@")
+	return strings.Fields(output)
+}
 
-		commit.Body += l + "\n"
+// Diff retrieves the changes between the two given commits. If
+// mergeBase is true, then the changes are those on the ref to since
+// it diverged from the ref from, as in `git diff from...to`.
+func (g *git) Diff(from, to string, mergeBase bool, opts DiffOptions) (files []*DiffFile) {
+	spec := from + ".." + to
+	if mergeBase {
+		spec = from + "..." + to
 	}
+	args := []string{"--no-pager", "diff", "--no-color", "--no-ext-diff"}
+	args = append(args, opts.args()...)
+	output, _ := g.execute(append(args, "--end-of-options", spec, "--")...)
+	return parseDiff(output)
+}
+
+// UpdateServerInfo rewrites the info/refs and objects/info/packs files
+// which are needed by clients using the dumb HTTP protocol. git only
+// rewrites them if they have changed. Repositories which Grove can't
+// write to are left as they are.
+func (g *git) UpdateServerInfo() {
+	if _, err := g.execute("update-server-info"); err != nil {
+		l.Debugf("Could not update server info of %q: %s\n", g.Path, err)
+	}
+}
 
-	// Now, remove the trailing "\n" characters.
-	commit.Body = strings.TrimRight(commit.Body, "\n")
+// parseLog is a low-level utility for calling `git log` and producing
+// a []*Commit with no phantom commits. It invokes gitParseCommit to
+// parse individual commits.
+func (g *git) parseLog(ref string, max int, arguments ...string) (commits []*Commit) {
+	// First, we have to go through the arduous process of creating
+	// the command.
+	command := []string{"--no-pager", "log", "-z", ref,
+		"--format=format:" + gitLogFmt}
+	if max > 0 {
+		command = append(command, "-n "+strconv.Itoa(max))
+	}
+	command = append(command, arguments...)
+
+	log, err := g.execute(command...)
+	if err != nil || len(log) == 0 {
+		return nil
+	}
+	// Now we must parse the output of that command. Every commit has
+	// the same number of fields, so if the output can't be divided
+	// into them, it is malformed.
+	fields := strings.Split(log, "\x00")
+	if len(fields)%gitLogFields != 0 {
+		return nil
+	}
+	commits = make([]*Commit, 0, len(fields)/gitLogFields)
+	for n := 0; n < len(fields); n += gitLogFields {
+		commits = append(commits, gitParseCommit(fields[n:n+gitLogFields]))
+	}
 	return
 }
 
+// gitParseCommit is a low-level utility for parsing the fields of a
+// commit in the following order. They are generated like this by
+// gitLogFmt.
+//
+//	<full hash>
+//	<commit time relative>
+//	<author name, as mapped by .mailmap>
+//	<author email, as mapped by .mailmap>
+//	<subject>
+//	<body>
+func gitParseCommit(fields []string) (commit *Commit) {
+	return &Commit{
+		SHA:     fields[0],
+		Time:    fields[1],
+		Author:  fields[2],
+		Email:   fields[3],
+		Subject: fields[4],
+		Body:    strings.TrimRight(fields[5], "\n"),
+	}
+}
+
 // execute invokes exec.Command() with the given command, arguments,
 // and working directory. All CR ('\r') characters are removed in
 // output.
@@ -188,10 +835,13 @@ func (g *git) execute(args ...string) (output string, err error) {
 }
 
 func (g *git) executeB(args ...string) (output []byte, err error) {
-	cmd := exec.Command("git", args...)
+	span := g.startSpan(args)
+	cmd := exec.Command(conf().GitBin, args...)
 	if len(g.Path) != 0 {
 		cmd.Dir = g.Path
 	}
+	cmd.Env = gitEnv()
 	out, err := cmd.Output()
+	endSpan(span, err)
 	return out, err
 }
@@ -0,0 +1,70 @@
+package grove
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"testing"
+)
+
+// TestParseLog commits messages which the old, text-separated log
+// format could not be parsed from, and checks that parseLog reads each
+// of them back whole.
+func TestParseLog(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoding string // i18n.commitEncoding, if not UTF-8
+		message  string
+		subject  string
+		body     string
+	}{
+		{"empty body", "", "Only a subject", "Only a subject", ""},
+		{"multiline body", "", "Subject\n\nFirst line\nSecond line\n\nNew paragraph\n",
+			"Subject", "First line\nSecond line\n\nNew paragraph"},
+		{"multiline subject", "", "Wrapped\nsubject\n\nBody", "Wrapped subject", "Body"},
+		{"old separator in subject", "", "Before ----GROVE-LOG-SEPARATOR---- after\n\nBody",
+			"Before ----GROVE-LOG-SEPARATOR---- after", "Body"},
+		{"old separator in body", "", "Subject\n\n----GROVE-LOG-SEPARATOR----\nMore",
+			"Subject", "----GROVE-LOG-SEPARATOR----\nMore"},
+		// git takes messages which are not UTF-8 to be Latin-1, unless
+		// another encoding is given, and log shows them in UTF-8.
+		{"non-UTF-8 subject", "", "Caf\xe9 \xff\xfe\n\nBody", "Café ÿþ", "Body"},
+		{"Latin-1 subject", "ISO-8859-1", "Caf\xe9\n\nBody", "Café", "Body"},
+		{"Shift JIS subject", "SHIFT-JIS", "\x93\xfa\x96\x7b\n\nBody", "日本", "Body"},
+		{"unusual characters", "", "Tab\there, %H %x00 \\0 <a@b.c> ✓\n\n\x1e\x1f%n",
+			"Tab\there, %H %x00 \\0 <a@b.c> ✓", "\x1e\x1f%n"},
+	}
+
+	repo, err := NewFixtureRepo(t.TempDir(), "log", nil)
+	if err != nil {
+		t.Fatalf("creating repository: %s", err)
+	}
+	for _, test := range tests {
+		args := []string{"commit", "--quiet", "--allow-empty", "--message=" + test.message}
+		if len(test.encoding) > 0 {
+			args = append([]string{"-c", "i18n.commitEncoding=" + test.encoding}, args...)
+		}
+		if err := fixtureGit(repo, args...); err != nil {
+			t.Fatalf("committing %s: %s", test.name, err)
+		}
+	}
+
+	g := &git{Path: repo}
+	commits := g.parseLog("HEAD", len(tests))
+	if len(commits) != len(tests) {
+		t.Fatalf("parsed %d commits, want %d", len(commits), len(tests))
+	}
+	for i, test := range tests {
+		// The log lists the most recent commit first.
+		commit := commits[len(commits)-1-i]
+		if commit.Subject != test.subject {
+			t.Errorf("%s: subject is %q, want %q", test.name, commit.Subject, test.subject)
+		}
+		if commit.Body != test.body {
+			t.Errorf("%s: body is %q, want %q", test.name, commit.Body, test.body)
+		}
+		if len(commit.SHA) != 40 || commit.Author != "Grove Fixture" ||
+			commit.Email != "fixture@example.com" {
+			t.Errorf("%s: commit is %+v", test.name, commit)
+		}
+	}
+}
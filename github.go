@@ -0,0 +1,384 @@
+package grove
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	githubPerPage    = 30  // Default number of commits per page
+	githubMaxPerPage = 100 // Maximum number of commits per page
+)
+
+var (
+	// githubViews lists the resources which may follow a repository
+	// in an API path, such as /repos/<repo>/commits.
+	githubViews = map[string]bool{
+		"commits": true, "contents": true, "git": true,
+	}
+)
+
+// The following types are encoded as the responses of the GitHub
+// compatible API. Only the commonly used fields of GitHub's own
+// responses are included.
+
+type githubOwner struct {
+	Login string `json:"login"`
+	Type  string `json:"type"`
+}
+
+type githubRepo struct {
+	Name          string       `json:"name"`
+	FullName      string       `json:"full_name"`
+	Owner         *githubOwner `json:"owner"`
+	Private       bool         `json:"private"`
+	Description   string       `json:"description"`
+	DefaultBranch string       `json:"default_branch"`
+	URL           string       `json:"url"`
+	HTMLURL       string       `json:"html_url"`
+	CloneURL      string       `json:"clone_url"`
+	SSHURL        string       `json:"ssh_url,omitempty"`
+}
+
+type githubPerson struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+	Date  string `json:"date"`
+}
+
+type githubSHA struct {
+	SHA string `json:"sha"`
+	URL string `json:"url,omitempty"`
+}
+
+type githubCommitData struct {
+	Author    *githubPerson `json:"author"`
+	Committer *githubPerson `json:"committer"`
+	Message   string        `json:"message"`
+	Tree      *githubSHA    `json:"tree"`
+}
+
+type githubCommit struct {
+	SHA     string            `json:"sha"`
+	URL     string            `json:"url"`
+	HTMLURL string            `json:"html_url"`
+	Commit  *githubCommitData `json:"commit"`
+	Parents []*githubSHA      `json:"parents"`
+}
+
+type githubContent struct {
+	Type        string `json:"type"`
+	Name        string `json:"name"`
+	Path        string `json:"path"`
+	SHA         string `json:"sha"`
+	Size        int64  `json:"size"`
+	URL         string `json:"url"`
+	HTMLURL     string `json:"html_url"`
+	DownloadURL string `json:"download_url,omitempty"`
+	Encoding    string `json:"encoding,omitempty"`
+	Content     string `json:"content,omitempty"`
+}
+
+type githubObject struct {
+	SHA  string `json:"sha"`
+	Type string `json:"type"`
+	URL  string `json:"url"`
+}
+
+type githubRef struct {
+	Ref    string        `json:"ref"`
+	URL    string        `json:"url"`
+	Object *githubObject `json:"object"`
+}
+
+type githubError struct {
+	Message string `json:"message"`
+}
+
+// githubAPI holds the state of a single request to the GitHub
+// compatible API.
+type githubAPI struct {
+	g       *git
+	repoURL string // URL path of the repository, such as "/proj"
+	root    string // Root URL of Grove, from rootLink
+	api     string // URL of the repository's API resource
+}
+
+// HandleGitHub serves a small subset of GitHub's REST API, (version
+// 3,) under /api/github/, so that tools which speak it can be pointed
+// at Grove by changing their base URL. Repositories are named by their
+// paths, so /api/github/repos/group/proj refers to /group/proj.
+// Supported are the repository itself, its commits, the contents of
+// its files and directories, and its refs.
+func HandleGitHub(w http.ResponseWriter, req *http.Request) {
+	reqLog(req).Debugf("GitHub API request %q from %q\n",
+		req.URL.Path, req.RemoteAddr)
+	if req.Method != "GET" && req.Method != "HEAD" {
+		githubRespond(w, http.StatusMethodNotAllowed, nil)
+		return
+	}
+	rest := strings.TrimPrefix(req.URL.Path, prefix+"/api/github")
+	if !strings.HasPrefix(rest, "/repos/") {
+		githubRespond(w, http.StatusNotFound, nil)
+		return
+	}
+	u := strings.TrimPrefix(rest, "/repos")
+
+	// Find the repository, which is either followed by a resource,
+	// or is the whole path.
+	repoURL, view, rest, ok := findRepoURL(u, githubViews)
+	if !ok {
+		repoURL = path.Clean(u)
+	}
+	toplevel, p := locate(repoURL)
+	repository, file, _, status := SplitRepository(toplevel, p)
+	if status != http.StatusOK {
+		githubRespond(w, status, nil)
+		return
+	}
+	if git, _ := isGit(repository); !git || len(file) != 0 {
+		githubRespond(w, http.StatusNotFound, nil)
+		return
+	}
+
+	a := &githubAPI{
+		g:       &git{Path: repository, ctx: req.Context()},
+		repoURL: repoURL,
+		root:    rootLink(req),
+	}
+	a.api = a.root + "/api/github/repos" + repoURL
+
+	var v interface{}
+	switch view {
+	case "":
+		v = a.repo()
+	case "commits":
+		if len(rest) > 0 {
+			v = a.commit(rest)
+		} else {
+			v = a.commits(req)
+		}
+	case "contents":
+		v = a.contents(rest, req.FormValue("ref"))
+	case "git":
+		if rest == "refs" || strings.HasPrefix(rest, "refs/") {
+			v = a.refs(rest)
+		}
+	}
+	if v == nil {
+		githubRespond(w, http.StatusNotFound, nil)
+		return
+	}
+	githubRespond(w, http.StatusOK, v)
+}
+
+// githubRespond writes v as the JSON encoded response. If v is nil,
+// an error message is written in its place, as GitHub does.
+func githubRespond(w http.ResponseWriter, status int, v interface{}) {
+	if v == nil {
+		v = &githubError{Message: http.StatusText(status)}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		l.Errf("GitHub API response failed to encode: %s\n", err)
+	}
+}
+
+// repo describes the repository itself.
+func (a *githubAPI) repo() *githubRepo {
+	branch := a.g.Branch("HEAD")
+	r := &githubRepo{
+		Name:          path.Base(a.repoURL),
+		FullName:      strings.TrimPrefix(a.repoURL, "/"),
+		Owner:         &githubOwner{Login: gitVarUser(), Type: "User"},
+		Description:   a.g.GetBranchDescription(branch),
+		DefaultBranch: branch,
+		URL:           a.api,
+		HTMLURL:       a.root + a.repoURL + "/",
+	}
+	_, gitDir := isGit(a.g.Path)
+	r.CloneURL = a.root + a.repoURL + "/" + gitDir
+	if len(conf().SSHHost) > 0 {
+		for _, u := range cloneURLs(&gitPage{RootLink: a.root,
+			Path: a.repoURL + "/", GitDir: gitDir}, a.g.Path) {
+			if u.Name == "SSH" {
+				r.SSHURL = string(u.URL)
+			}
+		}
+	}
+	return r
+}
+
+// commits lists the commits reachable from the sha parameter, or from
+// HEAD, optionally only those which modify the path parameter. They
+// are paginated with the page and per_page parameters.
+func (a *githubAPI) commits(req *http.Request) interface{} {
+	ref := req.FormValue("sha")
+	if len(ref) == 0 {
+		ref = "HEAD"
+	}
+	sha := a.g.ResolveCommit(ref)
+	if len(sha) == 0 {
+		return nil
+	}
+	perPage, err := strconv.Atoi(req.FormValue("per_page"))
+	if err != nil || perPage < 1 {
+		perPage = githubPerPage
+	} else if perPage > githubMaxPerPage {
+		perPage = githubMaxPerPage
+	}
+	page, err := strconv.Atoi(req.FormValue("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	commits := make([]*githubCommit, 0, perPage)
+	for _, c := range a.g.CommitDetails(sha, strings.Trim(req.FormValue("path"), "/"),
+		perPage, (page-1)*perPage) {
+		commits = append(commits, a.makeCommit(c))
+	}
+	return commits
+}
+
+// commit describes the single commit named by ref.
+func (a *githubAPI) commit(ref string) interface{} {
+	sha := a.g.ResolveCommit(ref)
+	if len(sha) == 0 {
+		return nil
+	}
+	commits := a.g.CommitDetails(sha, "", 1, 0)
+	if len(commits) == 0 {
+		return nil
+	}
+	return a.makeCommit(commits[0])
+}
+
+// makeCommit converts a CommitDetail to its API form.
+func (a *githubAPI) makeCommit(c *CommitDetail) *githubCommit {
+	privacy := conf().RepoEmailPrivacy(a.repoURL)
+	commit := &githubCommit{
+		SHA:     c.SHA,
+		URL:     a.api + "/commits/" + c.SHA,
+		HTMLURL: a.root + a.repoURL + "/commit/" + c.SHA,
+		Commit: &githubCommitData{
+			Author: &githubPerson{Name: c.Author,
+				Email: hideEmail(privacy, c.AuthorEmail), Date: c.AuthorDate},
+			Committer: &githubPerson{Name: c.Committer,
+				Email: hideEmail(privacy, c.CommitterEmail), Date: c.CommitterDate},
+			Message: c.Message,
+			Tree:    &githubSHA{SHA: c.Tree},
+		},
+		Parents: make([]*githubSHA, 0, len(c.Parents)),
+	}
+	for _, parent := range c.Parents {
+		commit.Parents = append(commit.Parents, &githubSHA{
+			SHA: parent,
+			URL: a.api + "/commits/" + parent,
+		})
+	}
+	return commit
+}
+
+// contents describes the file or directory at the given path in ref,
+// or HEAD. Files include their contents, base64 encoded, and
+// directories are described by a list of their entries.
+func (a *githubAPI) contents(file, ref string) interface{} {
+	if len(ref) == 0 {
+		ref = "HEAD"
+	}
+	commit := a.g.ResolveCommit(ref)
+	if len(commit) == 0 {
+		return nil
+	}
+	file = strings.Trim(file, "/")
+	refQuery := "?ref=" + url.QueryEscape(ref)
+
+	if len(file) > 0 {
+		sha, objType := a.g.ObjectAt(commit, file)
+		switch objType {
+		case "":
+			return nil
+		case "blob":
+			contents := a.g.GetFile(commit, file)
+			return &githubContent{
+				Type:        "file",
+				Name:        path.Base(file),
+				Path:        file,
+				SHA:         sha,
+				Size:        int64(len(contents)),
+				URL:         a.api + "/contents/" + escapePath(file) + refQuery,
+				HTMLURL:     a.root + a.repoURL + "/blob/" + escapePath(file) + refQuery,
+				DownloadURL: a.root + a.repoURL + "/raw/" + escapePath(file) + refQuery,
+				Encoding:    "base64",
+				Content:     base64.StdEncoding.EncodeToString(contents),
+			}
+		}
+	}
+
+	entries := a.g.TreeEntries(commit, file)
+	list := make([]*githubContent, 0, len(entries))
+	for _, e := range entries {
+		p := path.Join(file, e.Name)
+		c := &githubContent{
+			Name:    e.Name,
+			Path:    p,
+			SHA:     e.SHA,
+			URL:     a.api + "/contents/" + escapePath(p) + refQuery,
+			HTMLURL: a.root + a.repoURL + "/tree/" + escapePath(p) + refQuery,
+		}
+		switch {
+		case e.Type == "tree":
+			c.Type = "dir"
+		case e.Type == "commit":
+			c.Type = "submodule"
+		case e.Mode == "120000":
+			c.Type = "symlink"
+			c.Size = e.Size
+		default:
+			c.Type = "file"
+			c.Size = e.Size
+			c.HTMLURL = a.root + a.repoURL + "/blob/" + escapePath(p) + refQuery
+			c.DownloadURL = a.root + a.repoURL + "/raw/" + escapePath(p) + refQuery
+		}
+		list = append(list, c)
+	}
+	return list
+}
+
+// refs lists the refs whose names begin with "refs/" followed by the
+// rest of the given path, such as "refs/heads". If the path names a
+// single ref exactly, then only that ref is returned, not in a list.
+func (a *githubAPI) refs(p string) interface{} {
+	name := strings.TrimRight(p, "/")
+	refs := a.g.Refs(name)
+	list := make([]*githubRef, 0, len(refs))
+	for _, r := range refs {
+		ref := &githubRef{
+			Ref: r.Name,
+			URL: a.api + "/git/" + r.Name,
+			Object: &githubObject{
+				SHA:  r.SHA,
+				Type: r.Type,
+				URL:  a.api + "/git/" + r.Type + "s/" + r.SHA,
+			},
+		}
+		if r.Name == name {
+			return ref
+		}
+		if name == "refs" || strings.HasPrefix(r.Name, name+"/") {
+			list = append(list, ref)
+		}
+	}
+	if len(list) == 0 {
+		return nil
+	}
+	return list
+}
@@ -1,14 +1,27 @@
 // Grove - Git self-hosting for developers
 //
+// Package grove serves the git repositories within directories to git
+// clients, along with a web interface for browsing them. The grove
+// command is built on it. NewHandler returns the handler for a set of
+// directories, which may be served by an http.Server or an
+// httptest.Server, and Serve runs a complete server, as the command
+// does.
+//
+// The configuration, the index of the served directories, and the rest
+// of Grove's state are held by the package rather than by handlers, so
+// only one handler may be in use at a time. Each call to NewHandler
+// replaces the state of the handler made before it, which then serves
+// the new one's directories, and stops watching the old directories.
+// Tests which make handlers must not run in parallel, and programs can
+// only embed one instance of Grove. NewFixtureRepo creates throwaway
+// repositories for such tests to serve.
+//
 // Copyright ⓒ 2013 Alexander Bauer and Luke Evers (GPLv3)
-package main
+package grove
 
 import (
-	"flag"
 	"github.com/inhies/go-utils/log"
-	_ "log"
 	"os"
-	"path"
 )
 
 var (
@@ -26,81 +39,15 @@ var (
 	l *log.Logger
 )
 
-const (
-	usage = "usage: %s [repositorydir]\n"
-)
-
-var (
-	fQuiet = flag.Bool("q", false, "disable logging output")
-	//	fVerbose = flag.Bool("v", false, "enable verbose output")
-	fDebug = flag.Bool("debug", false, "enable debugging output")
-
-	fBind = flag.String("bind", Bind, "interface to bind to")
-	fPort = flag.String("port", Port, "port to listen on")
-	fRes  = flag.String("res", Resources, "resources directory")
-	fHost = flag.String("host", BaseURL, "hostname and prefix to use in links")
-	fWeb = flag.Bool("web", true, "enable web browsing")
-
-	fShowVersion  = flag.Bool("version", false, "print major version and exit")
-	fShowFVersion = flag.Bool("version-full", false, "print full version and exit")
-	fShowBind     = flag.Bool("show-bind", false, "print default bind interface and exit")
-	fShowPort     = flag.Bool("show-port", false, "print default port and exit")
-	fShowRes      = flag.Bool("show-res", false, "print default resources directory and exit")
-)
-
-func main() {
-	flag.Parse()
-
-	// Open a new logger with an appropriate log level.
-	if *fQuiet {
-		LogLevel = -1 // Disable ALL output
-		//	} else if *fVerbose {
-		//		LogLevel = log.INFO
-	} else if *fDebug {
-		LogLevel = log.DEBUG
-	}
-	l, _ = log.NewLevel(LogLevel, true, os.Stdout, "", log.Ltime)
-
-	// If any of the 'show' flags are set, print the relevant variable
-	// and exit.
-	switch {
-	case *fShowVersion:
-		l.Println(Version)
-		return
-	case *fShowFVersion:
-		l.Println(Version)
-		return
-	case *fShowBind:
-		l.Println(Bind)
-		return
-	case *fShowPort:
-		l.Println(Port)
-		return
-	case *fShowRes:
-		l.Println(Resources)
-		return
-	}
-
-	l.Infof("Starting Grove version %s\n", Version)
-
-	var repodir string
-	if flag.NArg() > 0 {
-		repodir = path.Clean(flag.Arg(0))
+// SetLogger sets the logger to which Grove logs. If it is not set,
+// NewHandler logs to standard output at LogLevel.
+func SetLogger(logger *log.Logger) {
+	l = logger
+}
 
-		if !path.IsAbs(repodir) {
-			wd, err := os.Getwd()
-			if err != nil {
-				l.Fatalf("Error getting working directory: %s\n", err)
-			}
-			repodir = path.Join(wd, repodir)
-		}
-	} else {
-		wd, err := os.Getwd()
-		if err != nil {
-			l.Fatalf("Error getting working directory: %s\n", err)
-		}
-		repodir = wd
+// defaultLogger sets up the logger, if SetLogger has not been called.
+func defaultLogger() {
+	if l == nil {
+		l, _ = log.NewLevel(LogLevel, true, os.Stdout, "", log.Ltime)
 	}
-
-	Serve(repodir)
 }
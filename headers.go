@@ -0,0 +1,81 @@
+package grove
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+const (
+	// defaultCSP is the Content-Security-Policy sent by default. The
+	// string {nonce} is replaced with the nonce of each request, which
+	// templates place on their inline scripts and styles. Images may
+	// come from anywhere, because READMEs and avatars link to them.
+	defaultCSP = "default-src 'self'; script-src 'self' 'nonce-{nonce}'; " +
+		"style-src 'self' 'nonce-{nonce}'; style-src-attr 'unsafe-inline'; " +
+		"img-src * data:; object-src 'none'; base-uri 'self'; form-action 'self'"
+
+	defaultReferrerPolicy = "same-origin"
+	defaultFrameAncestors = "'none'"
+
+	nonceBytes = 16 // Number of random bytes in each nonce
+)
+
+// nonceKey is the context key under which the nonce of a request is
+// stored.
+type nonceKey struct{}
+
+// securityHandler wraps a handler so that every response carries the
+// security headers given in the configuration. A new nonce is made
+// for each request, and can be retrieved with requestNonce.
+func securityHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b := make([]byte, nonceBytes)
+		if _, err := rand.Read(b); err != nil {
+			l.Errf("Could not generate nonce: %s\n", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError),
+				http.StatusInternalServerError)
+			return
+		}
+		nonce := base64.RawURLEncoding.EncodeToString(b)
+
+		header := w.Header()
+		header.Set("X-Content-Type-Options", "nosniff")
+		if len(conf().ReferrerPolicy) > 0 {
+			header.Set("Referrer-Policy", conf().ReferrerPolicy)
+		}
+		if csp := contentSecurityPolicy(nonce); len(csp) > 0 {
+			header.Set("Content-Security-Policy", csp)
+		}
+		if hsts := strictTransportSecurity(); len(hsts) > 0 && req.TLS != nil {
+			header.Set("Strict-Transport-Security", hsts)
+		}
+
+		h.ServeHTTP(w, req.WithContext(
+			context.WithValue(req.Context(), nonceKey{}, nonce)))
+	})
+}
+
+// contentSecurityPolicy builds the Content-Security-Policy header from
+// the CSP and FrameAncestors settings, using the given nonce.
+func contentSecurityPolicy(nonce string) string {
+	var directives []string
+	if len(conf().CSP) > 0 {
+		directives = append(directives, strings.Replace(conf().CSP, "{nonce}", nonce, -1))
+	}
+	if len(conf().FrameAncestors) > 0 {
+		directives = append(directives, "frame-ancestors "+conf().FrameAncestors)
+	}
+	return strings.Join(directives, "; ")
+}
+
+// requestNonce returns the nonce made for the request by
+// securityHandler, or an empty string if there is none.
+func requestNonce(req *http.Request) string {
+	nonce, _ := req.Context().Value(nonceKey{}).(string)
+	return nonce
+}
@@ -0,0 +1,146 @@
+package grove
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"sort"
+	"strings"
+)
+
+const (
+	// zeroSHA stands in for the old SHA of a ref which was created,
+	// or the new SHA of one which was deleted, as in git's hooks.
+	zeroSHA = "0000000000000000000000000000000000000000"
+
+	maxPushCommits = 100 // Most commits of each ref to notify about
+)
+
+// refUpdate is a change to a single ref made by a push.
+type refUpdate struct {
+	Name    string    // Full name of the ref, such as "refs/heads/master"
+	Old     string    // SHA before the push, or zeroSHA if it was created
+	New     string    // SHA after the push, or zeroSHA if it was deleted
+	Commits []*Commit // Commits added to the ref, newest first
+	More    bool      // Whether there were more than maxPushCommits
+}
+
+// pushEvent is a push to one of the served repositories, which is
+// passed on to each of the configured notifiers.
+type pushEvent struct {
+	Repo    string       // URL path of the repository, such as "/proj"
+	Root    string       // Root URL of Grove, as given by rootLink
+	Updates []*refUpdate // Refs changed by the push, sorted by name
+}
+
+// Created reports whether the push created the ref.
+func (u *refUpdate) Created() bool {
+	return u.Old == zeroSHA
+}
+
+// Deleted reports whether the push deleted the ref.
+func (u *refUpdate) Deleted() bool {
+	return u.New == zeroSHA
+}
+
+// Kind describes the type of the ref, such as "branch" or "tag".
+func (u *refUpdate) Kind() string {
+	switch {
+	case strings.HasPrefix(u.Name, "refs/heads/"):
+		return "branch"
+	case strings.HasPrefix(u.Name, "refs/tags/"):
+		return "tag"
+	}
+	return "ref"
+}
+
+// ShortName is the name of the ref without its refs/heads/ or
+// refs/tags/ prefix.
+func (u *refUpdate) ShortName() string {
+	return strings.TrimPrefix(strings.TrimPrefix(u.Name, "refs/heads/"),
+		"refs/tags/")
+}
+
+// Action describes what the push did to the ref, such as "created".
+func (u *refUpdate) Action() string {
+	switch {
+	case u.Created():
+		return "created"
+	case u.Deleted():
+		return "deleted"
+	}
+	return "updated"
+}
+
+// RefSHAs maps the name of every branch and tag in the repository to
+// the SHA it points to.
+func (g *git) RefSHAs() map[string]string {
+	shas := make(map[string]string)
+	for _, ref := range g.Refs("refs/") {
+		shas[ref.Name] = ref.SHA
+	}
+	return shas
+}
+
+// refUpdates compares the refs of a repository before and after a
+// push, and returns those which changed, sorted by name.
+func refUpdates(before, after map[string]string) (updates []*refUpdate) {
+	for name, sha := range after {
+		old, ok := before[name]
+		if !ok {
+			old = zeroSHA
+		}
+		if old != sha {
+			updates = append(updates, &refUpdate{Name: name, Old: old, New: sha})
+		}
+	}
+	for name, sha := range before {
+		if _, ok := after[name]; !ok {
+			updates = append(updates, &refUpdate{Name: name, Old: sha, New: zeroSHA})
+		}
+	}
+	sort.Slice(updates, func(i, j int) bool {
+		return updates[i].Name < updates[j].Name
+	})
+	return
+}
+
+// PushedCommits lists the commits which the update added to the ref,
+// newest first. For a new ref, those are the commits which are not
+// reachable from any other ref. The second result reports whether
+// there were more than max.
+func (g *git) PushedCommits(u *refUpdate, max int) (commits []*Commit, more bool) {
+	switch {
+	case u.Deleted():
+		return nil, false
+	case u.Created():
+		// HEAD is left out, as it may be the ref which was created.
+		commits = g.parseLog(u.New, max+1, "--not",
+			"--exclude="+u.Name, "--glob=refs/heads/*",
+			"--exclude="+u.Name, "--glob=refs/tags/*")
+	default:
+		commits = g.parseLog(u.Old+".."+u.New, max+1)
+	}
+	if len(commits) > max {
+		return commits[:max], true
+	}
+	return commits, false
+}
+
+// postReceive is run after a push to the repository at gitDir has
+// updated the given refs. It updates the files used by the dumb HTTP
+// protocol, and sends notifications about the push. It is
+// meant to be run in its own goroutine, after the response has been
+// sent, so errors are only logged.
+func postReceive(repo, root, gitDir string, updates []*refUpdate) {
+	g := &git{Path: gitDir}
+	g.UpdateServerInfo()
+	for _, u := range updates {
+		u.Commits, u.More = g.PushedCommits(u, maxPushCommits)
+	}
+	event := &pushEvent{Repo: repo, Root: root, Updates: updates}
+
+	if err := sendPushEmail(g, event); err != nil {
+		l.Errf("Could not send email about push to %q: %s\n", repo, err)
+	}
+	postChat(event)
+}
@@ -0,0 +1,71 @@
+package grove
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// AllowsHost checks whether the Host header of a request, host, names
+// one of the AllowedHosts, or whether any host is allowed because none
+// are given. Hosts are compared without regard to case, and without
+// their port unless the allowed host has one. An allowed host
+// beginning with "*." also allows any subdomain of the rest.
+func (c *Config) AllowsHost(host string) bool {
+	if len(c.AllowedHosts) == 0 {
+		return true
+	}
+	host = strings.ToLower(host)
+	name := hostname(host)
+	for _, allowed := range c.AllowedHosts {
+		candidate := name
+		if _, _, err := net.SplitHostPort(allowed); err == nil {
+			candidate = host
+		}
+		if domain, ok := strings.CutPrefix(allowed, "*."); ok {
+			if strings.HasSuffix(candidate, "."+domain) {
+				return true
+			}
+		} else if candidate == strings.Trim(allowed, "[]") {
+			return true
+		}
+	}
+	return false
+}
+
+// hostHandler wraps a handler so that requests whose Host header does
+// not name one of the AllowedHosts are refused, because links, clone
+// URLs, and redirects are built from it, and so could otherwise be
+// made to point elsewhere, such as in a shared cache. Requests without
+// a valid Host are bad requests, and those for another host are
+// misdirected.
+func hostHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		status := http.StatusOK
+		switch {
+		case len(conf().AllowedHosts) == 0:
+		case len(req.Host) == 0 || !validHost(hostname(req.Host)):
+			status = http.StatusBadRequest
+		case !conf().AllowsHost(req.Host):
+			status = http.StatusMisdirectedRequest
+		}
+		if status != http.StatusOK {
+			reqLog(req).Noticef("Request to %q from %q refused for host %q\n",
+				req.URL.Path, req.RemoteAddr, req.Host)
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// hostname removes the port, if any, and the brackets around an IPv6
+// address from the value of a Host header.
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return strings.Trim(host, "[]")
+}
@@ -0,0 +1,411 @@
+package grove
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"github.com/fsnotify/fsnotify"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxIndexDepth is the number of directories below the served
+	// directory which are indexed. Deeper directories are looked up
+	// on the filesystem as they are requested.
+	maxIndexDepth = 8
+
+	// defaultDescription is the description git gives to new
+	// repositories, which is not worth showing.
+	defaultDescription = "Unnamed repository;"
+)
+
+// indexEntry is a directory in the repository index.
+type indexEntry struct {
+	Info     os.FileInfo // Information about the directory itself
+	Children []string    // Sorted names of child directories
+	Scanned  bool        // Whether Children is complete and watched
+	Repo     *RepoInfo   // Information about the repository, or nil
+}
+
+// RepoInfo holds the information about a repository which is shown in
+// directory listings.
+type RepoInfo struct {
+	Description string    // Contents of its description file, if not default
+	Bare        bool      // Whether the repository has no working tree
+	Tip         string    // Short SHA of HEAD
+	Topics      []string  // Topics from the grove.topics setting
+	Updated     time.Time // Commit time of the latest branch
+	Changed     time.Time // When its git directory, such as its refs, last changed
+}
+
+// repoIndex is an in-memory index of the directories and repositories
+// within the served directories. It is kept up to date by watching the
+// directories with fsnotify, so that requests need not walk the
+// filesystem.
+type repoIndex struct {
+	mu      sync.RWMutex
+	roots   []string
+	entries map[string]*indexEntry // Entries by filesystem path
+	repos   map[string]string      // Repositories by watched .git path
+	watcher *fsnotify.Watcher
+}
+
+var (
+	index *repoIndex // Index of the served directories, or nil
+)
+
+// newRepoIndex scans the directories and starts watching them for
+// changes.
+func newRepoIndex(roots ...string) (x *repoIndex, err error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	x = &repoIndex{
+		roots:   roots,
+		entries: make(map[string]*indexEntry),
+		repos:   make(map[string]string),
+		watcher: watcher,
+	}
+	for _, root := range roots {
+		x.scan(root, 0)
+	}
+	go x.watch()
+	return x, nil
+}
+
+// Close stops watching the indexed directories, after which the index
+// is no longer kept up to date.
+func (x *repoIndex) Close() error {
+	if x == nil {
+		return nil
+	}
+	return x.watcher.Close()
+}
+
+// Lookup retrieves a copy of the index entry for the directory p, if
+// it is indexed.
+func (x *repoIndex) Lookup(p string) (entry indexEntry, ok bool) {
+	if x == nil {
+		return
+	}
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	e, ok := x.entries[path.Clean(p)]
+	if ok {
+		entry = *e
+	}
+	return
+}
+
+// Repos lists the paths of the indexed repositories, sorted. Those
+// which are shadowed by another served directory are left out.
+func (x *repoIndex) Repos() (repos []string) {
+	if x == nil {
+		return nil
+	}
+	var all []string
+	x.mu.RLock()
+	for p, entry := range x.entries {
+		if entry.Repo != nil {
+			all = append(all, p)
+		}
+	}
+	x.mu.RUnlock()
+	for _, p := range all {
+		if !shadowed(p) {
+			repos = append(repos, p)
+		}
+	}
+	sort.Strings(repos)
+	return repos
+}
+
+// update calls fn with the entry for p, if it is indexed, while
+// holding the lock, so that fn can change it.
+func (x *repoIndex) update(p string, fn func(entry *indexEntry)) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if entry, ok := x.entries[p]; ok {
+		fn(entry)
+	}
+}
+
+// IsRepo reports whether p is a repository. If the index cannot tell,
+// because p is not within the indexed directories, known is false.
+func (x *repoIndex) IsRepo(p string) (repo, known bool) {
+	if x == nil {
+		return false, false
+	}
+	p = path.Clean(p)
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	if entry, ok := x.entries[p]; ok {
+		return entry.Repo != nil, true
+	}
+	// If the parent is fully indexed, then p would be in the index if
+	// it were a directory at all.
+	if parent, ok := x.entries[path.Dir(p)]; ok && parent.Scanned &&
+		parent.Repo == nil {
+		return false, true
+	}
+	return false, false
+}
+
+// Stat returns information about the directory p from the index, or
+// from the filesystem if it is not indexed.
+func (x *repoIndex) Stat(p string) (os.FileInfo, error) {
+	if entry, ok := x.Lookup(p); ok {
+		return entry.Info, nil
+	}
+	return os.Stat(p)
+}
+
+// scan indexes the directory p and the directories below it, down to
+// maxIndexDepth, and watches them. Repositories are not descended
+// into.
+func (x *repoIndex) scan(p string, depth int) {
+	info, err := os.Stat(p)
+	if err != nil || !info.IsDir() {
+		return
+	}
+	entry := &indexEntry{Info: info}
+
+	if gitDir := gitDirOf(p); len(gitDir) > 0 {
+		entry.Repo = readRepoInfo(p)
+		x.watchRepo(p, gitDir)
+		x.set(p, entry)
+		return
+	}
+	x.set(p, entry)
+	if depth >= maxIndexDepth {
+		return
+	}
+	if err := x.watcher.Add(p); err != nil {
+		l.Debugf("Could not watch %q: %s\n", p, err)
+		return
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return
+	}
+	names, err := f.Readdirnames(0)
+	f.Close()
+	if err != nil {
+		return
+	}
+	var children []string
+	for _, name := range names {
+		child := path.Join(p, name)
+		if fi, err := os.Stat(child); err != nil || !fi.IsDir() {
+			continue
+		}
+		x.scan(child, depth+1)
+		children = append(children, name)
+	}
+	sort.Strings(children)
+
+	x.mu.Lock()
+	entry.Children = children
+	entry.Scanned = true
+	x.mu.Unlock()
+}
+
+// set adds or replaces the entry for p.
+func (x *repoIndex) set(p string, entry *indexEntry) {
+	x.mu.Lock()
+	x.entries[p] = entry
+	x.mu.Unlock()
+}
+
+// watchRepo watches the places in a repository where changes to its
+// refs appear: its git directory itself, which holds HEAD and
+// packed-refs, and every directory below refs, so that pushes of
+// nested branches and tags are noticed too.
+func (x *repoIndex) watchRepo(p, gitDir string) {
+	x.watchGitDir(p, gitDir)
+	filepath.Walk(path.Join(gitDir, "refs"),
+		func(dir string, info os.FileInfo, err error) error {
+			if err == nil && info.IsDir() {
+				x.watchGitDir(p, dir)
+			}
+			return nil
+		})
+}
+
+// watchGitDir watches the directory gitPath within the repository p.
+func (x *repoIndex) watchGitDir(p, gitPath string) {
+	if err := x.watcher.Add(gitPath); err != nil {
+		l.Debugf("Could not watch %q: %s\n", gitPath, err)
+		return
+	}
+	x.mu.Lock()
+	x.repos[gitPath] = p
+	x.mu.Unlock()
+}
+
+// remove removes p and everything below it from the index, and stops
+// watching them.
+func (x *repoIndex) remove(p string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for entry := range x.entries {
+		if isWithin(p, entry) {
+			delete(x.entries, entry)
+			x.watcher.Remove(entry)
+		}
+	}
+	for gitPath, repo := range x.repos {
+		if isWithin(p, repo) {
+			delete(x.repos, gitPath)
+			x.watcher.Remove(gitPath)
+		}
+	}
+}
+
+// depth returns the number of directories between the served
+// directory containing p and p.
+func (x *repoIndex) depth(p string) int {
+	root := rootOf(p)
+	if !isWithin(root, p) {
+		return 0
+	}
+	rel := strings.Trim(strings.TrimPrefix(p, root), "/")
+	if len(rel) == 0 {
+		return 0
+	}
+	return strings.Count(rel, "/") + 1
+}
+
+// watch handles events from the watcher until it is closed.
+func (x *repoIndex) watch() {
+	for {
+		select {
+		case event, ok := <-x.watcher.Events:
+			if !ok {
+				return
+			}
+			x.handle(event)
+		case err, ok := <-x.watcher.Errors:
+			if !ok {
+				return
+			}
+			l.Errf("Repository index watcher error: %s\n", err)
+		}
+	}
+}
+
+// handle updates the index in response to a filesystem event.
+func (x *repoIndex) handle(event fsnotify.Event) {
+	p := path.Clean(event.Name)
+
+	// Changes within a repository's git directory update its
+	// information, unless the git directory itself went away. That of
+	// a bare repository is the repository.
+	x.mu.RLock()
+	repo, inRepo := x.repos[path.Dir(p)]
+	gone, isGitDir := x.repos[p]
+	x.mu.RUnlock()
+	removed := event.Op&(fsnotify.Remove|fsnotify.Rename) != 0
+	switch {
+	case isGitDir && removed && (p == gone || p == path.Join(gone, ".git")):
+		x.rescan(gone)
+		return
+	case isGitDir && removed:
+		// A directory below refs went away, and the watcher has
+		// stopped watching it already.
+		x.mu.Lock()
+		delete(x.repos, p)
+		x.mu.Unlock()
+	}
+	if inRepo {
+		// New directories below refs hold refs of their own, such as
+		// branches named with a slash.
+		if event.Op&fsnotify.Create != 0 &&
+			isWithin(path.Join(gitDirOf(repo), "refs"), p) {
+			if fi, err := os.Stat(p); err == nil && fi.IsDir() {
+				x.watchGitDir(repo, p)
+			}
+		}
+		info := readRepoInfo(repo)
+		x.update(repo, func(entry *indexEntry) { entry.Repo = info })
+		return
+	}
+
+	// A .git directory appearing or disappearing changes whether its
+	// parent is a repository, as do HEAD, objects, and refs for bare
+	// repositories.
+	switch path.Base(p) {
+	case ".git", "HEAD", "objects", "refs":
+		x.rescan(path.Dir(p))
+		return
+	}
+
+	if event.Op == fsnotify.Chmod {
+		// If only the permissions changed, the entry can usually be
+		// updated in place. Directories which could not be read
+		// before are scanned again, in case they can be now.
+		if entry, ok := x.Lookup(p); ok && (entry.Scanned || entry.Repo != nil) {
+			if info, err := os.Stat(p); err == nil {
+				x.update(p, func(entry *indexEntry) { entry.Info = info })
+			}
+			return
+		}
+	}
+	x.rescan(p)
+}
+
+// rescan removes p from the index and scans it again, updating the
+// list of children of its parent.
+func (x *repoIndex) rescan(p string) {
+	x.remove(p)
+	x.scan(p, x.depth(p))
+	for _, root := range x.roots {
+		if p == root {
+			return
+		}
+	}
+
+	name := path.Base(p)
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	parent, ok := x.entries[path.Dir(p)]
+	if !ok {
+		return
+	}
+	children := make([]string, 0, len(parent.Children)+1)
+	for _, child := range parent.Children {
+		if child != name {
+			children = append(children, child)
+		}
+	}
+	if _, indexed := x.entries[p]; indexed {
+		children = append(children, name)
+		sort.Strings(children)
+	}
+	parent.Children = children
+}
+
+// readRepoInfo reads the description, tip, topics, and time of the
+// last update of the repository at p, and whether it is bare. It is
+// read again whenever the git directory changes, so Changed is now.
+func readRepoInfo(p string) *RepoInfo {
+	g := &git{Path: p}
+	info := &RepoInfo{Tip: g.SHA("HEAD"), Topics: readTopics(g),
+		Updated: g.LastUpdated(), Bare: isBare(p), Changed: time.Now()}
+	gitDir := path.Join(p, ".git")
+	if info.Bare {
+		gitDir = p
+	}
+	description, err := os.ReadFile(path.Join(gitDir, "description"))
+	if err == nil && !strings.HasPrefix(string(description), defaultDescription) {
+		info.Description = strings.TrimSpace(string(description))
+	}
+	return info
+}
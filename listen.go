@@ -0,0 +1,165 @@
+package grove
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// listenAddr determines the network and address to listen on for an
+// address given with --bind. Addresses beginning with "unix:" or "/"
+// are Unix sockets. Others are TCP addresses, to which --port is added
+// if they do not have a port of their own. IPv6 literals may be given
+// with or without brackets, and with a zone, such as "fe80::1%eth0".
+func listenAddr(bind string) (network, addr string, err error) {
+	switch {
+	case strings.HasPrefix(bind, "unix:"):
+		return "unix", strings.TrimPrefix(bind, "unix:"), nil
+	case strings.HasPrefix(bind, "/"):
+		return "unix", bind, nil
+	}
+
+	host, port, err := net.SplitHostPort(bind)
+	if err != nil {
+		// Without a port, the whole address is the host.
+		host, port = bind, conf().Port
+		if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+			host = host[1 : len(host)-1]
+		}
+	}
+	if !validHost(host) {
+		return "", "", fmt.Errorf("invalid address %q: %q is not an IP address or hostname", bind, host)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return "", "", fmt.Errorf("invalid address %q: %q is not a port number", bind, port)
+	}
+	return "tcp", net.JoinHostPort(host, port), nil
+}
+
+// validHost checks whether host is empty, for all interfaces, an IP
+// address, which may have a zone if it is IPv6, or a hostname.
+func validHost(host string) bool {
+	if len(host) == 0 {
+		return true
+	}
+	if i := strings.LastIndex(host, "%"); i >= 0 {
+		ip := net.ParseIP(host[:i])
+		return ip != nil && ip.To4() == nil && i < len(host)-1
+	}
+	if net.ParseIP(host) != nil {
+		return true
+	}
+	for _, part := range strings.Split(host, ".") {
+		if len(part) == 0 || len(part) > 63 ||
+			strings.HasPrefix(part, "-") || strings.HasSuffix(part, "-") {
+			return false
+		}
+		for _, c := range part {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+				c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// listen opens a listener on each of the given addresses. If any of
+// them cannot be opened, those which were are closed again.
+func listen(binds []string) (listeners []net.Listener, err error) {
+	for _, bind := range binds {
+		network, addr, err := listenAddr(bind)
+		if err != nil {
+			closeAll(listeners)
+			return nil, err
+		}
+		ln, err := listenOn(network, addr)
+		if err != nil {
+			closeAll(listeners)
+			return nil, err
+		}
+		l.Infof("Listening on %s\n", ln.Addr())
+		listeners = append(listeners, wrapListener(ln))
+	}
+	return listeners, nil
+}
+
+// listenOn listens on the address, as net.Listen does. Unix sockets
+// left behind by an earlier instance are replaced, and new ones are
+// given the permissions from --socket-mode, if it was set, so that
+// only the reverse proxy in front of Grove need be able to connect.
+func listenOn(network, addr string) (ln net.Listener, err error) {
+	if network != "unix" {
+		return net.Listen(network, addr)
+	}
+	removeSocket(addr)
+	if conf().SocketMode == 0 {
+		return net.Listen(network, addr)
+	}
+
+	// The socket is made in a directory which only Grove can enter,
+	// and moved into place once it has its permissions, so that
+	// nobody can connect to it before then.
+	dir, err := os.MkdirTemp(filepath.Dir(addr), ".grove-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "socket")
+	unixLn, err := net.ListenUnix(network, &net.UnixAddr{Name: tmp, Net: network})
+	if err != nil {
+		return nil, err
+	}
+	unixLn.SetUnlinkOnClose(false)
+	if err = os.Chmod(tmp, os.FileMode(conf().SocketMode)); err == nil {
+		err = os.Rename(tmp, addr)
+	}
+	if err != nil {
+		unixLn.Close()
+		return nil, err
+	}
+	return socketListener{unixLn, addr}, nil
+}
+
+// socketListener is a listener on a Unix socket which was moved to
+// path after it was made, and so removes it there when it is closed.
+type socketListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (ln socketListener) Close() error {
+	err := ln.UnixListener.Close()
+	os.Remove(ln.path)
+	return err
+}
+
+// wrapListener wraps a listener to read PROXY protocol headers from
+// every connection, if --proxy-protocol was given.
+func wrapListener(ln net.Listener) net.Listener {
+	if conf().ProxyProtocol {
+		return proxyListener{ln}
+	}
+	return ln
+}
+
+// closeAll closes each of the listeners.
+func closeAll(listeners []net.Listener) {
+	for _, ln := range listeners {
+		ln.Close()
+	}
+}
+
+// removeSocket removes the Unix socket at p, if there is one, such as
+// when it was left behind by an earlier instance. Other files are
+// left alone, so that listening on them fails.
+func removeSocket(p string) {
+	if fi, err := os.Lstat(p); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(p)
+	}
+}
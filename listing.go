@@ -0,0 +1,104 @@
+package grove
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DirEntry is an entry in the listing of a directory outside of any
+// repository, as served by the list API.
+type DirEntry struct {
+	Name        string    `json:"name"`                  // Name of the entry within the directory
+	Type        string    `json:"type"`                  // "repository", "directory", or "file"
+	Size        int64     `json:"size"`                  // Size in bytes, as reported by the filesystem
+	Modified    time.Time `json:"mtime"`                 // Time the entry was last modified
+	URL         string    `json:"url"`                   // Path of the entry's page
+	Description string    `json:"description,omitempty"` // Description of the repository, if any
+}
+
+// DirResponse is the response of the list API.
+type DirResponse struct {
+	Path    string      `json:"path"`    // URL path of the directory
+	Entries []*DirEntry `json:"entries"` // Entries, sorted by name
+}
+
+// HandleList serves the listing of a directory above the repositories
+// as JSON, at /api/v1/<directory>/list, so that the served tree can be
+// navigated by scripts. Entries are listed as MakeDirPage lists them,
+// following symlinks and leaving out those which may not be served.
+func HandleList(w http.ResponseWriter, req *http.Request) {
+	reqLog(req).Debugf("List request %q from %q\n",
+		req.URL.Path, req.RemoteAddr)
+	rest := strings.TrimPrefix(req.URL.Path, prefix+"/api/v1")
+	if !strings.HasSuffix(rest, "/list") {
+		apiRespond(w, http.StatusNotFound, nil)
+		return
+	}
+	dirURL := path.Clean("/" + strings.TrimSuffix(rest, "/list"))
+
+	toplevel, p := locate(dirURL)
+	directory, file, _, status := SplitRepository(toplevel, p)
+	if status != http.StatusOK {
+		apiRespond(w, status, nil)
+		return
+	}
+	// Directories within repositories are listed by their trees
+	// instead.
+	if git, _ := isGit(directory); git || len(file) != 0 {
+		apiRespond(w, http.StatusNotFound, nil)
+		return
+	}
+	fi, err := index.Stat(directory)
+	if err != nil || !fi.IsDir() {
+		apiRespond(w, http.StatusNotFound, nil)
+		return
+	}
+	if !CheckPerms(directory, fi) {
+		apiRespond(w, http.StatusForbidden, nil)
+		return
+	}
+
+	children, err := listDir(directory)
+	if err != nil {
+		apiRespond(w, http.StatusNotFound, nil)
+		return
+	}
+
+	base := strings.TrimSuffix(dirURL, "/") + "/"
+	r := &DirResponse{Path: base, Entries: make([]*DirEntry, 0, len(children))}
+	for _, child := range children {
+		n := path.Base(child)
+		info, err := os.Stat(child)
+		if err != nil || !CheckPerms(child, info) || !listable(directory, child) {
+			continue
+		}
+		entry := &DirEntry{
+			Name:     n,
+			Type:     "file",
+			Size:     info.Size(),
+			Modified: info.ModTime(),
+			URL:      prefix + base + escapePath(n),
+		}
+		if info.IsDir() {
+			entry.Type = "directory"
+			entry.URL += "/"
+			if git, _ := isGit(child); git {
+				entry.Type = "repository"
+				if indexed, ok := index.Lookup(child); ok && indexed.Repo != nil {
+					entry.Description = indexed.Repo.Description
+				}
+			}
+		}
+		r.Entries = append(r.Entries, entry)
+	}
+	sort.Slice(r.Entries, func(i, j int) bool {
+		return r.Entries[i].Name < r.Entries[j].Name
+	})
+	apiRespond(w, http.StatusOK, r)
+}
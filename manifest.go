@@ -0,0 +1,131 @@
+package grove
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"encoding/xml"
+	"net/http"
+	"path"
+	"strings"
+)
+
+const (
+	manifestRemote = "grove" // Name of the remote in manifest.xml
+)
+
+// manifestProject is a repository listed in the manifest.
+// Name is relative to the served directory, SSHURL is only given if
+// the SSHHost setting is, and Revision is the branch which is checked
+// out, or its SHA if HEAD is detached.
+type manifestProject struct {
+	Name        string `json:"name"`
+	URL         string `json:"url"`
+	SSHURL      string `json:"ssh_url,omitempty"`
+	Revision    string `json:"revision"`
+	Description string `json:"description,omitempty"`
+
+	gitDir string // ".git", or empty if the repository is bare
+}
+
+// The following types are encoded as manifest.xml, in the format read
+// by Android's repo tool.
+
+type repoManifest struct {
+	XMLName  xml.Name              `xml:"manifest"`
+	Remote   repoManifestRemote    `xml:"remote"`
+	Default  repoManifestDefault   `xml:"default"`
+	Projects []repoManifestProject `xml:"project"`
+}
+
+type repoManifestRemote struct {
+	Name  string `xml:"name,attr"`
+	Fetch string `xml:"fetch,attr"`
+}
+
+type repoManifestDefault struct {
+	Remote string `xml:"remote,attr"`
+}
+
+type repoManifestProject struct {
+	Name     string `xml:"name,attr"`
+	Path     string `xml:"path,attr"`
+	Revision string `xml:"revision,attr"`
+}
+
+// manifest lists every indexed repository which may be served and has
+// at least one commit, sorted by path.
+func manifest(req *http.Request) (projects []*manifestProject) {
+	root := rootLink(req)
+	for _, repo := range index.Repos() {
+		if _, _, _, status := SplitRepository(rootOf(repo), repo); status != http.StatusOK ||
+			!listable(rootOf(repo), repo) {
+			continue
+		}
+		g := &git{Path: repo, ctx: req.Context()}
+		revision := g.Branch("HEAD")
+		if len(revision) == 0 || revision == "HEAD" {
+			// HEAD is detached, so pin the project to its commit.
+			revision = g.FullSHA("HEAD")
+		}
+		if len(revision) == 0 {
+			continue
+		}
+
+		repoURL := relPath(repo)
+		p := &manifestProject{
+			Name:     strings.TrimPrefix(repoURL, "/"),
+			Revision: revision,
+		}
+		if entry, ok := index.Lookup(repo); ok && entry.Repo != nil {
+			p.Description = entry.Repo.Description
+		}
+		_, p.gitDir = isGit(repo)
+		for _, u := range cloneURLs(&gitPage{RootLink: root,
+			Path: repoURL + "/", GitDir: p.gitDir}, repo) {
+			switch u.Name {
+			case "SSH":
+				p.SSHURL = string(u.URL)
+			default:
+				p.URL = string(u.URL)
+			}
+		}
+		projects = append(projects, p)
+	}
+	return projects
+}
+
+// HandleManifest serves the list of repositories as manifest.json, or
+// as manifest.xml for Android's repo tool, so that all of them can be
+// cloned or synced at once.
+func HandleManifest(w http.ResponseWriter, req *http.Request) {
+	projects := manifest(req)
+	if !strings.HasSuffix(req.URL.Path, ".xml") {
+		if projects == nil {
+			projects = []*manifestProject{}
+		}
+		apiRespond(w, http.StatusOK, projects)
+		return
+	}
+
+	// Each project is fetched from the remote URL joined with its name,
+	// so the name includes the .git directory which is served, unless
+	// the repository is bare.
+	m := &repoManifest{
+		Remote:  repoManifestRemote{Name: manifestRemote, Fetch: rootLink(req) + "/"},
+		Default: repoManifestDefault{Remote: manifestRemote},
+	}
+	for _, p := range projects {
+		m.Projects = append(m.Projects, repoManifestProject{
+			Name:     path.Join(p.Name, p.gitDir),
+			Path:     p.Name,
+			Revision: p.Revision,
+		})
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "\t")
+	if err := enc.Encode(m); err != nil {
+		reqLog(req).Errf("Manifest failed to encode: %s\n", err)
+	}
+}
@@ -0,0 +1,144 @@
+package grove
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"bytes"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	gmhtml "github.com/yuin/goldmark/renderer/html"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+	"html"
+	"regexp"
+)
+
+const (
+	LinksSafe     = "safe"     // Neutralize links with dangerous schemes
+	LinksNoFollow = "nofollow" // As LinksSafe, and mark external links nofollow
+	LinksAny      = "any"      // Leave links as they were written
+)
+
+// MarkdownConfig holds the settings for rendering Markdown, such as
+// READMEs and tag annotations.
+type MarkdownConfig struct {
+	Tables        bool // GitHub style tables
+	Footnotes     bool // Footnote references and definitions
+	TaskLists     bool // Checkboxes in lists, such as "- [x] done"
+	Strikethrough bool // ~~struck through~~ text
+	Autolinks     bool // Link bare URLs, such as www.example.com
+	Typographer   bool // Smart quotes, dashes, and ellipses
+	RawHTML       bool // Pass HTML written in the Markdown through
+
+	// Links is the policy for links and images, which is one of
+	// LinksSafe (the default), LinksNoFollow, or LinksAny.
+	Links string
+}
+
+var (
+	// externalLink matches URLs which lead away from Grove.
+	externalLink = regexp.MustCompile(`^(?i)([a-z][a-z0-9+.-]*:|//)`)
+)
+
+// defaultMarkdown returns the Markdown settings which most closely
+// match those Grove used before they were configurable.
+func defaultMarkdown() MarkdownConfig {
+	return MarkdownConfig{
+		Tables:        true,
+		Strikethrough: true,
+		Autolinks:     true,
+		Typographer:   true,
+		RawHTML:       true,
+		Links:         LinksSafe,
+	}
+}
+
+// newMarkdown creates a Markdown renderer according to the settings.
+func newMarkdown(c MarkdownConfig) goldmark.Markdown {
+	var exts []goldmark.Extender
+	if c.Tables {
+		exts = append(exts, extension.Table)
+	}
+	if c.Footnotes {
+		exts = append(exts, extension.Footnote)
+	}
+	if c.TaskLists {
+		exts = append(exts, extension.TaskList)
+	}
+	if c.Strikethrough {
+		exts = append(exts, extension.Strikethrough)
+	}
+	if c.Autolinks {
+		exts = append(exts, extension.Linkify)
+	}
+	if c.Typographer {
+		exts = append(exts, extension.Typographer)
+	}
+
+	opts := []goldmark.Option{
+		goldmark.WithExtensions(exts...),
+		goldmark.WithParserOptions(
+			parser.WithAutoHeadingID(),
+			parser.WithASTTransformers(
+				util.Prioritized(linkPolicy(c.Links), 100))),
+		goldmark.WithRendererOptions(gmhtml.WithXHTML()),
+	}
+	// goldmark only removes dangerous links when raw HTML is not
+	// allowed, so they are always handled by the link policy instead.
+	if c.RawHTML {
+		opts = append(opts, goldmark.WithRendererOptions(gmhtml.WithUnsafe()))
+	}
+	return goldmark.New(opts...)
+}
+
+// renderMarkdown renders Markdown source as HTML according to the
+// current configuration, and sanitizes it. If it cannot be rendered,
+// the source is escaped and shown as preformatted text.
+func renderMarkdown(source []byte) []byte {
+	var buf bytes.Buffer
+	if err := newMarkdown(conf().Markdown).Convert(source, &buf); err != nil {
+		l.Errf("Markdown failed to render: %s\n", err)
+		return []byte("<pre>" + html.EscapeString(string(source)) + "</pre>")
+	}
+	return sanitize(buf.Bytes())
+}
+
+// linkPolicy is an AST transformer which applies one of the Links
+// policies to all links and images in a document.
+type linkPolicy string
+
+// Transform implements parser.ASTTransformer.
+func (p linkPolicy) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	if p == LinksAny {
+		return
+	}
+	source := reader.Source()
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		var dest []byte
+		switch link := n.(type) {
+		case *ast.Link:
+			if gmhtml.IsDangerousURL(link.Destination) {
+				link.Destination = []byte("#")
+			}
+			dest = link.Destination
+		case *ast.Image:
+			if gmhtml.IsDangerousURL(link.Destination) {
+				link.Destination = []byte("")
+			}
+			return ast.WalkContinue, nil
+		case *ast.AutoLink:
+			dest = link.URL(source)
+		default:
+			return ast.WalkContinue, nil
+		}
+		if p == LinksNoFollow && externalLink.Match(dest) {
+			n.SetAttributeString("rel", []byte("nofollow"))
+		}
+		return ast.WalkContinue, nil
+	})
+}
@@ -0,0 +1,102 @@
+package grove
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"path"
+	"strings"
+)
+
+const (
+	EmailsShow = "show" // Show email addresses as they are in git
+	EmailsMask = "mask" // Show only the first letter and the domain
+	EmailsOmit = "omit" // Leave email addresses out entirely
+)
+
+// RepoEmailPrivacy returns how email addresses are shown for the
+// repository at p, which must be relative to the served directory. It
+// is the setting of the first, in sorted order, of the patterns in
+// RepoEmails which matches, or else EmailPrivacy.
+func (c *Config) RepoEmailPrivacy(p string) string {
+	p = strings.Trim(path.Clean("/"+p), "/")
+	var match string
+	for pattern := range c.RepoEmails {
+		if matchPath(pattern, p) && (len(match) == 0 || pattern < match) {
+			match = pattern
+		}
+	}
+	if len(match) > 0 {
+		return c.RepoEmails[match]
+	}
+	return c.EmailPrivacy
+}
+
+// emailsHidden reports whether the EmailPrivacy setting hides email
+// addresses in any way.
+func emailsHidden(privacy string) bool {
+	return privacy == EmailsMask || privacy == EmailsOmit
+}
+
+// hideEmail returns the email address as it may be shown under the
+// given EmailPrivacy setting. Masked addresses keep the first letter
+// and the domain, as in "a***@example.com", and omitted ones are
+// empty.
+func hideEmail(privacy, email string) string {
+	switch privacy {
+	case EmailsMask:
+		local, domain, ok := strings.Cut(email, "@")
+		if !ok || len(local) == 0 {
+			return "***"
+		}
+		return local[:1] + "***@" + domain
+	case EmailsOmit:
+		return ""
+	}
+	return email
+}
+
+// hidePerson returns the value of a trailer naming a person, with
+// their email address hidden under the given EmailPrivacy setting.
+func hidePerson(privacy, name, email string) string {
+	if email = hideEmail(privacy, email); len(email) == 0 {
+		return name
+	}
+	return name + " <" + email + ">"
+}
+
+// hideEmails removes the email addresses of authors, committers,
+// taggers, and people named in trailers from the page, if its
+// repository's EmailPrivacy does not allow them to be shown. Pages
+// only use them to link to author pages and to find avatars, which
+// could be used to recover them, so both are left out.
+func (p *gitPage) hideEmails() {
+	if !emailsHidden(p.emails) {
+		return
+	}
+	logs := append([]*gitLog{p.Commit}, p.Logs...)
+	if p.Blob != nil {
+		logs = append(logs, p.Blob.Last)
+	}
+	for _, entry := range p.Shortlog {
+		entry.Email, entry.Avatar = "", ""
+		logs = append(logs, entry.Logs...)
+	}
+	for _, log := range logs {
+		if log == nil {
+			continue
+		}
+		log.Email, log.Avatar = "", ""
+		for _, t := range log.Trailers {
+			if len(t.Email) > 0 {
+				t.Value = hidePerson(p.emails, t.Name, t.Email)
+				t.Email, t.Avatar = "", ""
+			}
+		}
+	}
+	for _, row := range p.Blame {
+		row.Email = ""
+	}
+	if p.Tag != nil {
+		p.Tag.Avatar = ""
+	}
+}
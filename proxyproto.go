@@ -0,0 +1,171 @@
+package grove
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// proxyHeaderTimeout is how long a client has to send the PROXY
+	// protocol header once it has connected.
+	proxyHeaderTimeout = 10 * time.Second
+
+	// proxyV1MaxLength is the longest a version 1 header may be,
+	// including the trailing CRLF.
+	proxyV1MaxLength = 107
+)
+
+var (
+	// proxyV2Signature begins every version 2 header.
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	errNoProxyHeader  = errors.New("connection did not begin with a PROXY protocol header")
+	errBadProxyHeader = errors.New("malformed PROXY protocol header")
+)
+
+// proxyListener wraps a listener so that every connection must begin
+// with a PROXY protocol header, as sent by HAProxy and other load
+// balancers, which gives the address of the real client.
+type proxyListener struct {
+	net.Listener
+}
+
+func (ln proxyListener) Accept() (net.Conn, error) {
+	c, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: c, r: bufio.NewReader(c)}, nil
+}
+
+// proxyConn is a connection accepted by a proxyListener. The header is
+// read when the connection is first used, rather than in Accept, so
+// that a slow client can't hold up other connections.
+type proxyConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	once   sync.Once
+	remote net.Addr // Address given by the header, if any
+	err    error    // Error reading the header
+}
+
+// readHeader reads the PROXY protocol header, if it has not been read
+// already.
+func (c *proxyConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.remote, c.err = readProxyHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			l.Noticef("Connection from %q refused: %s\n",
+				c.Conn.RemoteAddr(), c.err)
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the address of the client given in the header,
+// or that of the connection itself if the header did not give one,
+// such as for health checks from the load balancer.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads a version 1 or 2 PROXY protocol header from
+// r, and returns the source address it gives. The address is nil if
+// the header does not give one.
+func readProxyHeader(r *bufio.Reader) (addr net.Addr, err error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, errNoProxyHeader
+	}
+	switch {
+	case bytes.Equal(sig, proxyV2Signature):
+		return readProxyV2(r)
+	case bytes.HasPrefix(sig, []byte("PROXY ")):
+		return readProxyV1(r)
+	}
+	return nil, errNoProxyHeader
+}
+
+// readProxyV1 reads a version 1 header, which is a line of text such
+// as "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n".
+func readProxyV1(r *bufio.Reader) (addr net.Addr, err error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil || len(line) > proxyV1MaxLength ||
+		!bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errBadProxyHeader
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errBadProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, errBadProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyV2 reads a version 2 header, which is binary. Only the
+// addresses of TCP over IPv4 and IPv6 are used.
+func readProxyV2(r *bufio.Reader) (addr net.Addr, err error) {
+	header := make([]byte, len(proxyV2Signature)+4)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return nil, errBadProxyHeader
+	}
+	verCmd, family := header[12], header[13]
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return nil, errBadProxyHeader
+	}
+	if verCmd>>4 != 2 {
+		return nil, errBadProxyHeader
+	}
+	if verCmd&0xF == 0 {
+		// LOCAL connections are made by the load balancer itself.
+		return nil, nil
+	}
+
+	switch family {
+	case 0x11: // TCP over IPv4
+		if len(payload) < 12 {
+			return nil, errBadProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]),
+			Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(payload) < 36 {
+			return nil, errBadProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]),
+			Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	}
+	return nil, nil
+}
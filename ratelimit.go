@@ -0,0 +1,179 @@
+package grove
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// requestBucketsMax is the most remote addresses for which a
+	// requestLimiter keeps buckets before it drops them.
+	requestBucketsMax = 10000
+)
+
+// RequestLimitConfig holds the limits on the rate of requests from
+// each remote address to the web interface, to the API, and to git
+// over HTTP. Each is limited separately, so that browsing does not use
+// up clones, nor the other way around.
+type RequestLimitConfig struct {
+	Web RequestLimit
+	API RequestLimit
+	Git RequestLimit
+}
+
+// RequestLimit is a token bucket. Each remote address may make up to
+// Burst requests at once, and Rate more per second after that. There
+// is no limit if Rate is 0. Burst is at least 1.
+type RequestLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// requestLimiters holds a requestLimiter for each kind of request. A
+// nil *requestLimiters does not limit anything.
+type requestLimiters struct {
+	web, api, git *requestLimiter
+}
+
+// newRequestLimiters returns the limiters for the RequestLimits
+// setting.
+func newRequestLimiters(c RequestLimitConfig) *requestLimiters {
+	return &requestLimiters{
+		web: newRequestLimiter(c.Web),
+		api: newRequestLimiter(c.API),
+		git: newRequestLimiter(c.Git),
+	}
+}
+
+// limiter returns the limiter for the kind of the request: git for
+// requests from git clients, as found by splitGitURL, api for those
+// under /api/, and web for everything else.
+func (r *requestLimiters) limiter(req *http.Request) *requestLimiter {
+	if r == nil {
+		return nil
+	}
+	if _, _, ok := splitGitURL(req.URL.Path); ok {
+		return r.git
+	}
+	if strings.HasPrefix(req.URL.Path, prefix+"/api/") {
+		return r.api
+	}
+	return r.web
+}
+
+// requestLimiter keeps a token bucket for each remote address. It is
+// safe to share between goroutines. A nil *requestLimiter does not
+// limit anything.
+type requestLimiter struct {
+	mu      sync.Mutex
+	limit   RequestLimit
+	buckets map[string]*bucket
+}
+
+// bucket holds the tokens left to a remote address, as of when it was
+// last used.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRequestLimiter returns a requestLimiter for the limit, or nil if
+// its rate is not positive.
+func newRequestLimiter(limit RequestLimit) *requestLimiter {
+	if limit.Rate <= 0 {
+		return nil
+	}
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+	return &requestLimiter{limit: limit, buckets: make(map[string]*bucket)}
+}
+
+// allow takes a token from the bucket of the remote address, and
+// reports whether there was one. If there was not, retry is how long
+// it will be until there is.
+func (r *requestLimiter) allow(addr string) (ok bool, retry time.Duration) {
+	if r == nil {
+		return true, 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	b, ok := r.buckets[addr]
+	if !ok {
+		if len(r.buckets) >= requestBucketsMax {
+			r.prune(now)
+		}
+		b = &bucket{tokens: float64(r.limit.Burst), last: now}
+		r.buckets[addr] = b
+	}
+	b.tokens = r.refill(b, now)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / r.limit.Rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// refill returns the tokens in the bucket at the given time.
+func (r *requestLimiter) refill(b *bucket, now time.Time) float64 {
+	tokens := b.tokens + now.Sub(b.last).Seconds()*r.limit.Rate
+	return math.Min(tokens, float64(r.limit.Burst))
+}
+
+// prune drops the buckets which have filled up again, since they are
+// no different from new ones. If that is not enough, because requests
+// are coming from too many addresses at once, it drops all of them,
+// so that they can't use up memory.
+func (r *requestLimiter) prune(now time.Time) {
+	for addr, b := range r.buckets {
+		if r.refill(b, now) >= float64(r.limit.Burst) {
+			delete(r.buckets, addr)
+		}
+	}
+	if len(r.buckets) >= requestBucketsMax {
+		r.buckets = make(map[string]*bucket)
+	}
+}
+
+// remoteKey returns the part of a remote address, in the form
+// host:port, by which requests are limited. It is the IP address of
+// the client, or for IPv6, its /64 network, since each host is
+// commonly given a whole one.
+func remoteKey(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.To4() != nil {
+		return host
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String()
+}
+
+// limitHandler refuses requests from remote addresses which have used
+// up their RequestLimits, with 429 Too Many Requests and a Retry-After
+// header giving the number of seconds until they may try again.
+func limitHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ok, retry := loaded().requestLimits.limiter(req).allow(remoteKey(req.RemoteAddr))
+		if !ok {
+			reqLog(req).Infof("Request to %q from %q refused for exceeding the rate limit\n",
+				req.URL.Path, req.RemoteAddr)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+			http.Error(w, http.StatusText(http.StatusTooManyRequests),
+				http.StatusTooManyRequests)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
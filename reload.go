@@ -0,0 +1,112 @@
+package grove
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"html/template"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var (
+	// onionAddr is the address of the onion service, if one was
+	// published, which is allowed in addition to the AllowedHosts of
+	// every configuration loaded.
+	onionAddr string
+
+	// current holds the state in use. It is replaced as a whole on
+	// SIGHUP, so that it can be read while requests are served.
+	current atomic.Pointer[state]
+)
+
+// state holds what is replaced when the configuration and templates
+// are reloaded.
+type state struct {
+	conf          *Config            // Configuration in use
+	t             *template.Template // Template containing all webui templates
+	pagesChanged  time.Time          // When conf and t were loaded
+	totalLimiter  *rateLimiter       // Limiter for TotalRateLimit, or nil
+	requestLimits *requestLimiters   // Limiters for RequestLimits
+}
+
+func init() {
+	current.Store(&state{conf: DefaultConfig()})
+}
+
+// loaded returns the state in use. Pages load it once, so that they
+// are made with one configuration and set of templates throughout.
+func loaded() *state {
+	return current.Load()
+}
+
+// conf returns the configuration in use.
+func conf() *Config {
+	return loaded().conf
+}
+
+// newState returns the state for the configuration and templates.
+// Rate limiters are kept from old, if it is not nil and their settings
+// are the same, so that clients are not given fresh limits.
+func newState(c *Config, t *template.Template, old *state) *state {
+	s := &state{conf: c, t: t, pagesChanged: time.Now()}
+	if old != nil && old.conf.TotalRateLimit == c.TotalRateLimit {
+		s.totalLimiter = old.totalLimiter
+	} else {
+		s.totalLimiter = newRateLimiter(c.TotalRateLimit)
+	}
+	if old != nil && old.requestLimits != nil &&
+		old.conf.RequestLimits == c.RequestLimits {
+		s.requestLimits = old.requestLimits
+	} else {
+		s.requestLimits = newRequestLimiters(c.RequestLimits)
+	}
+	return s
+}
+
+// reloadOnHangup reloads the configuration and templates, as reload
+// does, every time Grove receives SIGHUP.
+func reloadOnHangup(load func() (*Config, error)) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		reload(load)
+	}
+}
+
+// reload reads the configuration again with load, and the templates, and
+// replaces those in use only if both can be read, so that a mistake in
+// either leaves Grove as it was. Requests in progress are not
+// interrupted. Settings used only when Grove starts, such as those for
+// listening, TLS, and the onion service, still need a restart. So does
+// the path under which Grove is reached, since its routes are set up
+// under it, so a configuration which changes it is refused.
+func reload(load func() (*Config, error)) {
+	l.Noticef("Reloading configuration and templates\n")
+	c, err := load()
+	if err == nil {
+		err = c.normalize()
+	}
+	if err != nil {
+		l.Errf("Could not reload configuration: %s\n", err)
+		return
+	}
+	if p := basePath(c); p != prefix {
+		l.Errf("Could not reload configuration: the path %q under which Grove is reached can't change from %q without a restart\n",
+			p, prefix)
+		return
+	}
+	tmpl, err := getTemplate(c)
+	if err != nil {
+		l.Errf("Could not reload templates: %s\n", err)
+		return
+	}
+	if len(c.AllowedHosts) > 0 && len(onionAddr) > 0 {
+		c.AllowedHosts = append(c.AllowedHosts, onionAddr)
+	}
+
+	current.Store(newState(c, tmpl, loaded()))
+	l.Infof("Reloaded configuration and templates\n")
+}
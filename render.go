@@ -0,0 +1,111 @@
+package grove
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"bytes"
+	"context"
+	"github.com/microcosm-cc/bluemonday"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// rendererTimeout is how long an external renderer may run
+	// before it is killed, so that a pathological file cannot tie up
+	// the server.
+	rendererTimeout = 10 * time.Second
+)
+
+// renderer returns the external command configured to render files
+// with the extension of the given file, or nil if there is none.
+func renderer(file string) (command []string) {
+	return strings.Fields(conf().Renderers[strings.ToLower(path.Ext(file))])
+}
+
+// renderExternal renders the contents of a file with the external
+// command configured for its extension, which reads the file on
+// standard input and writes HTML to standard output. The output is
+// sanitized, because it is embedded in the page. If the command
+// fails, ok is false.
+func renderExternal(file string, contents []byte) (rendered []byte, ok bool) {
+	command := renderer(file)
+	if len(command) == 0 {
+		return nil, false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), rendererTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Stdin = bytes.NewReader(contents)
+	out, err := cmd.Output()
+	if err != nil {
+		l.Errf("Renderer %q failed on %q: %s\n", command[0], file, err)
+		return nil, false
+	}
+	return sanitize(out), true
+}
+
+// SanitizeConfig extends the allowlist of HTML which may appear in
+// rendered content, beyond the elements and attributes which are
+// usually safe in user content.
+type SanitizeConfig struct {
+	// Elements lists additional elements to allow, such as "iframe".
+	Elements []string
+
+	// Attributes maps additional attributes to allow to the elements
+	// they are allowed on, or to "*" for all elements.
+	Attributes map[string][]string
+
+	// URLSchemes lists additional URL schemes to allow in links, such
+	// as "irc". The schemes http, https, and mailto are always allowed.
+	URLSchemes []string
+}
+
+var (
+	// codeClass matches the classes used to mark the language of code
+	// blocks, so that they can be highlighted.
+	codeClass = regexp.MustCompile(`^language-[\w+#-]+$`)
+)
+
+// newHTMLPolicy creates the policy with which rendered HTML is
+// sanitized, according to the settings.
+func newHTMLPolicy(c SanitizeConfig) *bluemonday.Policy {
+	p := bluemonday.UGCPolicy()
+
+	// Whether links are marked nofollow is left to the Markdown link
+	// policy.
+	p.RequireNoFollowOnLinks(false)
+	p.AllowAttrs("rel").Matching(regexp.MustCompile(`^nofollow$`)).OnElements("a")
+	p.AllowAttrs("class").Matching(codeClass).OnElements("code")
+
+	// Allow the checkboxes of task lists, which are always disabled.
+	p.AllowAttrs("type").Matching(regexp.MustCompile(`^checkbox$`)).OnElements("input")
+	p.AllowAttrs("checked", "disabled").OnElements("input")
+
+	p.AllowElements(c.Elements...)
+	for attr, elements := range c.Attributes {
+		for _, element := range elements {
+			if element == "*" {
+				p.AllowAttrs(attr).Globally()
+			} else {
+				p.AllowAttrs(attr).OnElements(element)
+			}
+		}
+	}
+	if len(c.URLSchemes) > 0 {
+		p.AllowURLSchemes(append([]string{"http", "https", "mailto"},
+			c.URLSchemes...)...)
+	}
+	return p
+}
+
+// sanitize removes anything from rendered HTML which is not permitted
+// by the current policy, such as scripts and event handlers, so that
+// repositories cannot serve them to visitors.
+func sanitize(rendered []byte) []byte {
+	return conf().htmlPolicy.SanitizeBytes(rendered)
+}
@@ -0,0 +1,57 @@
+package grove
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"os"
+	"strings"
+)
+
+const (
+	defaultReplaceRefBase = "refs/replace/" // Where git replace stores refs
+)
+
+// gitEnv returns the environment in which git is run, which differs
+// from Grove's own only if replacement objects are configured. It is
+// nil if git should inherit Grove's environment.
+func gitEnv() []string {
+	switch {
+	case conf().NoReplaceObjects:
+		return append(os.Environ(), "GIT_NO_REPLACE_OBJECTS=1")
+	case conf().ReplaceRefBase != defaultReplaceRefBase:
+		return append(os.Environ(), "GIT_REPLACE_REF_BASE="+conf().ReplaceRefBase)
+	}
+	return nil
+}
+
+// Replacements maps the full SHAs of the objects in the repository
+// which are replaced, by refs under the ReplaceRefBase, to the SHAs of
+// their replacements. It is empty if replacement objects are disabled.
+func (g *git) Replacements() (replaced map[string]string) {
+	replaced = make(map[string]string)
+	if conf().NoReplaceObjects {
+		return
+	}
+	output, _ := g.execute("for-each-ref",
+		"--format=%(refname)%00%(objectname)", conf().ReplaceRefBase)
+	for _, line := range strings.Split(strings.TrimRight(output, "\n"), "\n") {
+		fields := strings.SplitN(line, "\x00", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		replaced[strings.TrimPrefix(fields[0], conf().ReplaceRefBase)] = fields[1]
+	}
+	return
+}
+
+// markReplaced marks the commits which are shown as their
+// replacements, rather than as they were originally made.
+func markReplaced(g *git, logs ...*gitLog) {
+	replaced := g.Replacements()
+	if len(replaced) == 0 {
+		return
+	}
+	for _, log := range logs {
+		log.Replaced = replaced[log.SHA]
+	}
+}
@@ -0,0 +1,81 @@
+package grove
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+)
+
+const (
+	requestIDHeader = "X-Request-Id"
+	requestIDBytes  = 8 // Number of random bytes in each request ID
+)
+
+var (
+	// validRequestID matches request IDs which may be accepted from a
+	// proxy in front of Grove, rather than generating new ones.
+	validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+)
+
+// requestIDKey is the context key under which the ID of a request is
+// stored.
+type requestIDKey struct{}
+
+// requestIDHandler wraps a handler so that every request is assigned
+// an ID, which is sent in the X-Request-Id header and included in log
+// lines about the request. If the request already carries a valid
+// X-Request-Id, such as one added by a proxy, it is used instead.
+func requestIDHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			b := make([]byte, requestIDBytes)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+		w.Header().Set(requestIDHeader, id)
+		h.ServeHTTP(w, req.WithContext(
+			context.WithValue(req.Context(), requestIDKey{}, id)))
+	})
+}
+
+// requestID returns the ID assigned to the request by
+// requestIDHandler, or an empty string if there is none.
+func requestID(req *http.Request) string {
+	id, _ := req.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestLogger logs messages about a single request, prefixed by its
+// ID.
+type requestLogger struct {
+	prefix string
+}
+
+// reqLog returns a logger for messages about the given request.
+func reqLog(req *http.Request) *requestLogger {
+	if id := requestID(req); len(id) > 0 {
+		return &requestLogger{prefix: "[" + id + "] "}
+	}
+	return &requestLogger{}
+}
+
+func (r *requestLogger) Debugf(format string, v ...interface{}) {
+	l.Debugf(r.prefix+format, v...)
+}
+
+func (r *requestLogger) Infof(format string, v ...interface{}) {
+	l.Infof(r.prefix+format, v...)
+}
+
+func (r *requestLogger) Noticef(format string, v ...interface{}) {
+	l.Noticef(r.prefix+format, v...)
+}
+
+func (r *requestLogger) Errf(format string, v ...interface{}) {
+	l.Errf(r.prefix+format, v...)
+}
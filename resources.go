@@ -0,0 +1,63 @@
+package grove
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"embed"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+)
+
+var (
+	// builtinRes holds the default templates, stylesheet, scripts,
+	// and images, so that Grove works without any installed
+	// resources.
+	//go:embed res
+	builtinRes embed.FS
+)
+
+// resourceFS is a filesystem of resources in which each file is read
+// from the resources directory if it is there, and is otherwise the
+// built-in one, so that individual files can be overridden.
+type resourceFS struct {
+	dir      string // Directory of overrides, which need not exist, or empty
+	fallback fs.FS  // Built-in resources
+}
+
+// resources returns the filesystem of resources, overridden by those
+// in the directory given by the Resources setting of c, if it is set.
+func resources(c *Config) fs.FS {
+	fallback, _ := fs.Sub(builtinRes, "res")
+	return resourceFS{dir: c.Resources, fallback: fallback}
+}
+
+// Open opens the named file from the resources directory, or else from
+// the built-in resources.
+func (r resourceFS) Open(name string) (fs.File, error) {
+	if len(r.dir) > 0 {
+		if f, err := os.DirFS(r.dir).Open(name); err == nil {
+			return f, nil
+		}
+	}
+	return r.fallback.Open(name)
+}
+
+// serveResource serves the named resource, as http.ServeFile would
+// serve a file.
+func serveResource(w http.ResponseWriter, req *http.Request, name string) {
+	f, err := resources(conf()).Open(name)
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	content, ok := f.(io.ReadSeeker)
+	if err != nil || !ok || info.IsDir() {
+		http.NotFound(w, req)
+		return
+	}
+	http.ServeContent(w, req, info.Name(), info.ModTime(), content)
+}
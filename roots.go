@@ -0,0 +1,109 @@
+package grove
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+var (
+	// roots holds the served directories, in the order in which they
+	// were given. They share one URL namespace, in which each name at
+	// the top level is served from the first of them which has it.
+	// The first, handler.Dir, is also where all other paths are looked
+	// for.
+	roots []string
+
+	// realRoots holds the served directories with symlinks resolved,
+	// for use in containment checks.
+	realRoots []string
+)
+
+// rootFor returns the served directory in which the URL path u is
+// found, which is the first to contain the first segment of u, or the
+// first served directory if none do.
+func rootFor(u string) string {
+	name, _, _ := strings.Cut(strings.TrimPrefix(path.Clean("/"+u), "/"), "/")
+	if len(name) > 0 {
+		for _, root := range roots {
+			if _, err := index.Stat(path.Join(root, name)); err == nil {
+				return root
+			}
+		}
+	}
+	return handler.Dir
+}
+
+// rootOf returns the served directory which contains the filesystem
+// path p, or the first served directory if none do.
+func rootOf(p string) string {
+	var root string
+	for _, r := range roots {
+		if isWithin(r, p) && len(r) > len(root) {
+			root = r
+		}
+	}
+	if len(root) == 0 {
+		return handler.Dir
+	}
+	return root
+}
+
+// shadowed reports whether the path p is within a served directory,
+// but is not served because an earlier one has the same name at the
+// top level.
+func shadowed(p string) bool {
+	root := rootOf(p)
+	return isWithin(root, p) && rootFor(strings.TrimPrefix(p, root)) != root
+}
+
+// rootChildren lists the paths of the directories at the top level of
+// every served directory which are indexed and not shadowed, sorted by
+// name, as a single listing of the top level.
+func rootChildren() (children []string) {
+	for _, root := range roots {
+		entry, ok := index.Lookup(root)
+		if !ok {
+			continue
+		}
+		for _, n := range entry.Children {
+			if rootFor(n) == root {
+				children = append(children, path.Join(root, n))
+			}
+		}
+	}
+	sort.Slice(children, func(i, j int) bool {
+		return path.Base(children[i]) < path.Base(children[j])
+	})
+	return
+}
+
+// listDir lists the paths of everything in the directory, as read from
+// the filesystem. The top level lists that of every served directory,
+// leaving out what is shadowed, as rootChildren does.
+func listDir(directory string) (children []string, err error) {
+	dirs := []string{directory}
+	if directory == handler.Dir {
+		dirs = roots
+	}
+	for _, dir := range dirs {
+		f, err := os.Open(dir)
+		if err != nil {
+			return nil, err
+		}
+		names, err := f.Readdirnames(0)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range names {
+			if dir == directory || rootFor(n) == dir {
+				children = append(children, path.Join(dir, n))
+			}
+		}
+	}
+	return children, nil
+}
@@ -0,0 +1,108 @@
+package grove
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"net/http"
+	"strings"
+)
+
+const (
+	ArgNone = iota // The view takes nothing after its name
+	ArgName        // The rest of the path, such as a commit or a tag
+	ArgFile        // The rest of the path is a file in the repository
+	ArgDir         // The rest of the path is a directory
+)
+
+// View is a page of a repository, such as a file or a commit, which is
+// served at paths within the repository beginning with its name, as
+// in "/proj/blob/README.md". The view with an empty name is the main
+// page of the repository.
+type View struct {
+	Name string   // First segment of the path, such as "blob"
+	Arg  int      // What the rest of the path names, such as ArgFile
+	Make ViewFunc // Function which makes the page
+
+	// Volatile views may change while the commit and refs they show
+	// stay the same, and so are never answered with 304 Not Modified.
+	Volatile bool
+}
+
+// ViewFunc makes a view of a repository for a request, writing the
+// page to the connection. As with the Make*Page functions, if it
+// returns an error, an error page with the status is shown instead.
+type ViewFunc func(v *ViewRequest) (err error, status int)
+
+// ViewRequest holds what a ViewFunc needs to make its page.
+type ViewRequest struct {
+	w          http.ResponseWriter
+	req        *http.Request
+	pageinfo   *gitPage
+	g          *git
+	repository string // Filesystem path of the repository
+	ref        string // Commit, or range of commits, being viewed
+	arg        string // Argument parsed from the path, as by Route
+	maxCommits int    // Number of commits to show in logs
+}
+
+// Route is a path within a repository, parsed into the view which
+// serves it and the view's argument.
+type Route struct {
+	View *View
+	Arg  string // File, directory, or name given after the view's name
+}
+
+// Router dispatches paths within repositories to views by the first
+// segment of the path, so that repositories, directories, and files
+// with the same names as views, such as "tree", are never mistaken for
+// them.
+type Router struct {
+	views map[string]*View
+}
+
+var (
+	// repoRouter holds the views which may be shown of every
+	// repository.
+	repoRouter = NewRouter()
+)
+
+// NewRouter returns a Router with no views.
+func NewRouter() *Router {
+	return &Router{views: make(map[string]*View)}
+}
+
+// Register adds a view to the router. It panics if there is already
+// one with the same name, as http.ServeMux does.
+func (r *Router) Register(v *View) {
+	if _, ok := r.views[v.Name]; ok {
+		panic("router: view " + v.Name + " registered twice")
+	}
+	r.views[v.Name] = v
+}
+
+// Route parses p, a path within a repository, such as "blob/README.md"
+// or "" for the repository itself. Trailing slashes are removed from
+// arguments, except that directories are given with one, and the top
+// of the repository is "./". It is not ok if no view has the name of
+// the first segment, or if p continues past a view which takes no
+// argument.
+func (r *Router) Route(p string) (route Route, ok bool) {
+	name, rest, _ := strings.Cut(strings.TrimPrefix(p, "/"), "/")
+	v := r.views[name]
+	if v == nil {
+		return Route{}, false
+	}
+	rest = strings.TrimRight(rest, "/")
+	switch v.Arg {
+	case ArgNone:
+		if len(rest) > 0 {
+			return Route{}, false
+		}
+	case ArgDir:
+		if len(rest) == 0 {
+			rest = "."
+		}
+		rest += "/"
+	}
+	return Route{View: v, Arg: rest}, true
+}
@@ -1,35 +1,60 @@
-package main
+package grove
 
 // Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
 
 import (
 	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"html/template"
 	"io"
+	stdlog "log"
+	"net"
 	"net/http"
-	"net/http/cgi"
+	"net/url"
 	"os"
+	"os/signal"
 	"path"
+	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// defaultShutdownTimeout is the number of seconds for which
+	// requests in progress are waited for when Grove is stopped, unless
+	// ShutdownTimeout is set.
+	defaultShutdownTimeout = 30
 )
 
 var (
 	Perms = uint(0)
-	// Used to specify which files can be served:
+	// Default level used to specify which files can be served, which
+	// can be overridden with the Perms setting or the --perms flag:
 	// 0: readable globally
 	// 1: readable by group
-	// 2: readable
+	// 2: readable by owner
 
 	prefix       string // Path to prepend to links
 	prefixLength int    // Number of characters to strip from requests
 
-	handler *cgi.Handler       // git-http-backend CGI handler
-	t       *template.Template // Template containing all webui templates
+	handler *gitHTTP // Handler for git clients
 
 	templateFiles = []string{ // Basenames of the HTML templates
 		"dir.html", "file.html",
 		"gitpage.html", "tree.html",
 		"error.html", "about.html",
+		"author.html", "shortlog.html",
+		"tag.html", "branches.html",
+		"commit.html", "activity.html",
+		"submodules.html", "reflog.html",
+		"blame.html", "branding.html",
 	}
 )
 
@@ -40,80 +65,314 @@ type gzipResponseWriter struct {
 }
 
 // Serve creates an HTTP server using net/http and initializes it
-// appropriately. If the fWeb flagg is true, it will serve directory
-// trees and git repositories to incoming requests.
-func Serve(repodir string) {
-	handler = &cgi.Handler{
-		Path: gitVarExecPath() + "/" + gitHttpBackend,
-		Root: "/",
-		Dir:  repodir,
-		Env: []string{"GIT_PROJECT_ROOT=" + repodir,
-			"GIT_HTTP_EXPORT_ALL=TRUE"},
-		Logger: &l.Logger,
-	}
-
-	// Set up the stripProxy variable, but only if *fHost contains a
-	// path to strip, such as "example.com/grove"
-	if hostLength := strings.Index(*fHost, "/"); hostLength > 0 {
-		prefixLength = len(*fHost) - hostLength
-		prefix = (*fHost)[hostLength:]
-	}
-
-	var err error
-	t, err = getTemplate()
+// appropriately. If the Web setting is true, it will serve directory
+// trees and git repositories to incoming requests. The repositories
+// in every one of repodirs are served together, as NewHandler
+// describes. It listens on the addresses in the Binds setting, and
+// serves until it is interrupted. On SIGHUP, the configuration is
+// replaced with that returned by load, if it is not nil.
+func Serve(c *Config, load func() (*Config, error), repodirs ...string) {
+	defaultLogger()
+	if c == nil {
+		c = DefaultConfig()
+	}
+	if err := c.normalize(); err != nil {
+		l.Fatalf("Error in configuration: %s\n", err)
+	}
+	current.Store(&state{conf: c})
+
+	// Make sure that git can be run, since nothing can be served
+	// without it.
+	version, err := gitVersion(c.GitBin)
 	if err != nil {
-		l.Emerg("HTML templates failed to load; exiting\n")
+		l.Fatalf("Error running git executable %q: %s; set it with --git-bin\n",
+			c.GitBin, err)
+	}
+	l.Debugf("Using %s from %q\n", version, c.GitBin)
+
+	// Check the addresses to listen on now, so that mistakes are
+	// reported before the served directory is indexed.
+	for _, bind := range c.Binds {
+		if _, _, err := listenAddr(bind); err != nil {
+			l.Fatalf("Error in --bind: %s\n", err)
+		}
+	}
+
+	shutdownTracing, err := startTracing()
+	if err != nil {
+		l.Emergf("Could not start tracing: %s\n", err)
 		return
-	} else {
-		l.Debug("Templates loaded successfully\n")
 	}
+	defer shutdownTracing(context.Background())
 
-	l.Infof("Starting server on %s:%s\n", *fBind, *fPort)
-	l.Infof("Serving %q\n", repodir)
-	l.Infof("Web access: %t\n", *fWeb)
-	
-	// Regardless if fWeb is true or not, host the CSS
-	http.HandleFunc(prefix+"/res/style.css", gzipHandler(HandleCSS))
-	
-	if *fWeb {
-		http.HandleFunc(prefix+"/res/highlight.js", gzipHandler(HandleJS))
-		http.HandleFunc(prefix+"/favicon.ico", gzipHandler(HandleIcon))
-		http.HandleFunc("/", gzipHandler(HandleWeb))
-	} else {
-		http.HandleFunc("/", gzipHandler(HandleAbout))
+	h, err := NewHandler(c, repodirs...)
+	if err != nil {
+		l.Emergf("Could not serve %q: %s\n", repodirs, err)
+		return
+	}
+	l.Debug("Templates loaded successfully\n")
+
+	if conf().WarmJobs > 0 {
+		go warmCaches(conf().WarmJobs)
+	}
+
+	for _, repodir := range repodirs {
+		l.Infof("Serving %q\n", repodir)
+	}
+	l.Infof("Web access: %t\n", conf().Web)
+	if conf().Dev {
+		l.Noticef("Development mode: templates are re-read on every request\n")
 	}
 
-	err = http.ListenAndServe(*fBind+":"+*fPort, nil)
+	tlsConf, err := tlsConfig(conf())
+	if err != nil {
+		l.Emergf("Could not configure TLS: %s\n", err)
+		return
+	}
+	listeners, err := listen(conf().Binds)
 	if err != nil {
+		l.Emergf("Could not listen: %s\n", err)
+		return
+	}
+	if tlsConf != nil {
+		for i, ln := range listeners {
+			listeners[i] = tls.NewListener(ln, tlsConf)
+		}
+		l.Infof("Serving HTTPS\n")
+		if len(conf().ClientAuth) > 0 {
+			l.Infof("Client certificates required for: %s\n", conf().ClientAuth)
+		}
+		// Let's Encrypt needs plain HTTP to answer its challenges.
+		redirect := conf().RedirectHTTP
+		if len(redirect) == 0 && certManager != nil {
+			redirect = defaultACMERedirect
+		}
+		if len(redirect) > 0 {
+			if err := serveRedirect(redirect); err != nil {
+				l.Emergf("Could not listen for HTTP redirects: %s\n", err)
+				closeAll(listeners)
+				return
+			}
+		}
+	}
+
+	// The onion service is served over plain HTTP, as Tor encrypts
+	// connections to it.
+	if len(conf().Tor.Control) > 0 {
+		ln, addr, err := listenOnion(conf().Tor)
+		if err != nil {
+			l.Emergf("Could not publish onion service: %s\n", err)
+			closeAll(listeners)
+			return
+		}
+		l.Infof("Serving onion service at http://%s/\n", addr)
+		onionAddr = addr
+		if len(conf().AllowedHosts) > 0 {
+			conf().AllowedHosts = append(conf().AllowedHosts, addr)
+		}
+		listeners = append(listeners, ln)
+	}
+	if load != nil {
+		go reloadOnHangup(load)
+	}
+
+	// Serve every listener from the same server, and stop if any of
+	// them fails, or if Grove is asked to.
+	server := &http.Server{
+		Handler: h,
+	}
+	if conf().H2C {
+		// HTTP/2 without TLS is accepted from clients which know to
+		// speak it, such as reverse proxies, so that they can
+		// multiplex requests over a single connection.
+		h2s := &http2.Server{}
+		if err := http2.ConfigureServer(server, h2s); err != nil {
+			l.Emergf("Could not configure HTTP/2: %s\n", err)
+			closeAll(listeners)
+			return
+		}
+		server.Handler = h2c.NewHandler(h, h2s)
+		l.Infof("Accepting HTTP/2 without TLS\n")
+	}
+	errs := make(chan error, len(listeners))
+	for _, ln := range listeners {
+		go func(ln net.Listener) {
+			errs <- server.Serve(ln)
+		}(ln)
+	}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-errs:
 		l.Fatalf("Server crashed: %s", err)
+	case sig := <-stop:
+		shutdown(server, sig)
 	}
-	return
 }
 
-// HandleJS uses http.ServeFile() to serve `highlight.js` directly
-// from the file system.
-func HandleJS(w http.ResponseWriter, req *http.Request) {
-	http.ServeFile(w, req, path.Join(*fRes, "highlight.js"))
+// shutdown stops the server from accepting connections, and waits for
+// the requests in progress, such as clones and pushes, to finish, for
+// up to ShutdownTimeout seconds. Those which take longer are cut off.
+// A second signal stops waiting.
+func shutdown(server *http.Server, sig os.Signal) {
+	timeout := time.Duration(conf().ShutdownTimeout) * time.Second
+	l.Noticef("Received %s; waiting up to %s for requests to finish\n",
+		sig, timeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	go func() {
+		again := make(chan os.Signal, 1)
+		signal.Notify(again, os.Interrupt, syscall.SIGTERM)
+		<-again
+		cancel()
+	}()
+	if err := server.Shutdown(ctx); err != nil {
+		l.Errf("Requests still in progress were cut off: %s\n", err)
+		server.Close()
+		return
+	}
+	l.Infof("Stopped\n")
 }
 
-// HandleCSS uses http.ServeFile() to serve `style.css` directly from
-// the file system.
-func HandleCSS(w http.ResponseWriter, req *http.Request) {
-	http.ServeFile(w, req, path.Join(*fRes, "style.css"))
+// NewHandler prepares Grove to serve the repositories in repodirs with
+// the given configuration, and returns the handler for every request,
+// which may be served by an http.Server or an httptest.Server. If c is
+// nil, the defaults are used. Settings which are not set are filled in
+// as LoadConfig would, and invalid ones are reported. Grove's state is
+// global, so only the most recently made handler may be used, as the
+// package documentation describes.
+//
+// The directories are served under the same URLs, and listed together
+// on the index page. Where more than one has the same name at the top
+// level, the first given is served.
+func NewHandler(c *Config, repodirs ...string) (h http.Handler, err error) {
+	if len(repodirs) == 0 {
+		return nil, errors.New("no directory to serve")
+	}
+	defaultLogger()
+	if c == nil {
+		c = DefaultConfig()
+	}
+	if err = c.normalize(); err != nil {
+		return nil, err
+	}
+
+	// The served directories themselves may be symlinks, so resolve
+	// them once here for use in containment checks.
+	roots, realRoots = nil, nil
+	for _, repodir := range repodirs {
+		realRoot, err := filepath.EvalSymlinks(repodir)
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, path.Clean(repodir))
+		realRoots = append(realRoots, realRoot)
+	}
+
+	tmpl, err := getTemplate(c)
+	if err != nil {
+		return nil, err
+	}
+	current.Store(newState(c, tmpl, nil))
+
+	handler = newGitHandler(roots[0])
+
+	// Index the repositories in the served directory, so that
+	// requests need not walk the filesystem to find them. If the
+	// index can't be built, the filesystem is used directly. The
+	// index of any handler made before is closed first, so that its
+	// watcher does not go on running.
+	var indexErr error
+	index.Close()
+	index, indexErr = newRepoIndex(roots...)
+	if indexErr != nil {
+		l.Errf("Could not index %q: %s\n", roots, indexErr)
+	}
+
+	// Set up the prefix, which is stripped from requests and added to
+	// links, if Grove is reached under a path, such as "/grove".
+	prefix = basePath(c)
+	prefixLength = len(prefix)
+
+	// Grove uses its own ServeMux, so that handlers which packages
+	// register on the default one, such as net/http/pprof, are only
+	// served if asked for.
+	mux := http.NewServeMux()
+	if conf().DebugHandlers {
+		registerDebug(mux)
+	}
+
+	// Regardless if fWeb is true or not, host the CSS
+	mux.HandleFunc(prefix+"/res/style.css", gzipHandler(HandleCSS))
+
+	if conf().Web {
+		mux.HandleFunc(prefix+"/res/highlight.js", gzipHandler(HandleJS))
+		mux.HandleFunc(prefix+"/favicon.ico", gzipHandler(HandleIcon))
+		mux.HandleFunc(prefix+"/res/logo.png", HandleLogo)
+		mux.HandleFunc(prefix+"/s/", HandleShort)
+		mux.HandleFunc(prefix+"/api/github/", gzipHandler(HandleGitHub))
+		mux.HandleFunc(prefix+"/api/v1/", gzipHandler(HandleAPIv1))
+		mux.HandleFunc(prefix+"/activity", gzipHandler(HandleActivityPage))
+		mux.HandleFunc(prefix+"/feed.atom", gzipHandler(HandleFeed))
+		mux.HandleFunc(prefix+"/manifest.json", gzipHandler(HandleManifest))
+		mux.HandleFunc(prefix+"/manifest.xml", gzipHandler(HandleManifest))
+		if conf().Avatars == AvatarsLocal {
+			mux.HandleFunc(prefix+"/avatar/", HandleAvatar)
+		}
+		mux.HandleFunc("/", gzipHandler(HandleWeb))
+	} else {
+		mux.HandleFunc("/", gzipHandler(HandleAbout))
+	}
+
+	return requestIDHandler(limitHandler(hostHandler(securityHandler(
+		clientCertHandler(realmHandler(devHandler(mux))))))), nil
 }
 
-// HandleIcon uses http.ServeFile() to serve the favicon directly from
-// the filesystem.
-func HandleIcon(w http.ResponseWriter, req *http.Request) {
-	http.ServeFile(w, req, path.Join(*fRes, "favicon.png"))
+// basePath returns the path under which Grove is reached with c, such
+// as "/grove", without a trailing slash. It is taken from ExternalURL,
+// or else from the Host setting, such as "example.com/grove", and is empty if
+// Grove is reached at the top level.
+func basePath(c *Config) string {
+	if len(c.ExternalURL) > 0 {
+		if u, err := url.Parse(c.ExternalURL); err == nil {
+			return strings.TrimRight(u.Path, "/")
+		}
+	}
+	if hostLength := strings.Index(c.Host, "/"); hostLength > 0 {
+		return strings.TrimRight(c.Host[hostLength:], "/")
+	}
+	return ""
+}
+
+// devHandler wraps a handler so that, with --dev, responses are marked
+// as not to be cached, so that changes to templates and stylesheets are
+// seen on reload. Handlers may still set their own Cache-Control.
+func devHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if conf().Dev {
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// HandleJS serves `highlight.js` from the resources.
+func HandleJS(w http.ResponseWriter, req *http.Request) {
+	serveResource(w, req, "highlight.js")
+}
+
+// HandleCSS serves `style.css` from the resources.
+func HandleCSS(w http.ResponseWriter, req *http.Request) {
+	serveResource(w, req, "style.css")
 }
 
 // HandleAbout makes an about page to be served regardless of the path
 // that the user is trying to look at. This func is only to be used as
-// a handler when *fWeb is true.
+// a handler when the Web setting is false.
 func HandleAbout(w http.ResponseWriter, req *http.Request) {
-	l.Noticef("Web access denied to %q\n", req.RemoteAddr)
-	MakeAboutPage(w)
+	reqLog(req).Noticef("Web access denied to %q\n", req.RemoteAddr)
+	MakeAboutPage(w, req)
 }
 
 // HandleWeb handles general requests, such as for the web interface
@@ -131,42 +390,175 @@ func HandleWeb(w http.ResponseWriter, req *http.Request) {
 	} else {
 		req.URL.Path = req.URL.Path[prefixLength:]
 	}
-	p := path.Join(handler.Dir, req.URL.Path)
+
+	req, span := traceRequest(req, "HandleWeb")
+	defer span.End()
+
+	// If the repository has been renamed, redirect to its new
+	// location. The trailing slash is kept, because git clients
+	// depend on it.
+	if renamed, ok := conf().Rename(req.URL.Path); ok {
+		if strings.HasSuffix(req.URL.Path, "/") {
+			renamed += "/"
+		}
+		if len(req.URL.RawQuery) > 0 {
+			renamed += "?" + req.URL.RawQuery
+		}
+		reqLog(req).Debugf("Redirecting %q from %q to %q\n",
+			req.URL.Path, req.RemoteAddr, renamed)
+		http.Redirect(w, req, prefix+renamed, http.StatusMovedPermanently)
+		return
+	}
+
+	// If compatibility with cgit or gitweb URLs is enabled, redirect
+	// them to their equivalents.
+	if conf().CgitCompat {
+		if target, ok := cgitRedirect(req.URL.Path, req.URL.Query()); ok {
+			reqLog(req).Debugf("Redirecting cgit URL %q from %q to %q\n",
+				req.URL, req.RemoteAddr, target)
+			http.Redirect(w, req, prefix+target, http.StatusMovedPermanently)
+			return
+		}
+	}
+	if conf().GitwebCompat {
+		if target, ok := gitwebRedirect(req.URL.RawQuery); ok {
+			reqLog(req).Debugf("Redirecting gitweb URL %q from %q to %q\n",
+				req.URL, req.RemoteAddr, target)
+			http.Redirect(w, req, prefix+target, http.StatusMovedPermanently)
+			return
+		}
+	}
+
+	// If the URL begins with an alias, then the repository it maps to
+	// is served as though it were in its parent directory, under its
+	// own name. Links are still built from the original URL.
+	toplevel, gitHandler := rootFor(req.URL.Path), handler
+	if toplevel != handler.Dir {
+		gitHandler = newGitHandler(toplevel)
+	}
+	urlPath := req.URL.Path
+	if alias, target, ok := conf().Alias(req.URL.Path); ok {
+		toplevel = path.Dir(target)
+		urlPath = "/" + path.Base(target) +
+			strings.TrimPrefix(req.URL.Path, alias)
+		gitHandler = newGitHandler(toplevel)
+	}
+	p := path.Join(toplevel, urlPath)
 
 	// Send the request to the git http backend if it is to a .git
 	// URL.
-	if strings.Contains(req.URL.String(), ".git/") {
-		gitPath := strings.SplitAfter(p, ".git/")[0]
-		l.Debugf("Git request to %q from %q\n",
+	if gitURL, _, ok := splitGitURL(urlPath); ok {
+		gitPath := path.Join(toplevel, gitURL)
+		reqLog(req).Debugf("Git request to %q from %q\n",
 			req.URL, req.RemoteAddr)
 
 		// Check to make sure that the repository is globally
 		// readable.
 		fi, err := os.Stat(gitPath)
 		if err != nil {
-			l.Errf("Git request of %q from %q produced error: %s\n",
+			reqLog(req).Errf("Git request of %q from %q produced error: %s\n",
 				req.URL.Path, req.RemoteAddr, err)
 			http.NotFound(w, req)
 			return
 		}
-		if !CheckPermBits(fi) {
-			l.Noticef("Git request to %q from %q denied\n",
+		// The repository itself must also be servable at the
+		// configured level, exactly as it would be for the web
+		// view.
+		if path.Base(path.Clean(gitPath)) == ".git" {
+			rfi, err := os.Stat(path.Dir(path.Clean(gitPath)))
+			if err == nil && !CheckPermBits(rfi) {
+				fi = rfi
+			}
+		}
+		if !conf().Visible(relPath(gitPath)) || !CheckContained(gitPath) ||
+			!CheckPolicy(gitPath, fi) {
+			reqLog(req).Noticef("Git request to %q from %q denied\n",
 				req.URL.Path, req.RemoteAddr)
 			http.Error(w, http.StatusText(http.StatusForbidden),
 				http.StatusForbidden)
 			return
 		}
 
-		handler.ServeHTTP(w, req)
+		// Copy the handler so that any errors it logs are marked with
+		// the ID of the request.
+		h := *gitHandler
+		if id := requestID(req); len(id) > 0 {
+			h.Logger = stdlog.New(l.Logger.Writer(),
+				l.Logger.Prefix()+"["+id+"] ", l.Logger.Flags())
+		}
+		req.URL.Path = urlPath
+		ctx, gitSpan := tracer.Start(req.Context(), "git-http",
+			trace.WithAttributes(attribute.String("git.dir", h.Dir)))
+		h.ServeHTTP(throttle(w), req.WithContext(ctx))
+		gitSpan.End()
 		return
 	}
 
 	// Figure out which directory is being requested, and check
 	// whether we're allowed to serve it.
-	repository, file, isFile, status := SplitRepository(handler.Dir, p)
+	repository, route, status := RouteRepository(toplevel, p)
 	if status == http.StatusOK {
-		MakePage(w, req, repository, file, isFile)
+		MakePage(w, req, repository, route)
+	} else {
+		Error(w, status)
+	}
+}
+
+// locate finds the filesystem path corresponding to the URL path u,
+// and the directory above which SplitRepository should not search,
+// taking aliases and the served directories into account.
+func locate(u string) (toplevel, p string) {
+	if alias, target, ok := conf().Alias(u); ok {
+		return path.Dir(target), path.Join(target, strings.TrimPrefix(u, alias))
 	}
+	toplevel = rootFor(u)
+	return toplevel, path.Join(toplevel, u)
+}
+
+// HandleShort redirects short URLs of the form /s/<repo>/<abbrev>,
+// where abbrev is an abbreviated SHA of a commit or blob, to the
+// canonical URL of that object.
+func HandleShort(w http.ResponseWriter, req *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(req.URL.Path, prefix+"/s/"), "/")
+	idx := strings.LastIndex(rest, "/")
+	if idx < 0 {
+		Error(w, http.StatusNotFound)
+		return
+	}
+	repoURL, abbrev := "/"+rest[:idx], rest[idx+1:]
+
+	// Locate the repository as HandleWeb would, and make sure that it
+	// may be served.
+	toplevel, p := locate(repoURL)
+	repository, file, _, status := SplitRepository(toplevel, p)
+	if status != http.StatusOK {
+		Error(w, status)
+		return
+	}
+	if git, _ := isGit(repository); !git || len(file) != 0 {
+		Error(w, http.StatusNotFound)
+		return
+	}
+
+	g := &git{Path: repository, ctx: req.Context()}
+	var target string
+	switch sha, objType := g.ResolveObject(abbrev); objType {
+	case "commit":
+		target = repoURL + "/commit/" + sha
+	case "blob":
+		if commit, file := g.FindBlob(sha); len(commit) > 0 {
+			target = repoURL + "/blob/" + escapePath(file) + "?ref=" + commit
+		}
+	}
+	if len(target) == 0 {
+		reqLog(req).Debugf("Short URL %q from %q not found\n",
+			req.URL.Path, req.RemoteAddr)
+		Error(w, http.StatusNotFound)
+		return
+	}
+	reqLog(req).Debugf("Short URL %q from %q redirected to %q\n",
+		req.URL.Path, req.RemoteAddr, target)
+	http.Redirect(w, req, prefix+target, http.StatusMovedPermanently)
 }
 
 // If the client accepts gzipped responses, that's what we'll send,
@@ -200,9 +592,24 @@ func (w gzipResponseWriter) Write(b []byte) (int, error) {
 // and listable, by default), or a .git directory could not be found,
 // or the path is invalid, this function will return an appropriate
 // exit code.  This function will only recurse upward until it reaches
-// the path indicated by toplevel.
+// the path indicated by toplevel. The file is the argument of the view
+// which the rest of the path selects, as parsed by repoRouter, and
+// isFile is whether that is a file.
 func SplitRepository(toplevel, p string) (repository, file string, isFile bool, status int) {
+	repository, route, status := RouteRepository(toplevel, p)
+	if route.View != nil {
+		file, isFile = route.Arg, route.View.Arg == ArgFile
+	}
+	return
+}
+
+// RouteRepository finds the repository in the path p as
+// SplitRepository does, and parses the rest of the path into a Route
+// with repoRouter. Paths which name no repository are routed to the
+// main page, with an empty argument, and are shown as directories.
+func RouteRepository(toplevel, p string) (repository string, route Route, status int) {
 	path.Clean(toplevel)
+	var file string
 	// Set the repository to the path for the moment, to simplify the
 	// loop
 	repository = p
@@ -219,14 +626,13 @@ func SplitRepository(toplevel, p string) (repository, file string, isFile bool,
 		// Check if we shouldn't continue.
 		if repository == toplevel {
 			repository = path.Join(repository, file)
-			file = ""
+			route, _ = repoRouter.Route("")
 			status = http.StatusOK
 			return
 		}
 
 		// Check if the path has a .git folder.
-		_, err := os.Stat(repository + "/.git")
-		if err != nil {
+		if git, _ := isGit(repository); !git {
 			// If not, traverse up and start again.
 			i++
 			continue
@@ -234,7 +640,7 @@ func SplitRepository(toplevel, p string) (repository, file string, isFile bool,
 
 		// If the .git directory was discovered, then we now have to
 		// check if we are allowed to serve the parent directory.
-		fi, err := os.Stat(repository)
+		fi, err := index.Stat(repository)
 		if err != nil {
 			// An error at this point would imply that the server is
 			// in error.
@@ -243,38 +649,18 @@ func SplitRepository(toplevel, p string) (repository, file string, isFile bool,
 		}
 
 		// If all is well, check if it's servable.
-		if !CheckPerms(fi) {
+		if !CheckPerms(repository, fi) {
 			// If not, 403 Forbidden.
 			status = http.StatusForbidden
 			return
 		}
 
-		// If the file is prefixed with /blob/, then treat it as a
-		// file. If it has /tree/, then treat it as a directory. In
-		// either case, chop off the prefix.  If it has neither, 404.
-		if len(file) != 0 {
-			// The trailing slash trickery involves avoiding runtime
-			// errors and splitting the strings sanely.
-			file += "/"
-			if strings.HasPrefix(file, "blob/") {
-				file = strings.SplitAfterN(file, "/", 2)[1]
-				isFile = true
-				file = strings.TrimRight(file, "/")
-			} else if strings.HasPrefix(file, "tree/") {
-				// Remove the /tree/, but be sure that, if the file is
-				// blank, to make it "/" instead.
-				file = strings.SplitAfterN(file, "/", 2)[1]
-				if len(file) == 0 {
-					file = "./"
-				}
-			} else if strings.HasPrefix(file, "raw/") {
-				file = strings.SplitAfterN(file, "/", 2)[1]
-				isFile = true
-				file = strings.TrimRight(file, "/")
-			} else {
-				status = http.StatusNotFound
-				return
-			}
+		// The rest of the path selects the view of the repository,
+		// which must be one that the router knows.
+		var ok bool
+		if route, ok = repoRouter.Route(file); !ok {
+			status = http.StatusNotFound
+			return
 		}
 		status = http.StatusOK
 		return
@@ -284,13 +670,95 @@ func SplitRepository(toplevel, p string) (repository, file string, isFile bool,
 	return
 }
 
-func CheckPerms(info os.FileInfo) (canServe bool) {
-	if strings.HasPrefix(info.Name(), ".") {
+// CheckPerms checks whether the file or directory at the path p may
+// be served. Hidden files are not served unless they are listed in
+// the Hidden setting. Otherwise, the decision is left to CheckPolicy.
+func CheckPerms(p string, info os.FileInfo) (canServe bool) {
+	if strings.HasPrefix(info.Name(), ".") && !conf().Visible(relPath(p)) {
+		return false
+	}
+	if !CheckContained(p) {
+		return false
+	}
+	return CheckPolicy(p, info)
+}
+
+// CheckContained checks that the path p, once all symlinks are
+// resolved, does not escape the served directories. If FollowSymlinks is
+// set, p may instead resolve to a location within a repository that
+// a symlink points to, so repositories elsewhere on disk can be linked
+// into the served directory without exposing arbitrary locations.
+func CheckContained(p string) bool {
+	real, err := filepath.EvalSymlinks(p)
+	if err != nil {
 		return false
 	}
+	for _, realRoot := range realRoots {
+		if isWithin(realRoot, real) {
+			return true
+		}
+	}
+	// Aliased repositories are explicitly configured, and so may be
+	// anywhere.
+	if _, target, ok := conf().Unalias(p); ok {
+		realTarget, err := filepath.EvalSymlinks(target)
+		return err == nil && isWithin(realTarget, real)
+	}
+	if !conf().FollowSymlinks {
+		return false
+	}
+
+	// Find the nearest repository containing p, without following
+	// symlinks in the search, and require that p resolve to a location
+	// inside of wherever that repository resolves to.
+	root := rootOf(p)
+	for dir := path.Clean(p); isWithin(root, dir); dir = path.Dir(dir) {
+		if len(gitDirOf(dir)) == 0 {
+			continue
+		}
+		realRepo, err := filepath.EvalSymlinks(dir)
+		return err == nil && isWithin(realRepo, real)
+	}
+	return false
+}
+
+// isWithin reports whether the path p is dir or is inside of it.
+func isWithin(dir, p string) bool {
+	return p == dir || strings.HasPrefix(p, strings.TrimRight(dir, "/")+"/")
+}
+
+// CheckPolicy applies the configured serving policy to the file or
+// directory at the path p. With PolicyList, p is checked against the
+// Allow and Deny lists in the configuration, and the permission bits
+// are ignored. Otherwise, CheckPermBits is used.
+func CheckPolicy(p string, info os.FileInfo) (canServe bool) {
+	if conf().Policy == PolicyList {
+		return conf().Listed(relPath(p))
+	}
 	return CheckPermBits(info)
 }
 
+// relPath strips the served directory containing the path p from it,
+// as well as the .git directory if the path is within one, so that it
+// can be matched against patterns naming repositories. Paths within aliased
+// repositories are given relative to their alias. Paths outside of
+// every served directory, such as "/srv/git2" when "/srv/git" is
+// served, are left whole.
+func relPath(p string) (rel string) {
+	p = path.Clean(p)
+	if alias, target, ok := conf().Unalias(p); ok {
+		rel = alias + strings.TrimPrefix(p, target)
+	} else if root := rootOf(p); isWithin(root, p) {
+		rel = strings.TrimPrefix(p, root)
+	} else {
+		rel = p
+	}
+	return strings.TrimSuffix(rel, "/.git")
+}
+
+// CheckPermBits checks whether the permission bits of the file or
+// directory allow it to be served at the level given by the Perms
+// setting.
 func CheckPermBits(info os.FileInfo) (canServe bool) {
 	permBits := 0004
 	if info.IsDir() {
@@ -306,18 +774,18 @@ func CheckPermBits(info os.FileInfo) (canServe bool) {
 	//    TRUE
 	// 
 	// Thus, the file is readable and listable by the group, and
-	// therefore okay to serve.
-	return (info.Mode().Perm()&os.FileMode((permBits<<(Perms*3))) > 0)
+	// therefore okay to serve when conf.Perms is 1.
+	return (info.Mode().Perm()&os.FileMode((permBits<<(conf().Perms*3))) > 0)
 }
 
-// getTemplate uses the global variables templateFiles and *fRes to
-// load the templates and return the given object.
-func getTemplate() (t *template.Template, err error) {
+// getTemplate uses the global variable templateFiles to load the
+// templates from the resources of c and return the given object.
+func getTemplate(c *Config) (t *template.Template, err error) {
 	// First, ensure that the paths are correct.
 	files := make([]string, len(templateFiles))
 	for i, f := range templateFiles {
-		files[i] = path.Join(*fRes, "templates", f)
+		files[i] = path.Join("templates", f)
 	}
 	// Now, return the results.
-	return template.New("master").ParseFiles(files...)
+	return template.New("master").Funcs(templateFuncs).ParseFS(resources(c), files...)
 }
@@ -0,0 +1,276 @@
+package grove
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	stdlog "log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	uploadPack  = "git-upload-pack"
+	receivePack = "git-receive-pack"
+)
+
+var (
+	// dumbFiles matches the files within a repository which are served
+	// to clients using the dumb HTTP protocol, and maps them to their
+	// Content-Types, as git-http-backend does. Objects never change
+	// once written, so they may be cached indefinitely, but the rest
+	// change with every push.
+	dumbFiles = []struct {
+		pattern     *regexp.Regexp
+		contentType string
+		immutable   bool
+	}{
+		{regexp.MustCompile(`^(HEAD|info/refs|objects/info/(alternates|http-alternates))$`),
+			"text/plain", false},
+		{regexp.MustCompile(`^objects/info/packs$`),
+			"text/plain; charset=utf-8", false},
+		{regexp.MustCompile(`^objects/[0-9a-f]{2}/[0-9a-f]{38,62}$`),
+			"application/x-git-loose-object", true},
+		{regexp.MustCompile(`^objects/pack/pack-[0-9a-f]{40,64}\.pack$`),
+			"application/x-git-packed-objects", true},
+		{regexp.MustCompile(`^objects/pack/pack-[0-9a-f]{40,64}\.idx$`),
+			"application/x-git-packed-objects-toc", true},
+	}
+
+	// validGitProtocol matches values of the Git-Protocol header which
+	// may be passed on to git.
+	validGitProtocol = regexp.MustCompile(`^[A-Za-z0-9=:.,_-]+$`)
+)
+
+// gitHTTP serves the repositories within Dir to git clients. The smart
+// protocol is served by running git upload-pack and receive-pack
+// directly, and the dumb protocol by serving files from the
+// repository.
+type gitHTTP struct {
+	Dir    string         // Directory containing the repositories
+	Logger *stdlog.Logger // Logger for errors from git
+}
+
+// newGitHandler creates a gitHTTP which serves repositories within the
+// given directory.
+func newGitHandler(dir string) *gitHTTP {
+	return &gitHTTP{
+		Dir:    dir,
+		Logger: &l.Logger,
+	}
+}
+
+// ServeHTTP serves requests to paths within a repository's .git
+// directory, or within a bare repository whose name ends in .git.
+func (h *gitHTTP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	gitURL, file, ok := splitGitURL(req.URL.Path)
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	gitDir := path.Join(h.Dir, gitURL)
+	g := &git{Path: gitDir, ctx: req.Context()}
+
+	service := req.URL.Query().Get("service")
+	switch {
+	case file == "info/refs" && len(service) > 0:
+		h.advertise(w, req, g, service)
+	case file == uploadPack || file == receivePack:
+		h.rpc(w, req, g, file)
+	case req.Method == "GET" || req.Method == "HEAD":
+		// The dumb protocol serves every object, so it can't keep
+		// hidden refs from being fetched.
+		if len(conf().RepoFetchRefs(relPath(gitDir))) > 0 {
+			http.Error(w, http.StatusText(http.StatusForbidden),
+				http.StatusForbidden)
+			return
+		}
+		if file == "info/refs" || file == "objects/info/packs" {
+			// Dumb clients rely on these files to find refs and
+			// packs, so bring them up to date with any changes made
+			// outside of Grove first.
+			g.UpdateServerInfo()
+		}
+		h.serveFile(w, req, gitDir, file)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed),
+			http.StatusMethodNotAllowed)
+	}
+}
+
+// advertise sends the refs of the repository to a client which is
+// about to fetch or push with the smart protocol.
+func (h *gitHTTP) advertise(w http.ResponseWriter, req *http.Request, g *git, service string) {
+	if !h.enabled(g, service) {
+		http.Error(w, http.StatusText(http.StatusForbidden),
+			http.StatusForbidden)
+		return
+	}
+
+	var out bytes.Buffer
+	if err := h.run(req, g, nil, &out, service, "--advertise-refs"); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-"+service+"-advertisement")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Clients speaking version 2 of the protocol do not expect the
+	// service to be announced.
+	if !strings.Contains(req.Header.Get("Git-Protocol"), "version=2") {
+		io.WriteString(w, pktLine("# service="+service+"\n")+"0000")
+	}
+	out.WriteTo(w)
+}
+
+// rpc runs the service with the client's request as its input, and
+// sends its output as the response.
+func (h *gitHTTP) rpc(w http.ResponseWriter, req *http.Request, g *git, service string) {
+	if req.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed),
+			http.StatusMethodNotAllowed)
+		return
+	}
+	if req.Header.Get("Content-Type") != "application/x-"+service+"-request" {
+		http.Error(w, http.StatusText(http.StatusUnsupportedMediaType),
+			http.StatusUnsupportedMediaType)
+		return
+	}
+	if !h.enabled(g, service) {
+		http.Error(w, http.StatusText(http.StatusForbidden),
+			http.StatusForbidden)
+		return
+	}
+
+	body := io.Reader(req.Body)
+	if req.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(req.Body)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest),
+				http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	// Note the refs before a push, so that notifications can be sent
+	// about those which it changes.
+	var before map[string]string
+	if service == receivePack {
+		before = g.RefSHAs()
+	}
+
+	w.Header().Set("Content-Type", "application/x-"+service+"-result")
+	w.Header().Set("Cache-Control", "no-cache")
+	// The response has begun by the time the service fails, if it
+	// does, so the error can only be logged.
+	if err := h.run(req, g, body, w, service); err != nil || service != receivePack {
+		return
+	}
+	if updates := refUpdates(before, g.RefSHAs()); len(updates) > 0 {
+		go postReceive(relPath(g.Path), rootLink(req), g.Path, updates)
+	}
+}
+
+// serveFile serves a file from the repository at gitDir to a client
+// using the dumb protocol, which fetches refs and objects as plain
+// files, for clients which can't use the smart protocol.
+func (h *gitHTTP) serveFile(w http.ResponseWriter, req *http.Request, gitDir, file string) {
+	for _, dumb := range dumbFiles {
+		if dumb.pattern.MatchString(file) {
+			w.Header().Set("Content-Type", dumb.contentType)
+			if dumb.immutable {
+				w.Header().Set("Cache-Control", "public, max-age=31536000")
+			} else {
+				w.Header().Set("Cache-Control", "no-cache")
+			}
+			http.ServeFile(w, req, path.Join(gitDir, file))
+			return
+		}
+	}
+	http.NotFound(w, req)
+}
+
+// enabled checks whether the service may be used on the repository.
+// As with git-http-backend, upload-pack is enabled unless the
+// http.uploadpack setting is false, and receive-pack is disabled
+// unless http.receivepack is true, because clients are not
+// authenticated.
+func (h *gitHTTP) enabled(g *git, service string) bool {
+	var setting string
+	var enabled bool
+	switch service {
+	case uploadPack:
+		setting, enabled = "http.uploadpack", true
+	case receivePack:
+		setting, enabled = "http.receivepack", false
+	default:
+		return false
+	}
+	if value, err := g.execute("config", "--bool", setting); err == nil {
+		enabled = strings.TrimSpace(value) == "true"
+	}
+	return enabled
+}
+
+// run runs the service, such as git-upload-pack, on the repository
+// with the given input and output, passing on the version of the
+// protocol which the client asked for, along with any environment
+// which the configuration gives the repository, and hiding the refs
+// which may not be fetched from it. Errors are logged.
+func (h *gitHTTP) run(req *http.Request, g *git, stdin io.Reader, stdout io.Writer, service string, args ...string) (err error) {
+	args = append(append([]string{strings.TrimPrefix(service, "git-"),
+		"--stateless-rpc"}, args...), g.Path)
+	span := g.startSpan(args)
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(req.Context(), conf().GitBin, args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = stdin, stdout, &stderr
+	cmd.Env = append(os.Environ(), conf().RepoEnv(relPath(g.Path))...)
+	if service == uploadPack {
+		cmd.Env = append(cmd.Env, hideRefsEnv(conf().RepoFetchRefs(relPath(g.Path)))...)
+	}
+	if proto := req.Header.Get("Git-Protocol"); validGitProtocol.MatchString(proto) {
+		cmd.Env = append(cmd.Env, "GIT_PROTOCOL="+proto)
+	}
+	err = cmd.Run()
+	endSpan(span, err)
+	if err != nil {
+		h.Logger.Printf("%s on %q failed: %s: %s", service, g.Path, err,
+			strings.TrimSpace(stderr.String()))
+	}
+	return err
+}
+
+// hideRefsEnv makes the environment which configures upload-pack to
+// advertise and serve only the given refs, such as "refs/tags" or
+// "refs/heads/master", and those below them, by hiding every ref and
+// then exposing each of them with uploadpack.hideRefs. It is empty if
+// no refs are given, so that all of them may be fetched.
+func hideRefsEnv(refs []string) []string {
+	if len(refs) == 0 {
+		return nil
+	}
+	env := []string{"GIT_CONFIG_KEY_0=uploadpack.hideRefs",
+		"GIT_CONFIG_VALUE_0=refs/"}
+	for n, ref := range refs {
+		env = append(env,
+			fmt.Sprintf("GIT_CONFIG_KEY_%d=uploadpack.hideRefs", n+1),
+			fmt.Sprintf("GIT_CONFIG_VALUE_%d=!%s", n+1, ref))
+	}
+	return append(env, "GIT_CONFIG_COUNT="+strconv.Itoa(len(refs)+1))
+}
+
+// pktLine encodes s as a pkt-line, prefixed with its length in hex.
+func pktLine(s string) string {
+	return fmt.Sprintf("%04x%s", len(s)+4, s)
+}
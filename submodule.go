@@ -0,0 +1,98 @@
+package grove
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"html/template"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	// scpURL matches scp-like git URLs, such as
+	// "git@example.com:group/proj.git", capturing the host and path.
+	scpURL = regexp.MustCompile(`^(?:[^@/]+@)?([^:/]+):([^/].*)$`)
+)
+
+// Submodule is a submodule declared in a repository's .gitmodules.
+type Submodule struct {
+	Name       string       // Name of the submodule
+	Path       string       // Path of the submodule within the repository
+	URL        string       // URL from which it is cloned
+	Link       template.URL // Web page of URL, if one can be guessed
+	Commit     string       // SHA at which it is pinned, if any
+	CommitLink template.URL // Page of the pinned commit, if it is in Grove
+}
+
+// Submodules parses the .gitmodules file of the repository at the
+// given ref, and finds the commit at which each submodule is pinned.
+// repoURL is the URL path of the repository, which relative submodule
+// URLs are resolved against. The submodules are sorted by path.
+func (g *git) Submodules(ref, repoURL string) (subs []*Submodule) {
+	output, _ := g.execute("config", "--blob", ref+":.gitmodules",
+		"--get-regexp", `^submodule\..*\.(path|url)$`)
+	byName := make(map[string]*Submodule)
+	for _, line := range strings.Split(strings.TrimRight(output, "\n"), "\n") {
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		key := strings.TrimPrefix(fields[0], "submodule.")
+		i := strings.LastIndex(key, ".")
+		name := key[:i]
+		sub, ok := byName[name]
+		if !ok {
+			sub = &Submodule{Name: name}
+			byName[name] = sub
+			subs = append(subs, sub)
+		}
+		switch key[i+1:] {
+		case "path":
+			sub.Path = fields[1]
+		case "url":
+			sub.URL = fields[1]
+		}
+	}
+
+	for _, sub := range subs {
+		if len(sub.Path) == 0 {
+			sub.Path = sub.Name
+		}
+		sub.Link, sub.CommitLink = submoduleLinks(sub.URL, repoURL)
+		output, _ := g.execute("ls-tree", ref, "--", sub.Path)
+		// The submodule is recorded as "160000 commit <sha>\t<path>".
+		if fields := strings.Fields(output); len(fields) >= 3 && fields[1] == "commit" {
+			sub.Commit = fields[2]
+			if len(sub.CommitLink) > 0 {
+				sub.CommitLink += template.URL(sub.Commit)
+			}
+		}
+	}
+	sort.Slice(subs, func(i, j int) bool {
+		return subs[i].Path < subs[j].Path
+	})
+	return subs
+}
+
+// submoduleLinks guesses the web page of a submodule from its URL.
+// Relative URLs name repositories served by Grove, so a link prefix for
+// their commits is also returned. Other URLs are only linked if they
+// are HTTP(S), or scp-like URLs, which are assumed to have a web page
+// at the same host and path.
+func submoduleLinks(u, repoURL string) (link, commitLink template.URL) {
+	switch {
+	case strings.HasPrefix(u, "./") || strings.HasPrefix(u, "../"):
+		p := strings.TrimSuffix(path.Join(repoURL, u), "/.git")
+		return template.URL(prefix + p + "/"),
+			template.URL(prefix + p + "/commit/")
+	case strings.HasPrefix(u, "http://") || strings.HasPrefix(u, "https://"):
+		return template.URL(strings.TrimSuffix(u, ".git")), ""
+	}
+	if m := scpURL.FindStringSubmatch(u); m != nil {
+		return template.URL("https://" + m[1] + "/" +
+			strings.TrimSuffix(m[2], ".git")), ""
+	}
+	return "", ""
+}
@@ -0,0 +1,95 @@
+package grove
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// throttleChunk is the most which is written at once by a
+	// throttled writer, so that waits are short and even.
+	throttleChunk = 16 * 1024
+)
+
+// rateLimiter limits the rate at which bytes are passed through it.
+// It is safe to share between goroutines. A nil *rateLimiter does not
+// limit anything.
+type rateLimiter struct {
+	mu   sync.Mutex
+	rate int       // Bytes per second
+	next time.Time // Time at which the bytes so far are paid for
+}
+
+// newRateLimiter returns a rateLimiter allowing rate bytes per second,
+// or nil if rate is not positive.
+func newRateLimiter(rate int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: rate}
+}
+
+// wait blocks until n more bytes may be passed.
+func (r *rateLimiter) wait(n int) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	now := time.Now()
+	if r.next.Before(now) {
+		r.next = now
+	}
+	r.next = r.next.Add(time.Duration(n) * time.Second / time.Duration(r.rate))
+	delay := r.next.Sub(now)
+	r.mu.Unlock()
+	time.Sleep(delay)
+}
+
+// throttledWriter is an http.ResponseWriter which is limited by its
+// own rateLimiter and by the one for TotalRateLimit.
+type throttledWriter struct {
+	http.ResponseWriter
+	limiter *rateLimiter
+	total   *rateLimiter
+}
+
+// throttle wraps w so that writes to it are limited by the RateLimit
+// and TotalRateLimit settings. It is used for git transfers and
+// archives, which may be large.
+func throttle(w http.ResponseWriter) http.ResponseWriter {
+	s := loaded()
+	limiter := newRateLimiter(s.conf.RateLimit)
+	if limiter == nil && s.totalLimiter == nil {
+		return w
+	}
+	return &throttledWriter{ResponseWriter: w, limiter: limiter, total: s.totalLimiter}
+}
+
+func (w *throttledWriter) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > throttleChunk {
+			chunk = chunk[:throttleChunk]
+		}
+		w.limiter.wait(len(chunk))
+		w.total.wait(len(chunk))
+		written, err := w.ResponseWriter.Write(chunk)
+		n += written
+		if err != nil {
+			return n, err
+		}
+		b = b[len(chunk):]
+	}
+	return n, nil
+}
+
+// Flush passes flushes through, so that the client is not kept
+// waiting on buffered data.
+func (w *throttledWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
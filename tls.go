@@ -0,0 +1,209 @@
+package grove
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	ClientAuthAll  = "all"  // Require client certificates for everything
+	ClientAuthPush = "push" // Require them only for pushes and /debug/
+)
+
+// tlsConfig builds the TLS configuration from the TLSCert, TLSKey,
+// TLSCertDir, ACMEHosts, ClientCA, and ClientAuth settings. It returns
+// nil if TLS is not enabled.
+func tlsConfig(c *Config) (config *tls.Config, err error) {
+	certManager = nil
+	if len(c.ACMEHosts) > 0 {
+		if len(c.TLSCert) > 0 || len(c.TLSKey) > 0 || len(c.TLSCertDir) > 0 {
+			return nil, errors.New("ACMEHosts can't be used with TLSCert, TLSKey, or TLSCertDir")
+		}
+		if certManager, err = newCertManager(c); err != nil {
+			return nil, err
+		}
+		// The manager's configuration offers HTTP/2, and also answers
+		// TLS-ALPN-01 challenges on the HTTPS port.
+		config = certManager.TLSConfig()
+		config.MinVersion = tls.VersionTLS12
+		return clientAuthConfig(c, config)
+	}
+	if len(c.TLSCert) == 0 && len(c.TLSKey) == 0 && len(c.TLSCertDir) == 0 {
+		switch {
+		case len(c.ClientAuth) > 0:
+			return nil, errors.New("ClientAuth requires TLSCert and TLSKey")
+		case len(c.RedirectHTTP) > 0:
+			return nil, errors.New("RedirectHTTP requires TLSCert and TLSKey")
+		case c.HSTSMaxAge > 0:
+			return nil, errors.New("HSTSMaxAge requires TLSCert and TLSKey")
+		}
+		return nil, nil
+	}
+	// HTTP/2 is offered to clients which support it, as
+	// http.ListenAndServeTLS would.
+	config = &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	// The certificate given by TLSCert comes first, so that it is
+	// used for clients which don't send a server name, or send one
+	// which none of the certificates match.
+	if len(c.TLSCert) > 0 || len(c.TLSKey) > 0 {
+		cert, err := tls.LoadX509KeyPair(c.TLSCert, c.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = append(config.Certificates, cert)
+	}
+	if len(c.TLSCertDir) > 0 {
+		certs, err := loadCertDir(c.TLSCertDir)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = append(config.Certificates, certs...)
+	}
+	if len(config.Certificates) == 0 {
+		return nil, errors.New("no certificates found in " + c.TLSCertDir)
+	}
+	return clientAuthConfig(c, config)
+}
+
+// clientAuthConfig adds the ClientCA and ClientAuth settings to the TLS
+// configuration.
+func clientAuthConfig(c *Config, config *tls.Config) (*tls.Config, error) {
+	switch c.ClientAuth {
+	case "":
+		return config, nil
+	case ClientAuthAll:
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	case ClientAuthPush:
+		// Certificates are checked if they are given, and
+		// clientCertHandler requires them where they are needed.
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return nil, errors.New("ClientAuth must be \"" + ClientAuthAll +
+			"\" or \"" + ClientAuthPush + "\"")
+	}
+	if len(c.ClientCA) == 0 {
+		return nil, errors.New("ClientAuth requires ClientCA")
+	}
+	pem, err := os.ReadFile(c.ClientCA)
+	if err != nil {
+		return nil, err
+	}
+	config.ClientCAs = x509.NewCertPool()
+	if !config.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates found in " + c.ClientCA)
+	}
+	return config, nil
+}
+
+// loadCertDir loads each certificate in the directory dir, which are
+// named <name>.crt, along with their private keys, named <name>.key.
+// Certificates are chosen from among them for each connection by the
+// server name which the client sends, with SNI, so that several
+// domains can be served at once.
+func loadCertDir(dir string) (certs []tls.Certificate, err error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.crt"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		key := strings.TrimSuffix(file, ".crt") + ".key"
+		cert, err := tls.LoadX509KeyPair(file, key)
+		if err != nil {
+			return nil, err
+		}
+		if cert.Leaf != nil {
+			l.Debugf("Loaded certificate %q for %s\n", file,
+				strings.Join(cert.Leaf.DNSNames, ", "))
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// serveRedirect listens for plain HTTP on the RedirectHTTP address,
+// and redirects every request to HTTPS with httpsRedirect, except for
+// the challenges from Let's Encrypt if ACMEHosts is set.
+func serveRedirect(addr string) error {
+	network, addr, err := listenAddr(addr)
+	if err != nil {
+		return err
+	}
+	ln, err := listenOn(network, addr)
+	if err != nil {
+		return err
+	}
+	l.Infof("Redirecting plain HTTP on %s to HTTPS\n", ln.Addr())
+	go func() {
+		err := http.Serve(wrapListener(ln), requestIDHandler(acmeChallengeHandler(
+			hostHandler(http.HandlerFunc(httpsRedirect)))))
+		l.Errf("HTTP redirect listener stopped: %s\n", err)
+	}()
+	return nil
+}
+
+// httpsRedirect permanently redirects the request to the same URL over
+// HTTPS, on the port given with --port.
+func httpsRedirect(w http.ResponseWriter, req *http.Request) {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+	if conf().Port != "443" {
+		host = net.JoinHostPort(host, conf().Port)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	http.Redirect(w, req, "https://"+host+req.URL.RequestURI(),
+		http.StatusMovedPermanently)
+}
+
+// clientCertHandler wraps a handler so that, with ClientAuthPush,
+// pushes and requests to /debug/ are refused unless the client gave a
+// certificate signed by the ClientCA. With ClientAuthAll, this is
+// already enforced by the TLS handshake.
+func clientCertHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if conf().ClientAuth == ClientAuthPush && needsClientCert(req) &&
+			(req.TLS == nil || len(req.TLS.VerifiedChains) == 0) {
+			reqLog(req).Noticef("Request to %q from %q denied without client certificate\n",
+				req.URL.Path, req.RemoteAddr)
+			http.Error(w, http.StatusText(http.StatusForbidden),
+				http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// strictTransportSecurity returns the Strict-Transport-Security
+// header for the HSTSMaxAge setting, or an empty string if it should
+// not be sent.
+func strictTransportSecurity() string {
+	if conf().HSTSMaxAge <= 0 {
+		return ""
+	}
+	return "max-age=" + strconv.Itoa(conf().HSTSMaxAge)
+}
+
+// needsClientCert checks whether the request is a push, or is to the
+// debugging handlers.
+func needsClientCert(req *http.Request) bool {
+	return strings.HasSuffix(req.URL.Path, "/git-receive-pack") ||
+		req.URL.Query().Get("service") == "git-receive-pack" ||
+		strings.HasPrefix(req.URL.Path, prefix+"/debug/")
+}
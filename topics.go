@@ -0,0 +1,93 @@
+package grove
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// readTopics reads the topics of a repository from its grove.topics
+// setting, in which they are separated by commas or spaces.
+func readTopics(g *git) []string {
+	output, _ := g.execute("config", "--get", "grove.topics")
+	return strings.FieldsFunc(output, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	})
+}
+
+// repoTopics lists the topics of the repository at p, which are those
+// in its grove.topics setting along with those given to it by the
+// Topics setting of the configuration. They are lowercase and sorted.
+func repoTopics(p string) []string {
+	var topics []string
+	if entry, ok := index.Lookup(p); ok && entry.Repo != nil {
+		topics = append(topics, entry.Repo.Topics...)
+	} else {
+		topics = readTopics(&git{Path: p})
+	}
+	topics = append(topics, conf().RepoTopics(relPath(p))...)
+	return normalizeTopics(topics)
+}
+
+// normalizeTopics lowercases the topics, and sorts them with duplicates
+// removed.
+func normalizeTopics(topics []string) []string {
+	seen := make(map[string]bool, len(topics))
+	normalized := make([]string, 0, len(topics))
+	for _, t := range topics {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if len(t) == 0 || seen[t] {
+			continue
+		}
+		seen[t] = true
+		normalized = append(normalized, t)
+	}
+	sort.Strings(normalized)
+	return normalized
+}
+
+// reposWithin lists the indexed repositories within directory which
+// may be served, named by their paths relative to it. If topic is not
+// empty, only those which have it are listed. Paths are compared by
+// URL, so that the top level of every served directory is within the
+// first.
+func reposWithin(directory, topic string) (list []*dirList) {
+	within := relPath(directory) + "/"
+	for _, repo := range index.Repos() {
+		if !strings.HasPrefix(relPath(repo), within) {
+			continue
+		}
+		if _, _, _, status := SplitRepository(rootOf(repo), repo); status != http.StatusOK ||
+			!listable(directory, repo) {
+			continue
+		}
+		topics := repoTopics(repo)
+		if i := sort.SearchStrings(topics, topic); len(topic) > 0 &&
+			(i == len(topics) || topics[i] != topic) {
+			continue
+		}
+		item := &dirList{
+			URL:    template.URL(prefix + relPath(repo) + "/"),
+			Name:   strings.TrimPrefix(relPath(repo), within),
+			Topics: topics,
+		}
+		if entry, ok := index.Lookup(repo); ok && entry.Repo != nil {
+			item.Description = entry.Repo.Description
+			item.Tip = entry.Repo.Tip
+		}
+		list = append(list, item)
+	}
+	return
+}
+
+// allTopics gathers the topics of the listed repositories, sorted.
+func allTopics(list []*dirList) []string {
+	var topics []string
+	for _, item := range list {
+		topics = append(topics, item.Topics...)
+	}
+	return normalizeTopics(topics)
+}
@@ -0,0 +1,187 @@
+package grove
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultOnionPort = 80 // Port on which the onion service is reached
+)
+
+// TorConfig holds the settings for publishing Grove as a Tor onion
+// service, through the control port of a Tor daemon which is already
+// running.
+type TorConfig struct {
+	// Control is the address of Tor's control port, such as
+	// "127.0.0.1:9051", or "unix:" followed by the path of its
+	// control socket. The onion service is only published if it is
+	// set. Password is the password set by HashedControlPassword in
+	// the torrc; if it is not given, the cookie file is used if Tor
+	// allows it.
+	Control  string
+	Password string
+
+	// KeyFile is the file holding the private key of the onion
+	// service, which determines its address. If it does not exist, a
+	// new key is made and saved to it, so that the address stays the
+	// same from then on. It is required.
+	KeyFile string
+
+	// Port is the port on which the onion service is reached, which
+	// is 80 by default.
+	Port int
+}
+
+// onionListener is the listener on which connections to the onion
+// service arrive from Tor. The service lasts as long as the control
+// connection which added it, and so closing the listener closes that
+// too, which removes the service.
+type onionListener struct {
+	net.Listener
+	ctrl *textproto.Conn
+}
+
+func (ln onionListener) Close() error {
+	ln.ctrl.Close()
+	return ln.Listener.Close()
+}
+
+// listenOnion publishes an onion service through the Tor control port,
+// forwarding to a new listener on the loopback interface, and returns
+// that listener along with the service's address, such as
+// "<id>.onion".
+func listenOnion(c TorConfig) (ln net.Listener, addr string, err error) {
+	if len(c.KeyFile) == 0 {
+		return nil, "", errors.New("tor: KeyFile is not set")
+	}
+	ctrl, err := torControl(c)
+	if err != nil {
+		return nil, "", err
+	}
+
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		ctrl.Close()
+		return nil, "", err
+	}
+
+	// Tor is asked to make a new key if there is none saved yet, and
+	// otherwise to use, but not echo back, the saved one.
+	key, flags := "NEW:ED25519-V3", ""
+	if saved, err := os.ReadFile(c.KeyFile); err == nil {
+		key, flags = strings.TrimSpace(string(saved)), " Flags=DiscardPK"
+	} else if !os.IsNotExist(err) {
+		local.Close()
+		ctrl.Close()
+		return nil, "", err
+	}
+	reply, err := torCommand(ctrl, "ADD_ONION %s%s Port=%d,%s",
+		key, flags, c.Port, local.Addr())
+	if err != nil {
+		local.Close()
+		ctrl.Close()
+		return nil, "", err
+	}
+
+	for _, line := range strings.Split(reply, "\n") {
+		k, v, _ := strings.Cut(line, "=")
+		switch k {
+		case "ServiceID":
+			addr = v + ".onion"
+		case "PrivateKey":
+			err = os.WriteFile(c.KeyFile, []byte(v+"\n"), 0600)
+		}
+	}
+	if err == nil && len(addr) == 0 {
+		err = errors.New("tor: no service ID in reply to ADD_ONION")
+	}
+	if err != nil {
+		local.Close()
+		ctrl.Close()
+		return nil, "", err
+	}
+	return onionListener{Listener: local, ctrl: ctrl}, addr, nil
+}
+
+// torControl connects to the Tor control port and authenticates, with
+// the password if one is given, or else with the cookie file or no
+// authentication, whichever Tor reports that it accepts.
+func torControl(c TorConfig) (ctrl *textproto.Conn, err error) {
+	network, address := "tcp", c.Control
+	if strings.HasPrefix(address, "unix:") {
+		network, address = "unix", strings.TrimPrefix(address, "unix:")
+	}
+	ctrl, err = textproto.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	// The reply to PROTOCOLINFO includes a line such as
+	//    AUTH METHODS=COOKIE,SAFECOOKIE COOKIEFILE="/run/tor/cookie"
+	info, err := torCommand(ctrl, "PROTOCOLINFO 1")
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	var methods, cookieFile string
+	for _, line := range strings.Split(info, "\n") {
+		if !strings.HasPrefix(line, "AUTH ") {
+			continue
+		}
+		// The path of the cookie file may contain spaces, so it is
+		// taken from the rest of the line.
+		line, quoted, _ := strings.Cut(line, " COOKIEFILE=")
+		cookieFile, _ = strconv.Unquote(quoted)
+		for _, field := range strings.Fields(line) {
+			if v, ok := strings.CutPrefix(field, "METHODS="); ok {
+				methods = "," + v + ","
+			}
+		}
+	}
+
+	auth := "AUTHENTICATE"
+	switch {
+	case len(c.Password) > 0:
+		auth += " " + strconv.Quote(c.Password)
+	case strings.Contains(methods, ",COOKIE,") && len(cookieFile) > 0:
+		cookie, err := os.ReadFile(cookieFile)
+		if err != nil {
+			ctrl.Close()
+			return nil, err
+		}
+		auth += " " + hex.EncodeToString(cookie)
+	case strings.Contains(methods, ",NULL,"):
+	default:
+		ctrl.Close()
+		return nil, fmt.Errorf("tor: no supported authentication method in %q",
+			strings.Trim(methods, ","))
+	}
+	if _, err = torCommand(ctrl, "%s", auth); err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	return ctrl, nil
+}
+
+// torCommand sends a command to the control port and reads the reply,
+// which must succeed. The lines of the reply are returned without
+// their status codes.
+func torCommand(ctrl *textproto.Conn, format string, args ...interface{}) (reply string, err error) {
+	if _, err = ctrl.Cmd(format, args...); err != nil {
+		return "", err
+	}
+	_, reply, err = ctrl.ReadResponse(250)
+	if err != nil {
+		return "", fmt.Errorf("tor: %s", err)
+	}
+	return reply, nil
+}
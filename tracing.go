@@ -0,0 +1,100 @@
+package grove
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var (
+	// tracer creates the spans which trace requests. Until tracing is
+	// set up by startTracing, it creates spans which are discarded.
+	tracer = otel.Tracer("grove")
+)
+
+// startTracing sets up tracing, with spans exported over OTLP/HTTP to
+// the OTLPEndpoint setting, or to the endpoint given by the standard
+// OTEL_EXPORTER_OTLP_ENDPOINT environment variables. If neither is
+// set, tracing is left disabled. The returned function flushes any
+// spans which have not yet been exported.
+func startTracing() (shutdown func(context.Context) error, err error) {
+	var opts []otlptracehttp.Option
+	if len(conf().OTLPEndpoint) > 0 {
+		opts = append(opts, otlptracehttp.WithEndpointURL(conf().OTLPEndpoint))
+	} else if len(os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")) == 0 &&
+		len(os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")) == 0 {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceNameKey.String("grove"),
+			semconv.ServiceVersionKey.String(Version))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	tracer = provider.Tracer("grove")
+	return provider.Shutdown, nil
+}
+
+// traceRequest starts a span for a request, continuing any trace
+// begun by the client or a proxy, and returns the request with the
+// span in its context.
+func traceRequest(req *http.Request, name string) (*http.Request, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(req.Context(),
+		propagation.HeaderCarrier(req.Header))
+	ctx, span := tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPMethodKey.String(req.Method),
+			semconv.HTTPTargetKey.String(req.URL.RequestURI()),
+			attribute.String("grove.request_id", requestID(req))))
+	return req.WithContext(ctx), span
+}
+
+// startSpan starts a span for a git command run on behalf of a
+// request. If the git was not created for a request, the span is
+// discarded.
+func (g *git) startSpan(args []string) trace.Span {
+	if g.ctx == nil {
+		return trace.SpanFromContext(context.Background())
+	}
+	name := "git"
+	for _, arg := range args {
+		// Skip leading options, such as --no-pager, to name the span
+		// after the subcommand.
+		if !strings.HasPrefix(arg, "-") {
+			name += " " + arg
+			break
+		}
+	}
+	_, span := tracer.Start(g.ctx, name, trace.WithAttributes(
+		attribute.String("git.dir", g.Path),
+		attribute.StringSlice("git.args", args)))
+	return span
+}
+
+// endSpan ends the span, recording the error if there was one.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,83 @@
+package grove
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"html/template"
+	"regexp"
+	"strings"
+)
+
+var (
+	// trailerLine matches a line of a commit's trailers, such as
+	// "Signed-off-by: A U Thor <author@example.com>", capturing the
+	// key and value.
+	trailerLine = regexp.MustCompile(`^([A-Za-z0-9][A-Za-z0-9-]*):\s*(.*)$`)
+
+	// trailerPerson matches values naming a person, capturing their
+	// name and email address.
+	trailerPerson = regexp.MustCompile(`^(.*?)\s*<([^<>@\s]+@[^<>\s]+)>$`)
+
+	// trailerCommit matches values beginning with the SHA of a commit,
+	// as in "Fixes: 0123abcd ("subject")", capturing the SHA and the
+	// rest of the value.
+	trailerCommit = regexp.MustCompile(`^([0-9a-f]{7,64})\b\s*(.*)$`)
+)
+
+// Trailer is one of the trailers at the end of a commit message, such
+// as Signed-off-by or Fixes. Values naming a person or a commit are
+// split up so that they can be linked.
+type Trailer struct {
+	Key    string       // Key, such as "Signed-off-by"
+	Value  string       // Value as written
+	Name   string       // Name of the person, if the value names one
+	Email  string       // Email address of the person, if any
+	Avatar template.URL // Avatar of the person, if enabled
+	SHA    string       // SHA of the commit, if the value begins with one
+	Rest   string       // Remainder of the value after the SHA
+}
+
+// parseTrailers splits the trailers from the end of a commit body. As
+// with git interpret-trailers, they are the last paragraph of the
+// body, if every line of it is a "Key: value" pair or a continuation
+// of the previous value. If there are none, the body is returned as it
+// is.
+func parseTrailers(body string) (rest string, trailers []*Trailer) {
+	body = strings.TrimRight(body, "\n")
+	// The body may be a single paragraph made up of trailers alone.
+	start := 0
+	if i := strings.LastIndex(body, "\n\n"); i >= 0 {
+		start = i + 2
+	}
+	for _, line := range strings.Split(body[start:], "\n") {
+		if len(trailers) > 0 && (strings.HasPrefix(line, " ") ||
+			strings.HasPrefix(line, "\t")) {
+			last := trailers[len(trailers)-1]
+			last.Value += " " + strings.TrimSpace(line)
+			continue
+		}
+		m := trailerLine.FindStringSubmatch(line)
+		if m == nil {
+			return body, nil
+		}
+		trailers = append(trailers, &Trailer{Key: trailerKey(m[1]), Value: m[2]})
+	}
+
+	for _, t := range trailers {
+		if m := trailerPerson.FindStringSubmatch(t.Value); m != nil {
+			t.Name, t.Email = m[1], m[2]
+			t.Avatar = avatarURL(t.Email)
+		} else if m := trailerCommit.FindStringSubmatch(t.Value); m != nil {
+			t.SHA, t.Rest = m[1], m[2]
+		}
+	}
+	return strings.TrimRight(body[:start], "\n"), trailers
+}
+
+// trailerKey normalizes the case of a trailer key, so that
+// "signed-off-by" and "Signed-Off-By" are both shown as
+// "Signed-off-by".
+func trailerKey(key string) string {
+	key = strings.ToLower(key)
+	return strings.ToUpper(key[:1]) + key[1:]
+}
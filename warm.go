@@ -0,0 +1,111 @@
+package grove
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"html/template"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// frontPageCache caches the log and README shown on the front page
+	// of each repository. Entries are keyed by the SHA of the tip, so
+	// they never need to be invalidated, but it is cleared when it
+	// reaches frontPageCacheMax entries to bound its size.
+	frontPageCache    = make(map[string]*frontPage)
+	frontPageCacheMu  sync.Mutex
+	frontPageCacheMax = 1024
+)
+
+// frontPage holds the parts of the front page of a repository which
+// are costly to make.
+type frontPage struct {
+	Commits []*Commit     // Most recent commits reachable from the tip
+	Readme  template.HTML // Rendered README, if there is one
+}
+
+// FrontPage retrieves the most recent maxCommits commits reachable from
+// ref, and renders the README at it, if there is one. Results are
+// cached per tip SHA.
+func (g *git) FrontPage(ref string, maxCommits int) *frontPage {
+	tip := g.FullSHA(ref)
+	if len(tip) == 0 {
+		// Refs which don't name a single commit, such as ranges, are
+		// not cached.
+		return g.makeFrontPage(ref, maxCommits)
+	}
+	key := g.Path + "\x00" + tip + "\x00" + strconv.Itoa(maxCommits)
+	frontPageCacheMu.Lock()
+	page, ok := frontPageCache[key]
+	frontPageCacheMu.Unlock()
+	if ok {
+		return page
+	}
+
+	page = g.makeFrontPage(tip, maxCommits)
+
+	frontPageCacheMu.Lock()
+	if len(frontPageCache) >= frontPageCacheMax {
+		frontPageCache = make(map[string]*frontPage)
+	}
+	frontPageCache[key] = page
+	frontPageCacheMu.Unlock()
+	return page
+}
+
+func (g *git) makeFrontPage(ref string, maxCommits int) *frontPage {
+	return &frontPage{
+		Commits: g.Commits(ref, maxCommits),
+		Readme:  g.Readme(ref),
+	}
+}
+
+// Readme renders the README at the top of the tree at ref, or is empty
+// if there is none.
+func (g *git) Readme(ref string) template.HTML {
+	// Load the README if it can be located. To locate, go through a
+	// list of possible names and break the loop at the first one.
+	for _, fn := range []string{"README", "README.txt", "README.md"} {
+		readme := g.GetFile(ref, fn)
+		if len(readme) != 0 {
+			return template.HTML(renderMarkdown(readme))
+		}
+	}
+	return ""
+}
+
+// warmCaches fills the caches behind the front pages, activity, and
+// feeds of every indexed repository, so that the first requests after
+// Grove starts are not slowed by filling them. Up to jobs repositories
+// are warmed at once. The index itself is built before Grove serves
+// anything, so it needs no warming.
+func warmCaches(jobs int) {
+	repos := index.Repos()
+	start := time.Now()
+	l.Infof("Warming caches of %d repositories\n", len(repos))
+
+	queue := make(chan string)
+	var wg sync.WaitGroup
+	for n := 0; n < jobs; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range queue {
+				g := &git{Path: p}
+				g.FrontPage("HEAD", conf().DefaultCommits)
+				g.Activity()
+				g.TotalCommits()
+				g.FeedEvents(relPath(p))
+			}
+		}()
+	}
+	for _, p := range repos {
+		queue <- p
+	}
+	close(queue)
+	wg.Wait()
+	l.Infof("Warmed caches of %d repositories in %s\n", len(repos),
+		time.Since(start).Round(time.Millisecond))
+}
@@ -1,59 +1,286 @@
-package main
+package grove
 
 // Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
 
 import (
+	"bytes"
+	"context"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
-	"github.com/russross/blackfriday"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"html"
 	"html/template"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 type gitPage struct {
 	Prefix     string // URL prefix to be prepended
+	Nonce      string // Nonce for inline scripts and styles
 	Owner      string
 	InRepoPath string
 	URL        string
 	GitDir     string
 	Branch     string
 	RootLink   string
-	TagNum     string
 	Path       string
-	CommitNum  string
 	SHA        string
+	CloneURLs  []*dirList
 	Content    template.HTML
+	Lines      template.HTML
+	Markup     bool
+	Rendered   bool
+	Toggle     template.URL
+	Download   template.URL
+	Submodules []*Submodule
+	Topics     []string
+	Topic      string
+	Sort       string
+	Pinned     []*dirList
+	Groups     []*repoGroup
+	Reflogs    []*reflogGroup
+	Pickaxe    *Pickaxe
+	Binary     bool
+	Hexdump    bool
+	Size       int
+	TabWidth   int
+	Blob       *blobInfo
+	Blame      []*blameRow
+	Crumbs     []*dirList
 	List       []*dirList
 	Logs       []*gitLog
 	Version    string
 	Query      template.URL
 	Status     string
+	RequestID  string
+	Author     *authorSummary
+	Shortlog   []*shortlogEntry
+	Tag        *tagInfo
+	Branches   []*branchInfo
+	Stale      bool
+	RepoLogo   template.URL // Link to the repository's logo, if any
+	Commit     *gitLog
+	Parents    []*parentLink
+	Combined   *parentLink
+	Compare    string
+	Diff       []*DiffFile
+	DiffLinks  []*dirList
+	Split      bool
+	DiffStat   *diffStat
+	Activity   []*activityBar
+	Feed       []*feedEvent
+	PrevPage   template.URL
+	NextPage   template.URL
+
+	ctx    context.Context // Context of the request, for tracing
+	counts *repoCounts     // Numbers of tags and commits, when needed
+	emails string          // EmailPrivacy of the repository, if any
+	state  *state          // Configuration and templates of the page, if set
+}
+
+// repoCounts holds the numbers of tags and commits in a repository,
+// which are only counted if a page shows them, because counting is
+// slow in large repositories.
+type repoCounts struct {
+	once    sync.Once
+	g       *git
+	tags    int
+	commits int
+}
+
+// count counts the tags and commits of the repository, concurrently,
+// the first time it is called.
+func (c *repoCounts) count() {
+	c.once.Do(func() {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.tags = len(c.g.Tags())
+		}()
+		c.commits = c.g.TotalCommits()
+		wg.Wait()
+	})
+}
+
+// TagNum is the number of tags in the repository, or empty outside of
+// one.
+func (p *gitPage) TagNum() string {
+	if p.counts == nil {
+		return ""
+	}
+	p.counts.count()
+	return strconv.Itoa(p.counts.tags)
+}
+
+// CommitNum is the number of commits in the repository, or empty
+// outside of one.
+func (p *gitPage) CommitNum() string {
+	if p.counts == nil {
+		return ""
+	}
+	p.counts.count()
+	return strconv.Itoa(p.counts.commits)
+}
+
+type authorSummary struct {
+	Name    string
+	Email   string
+	Avatar  template.URL
+	Commits string
+	First   *gitLog
+	Last    *gitLog
 }
 
 type gitLog struct {
 	Author    string
+	Email     string
+	Avatar    template.URL
 	Classtype string
 	SHA       string
 	Time      string
 	Subject   template.HTML
 	Body      template.HTML
+	Trailers  []*Trailer
+	Replaced  string // SHA of the commit replacing this one, if any
+}
+
+// parentLink is a parent of the commit shown on a commit page. For
+// merges, each links to the diff against that parent alone, and
+// another, without a SHA, links to the combined diff.
+type parentLink struct {
+	SHA      string       // Full SHA of the parent
+	Subject  string       // Subject of the parent
+	Diff     template.URL // Link to the diff against the parent, for merges
+	Selected bool         // Whether that diff is the one shown
+}
+
+type branchInfo struct {
+	Name    string
+	SHA     string
+	Author  string
+	Time    string
+	Subject string
+	Default bool
+	Merged  bool
+	Ahead   int
+	Behind  int
+}
+
+type diffStat struct {
+	Files     []*diffStatFile
+	Additions int
+	Deletions int
+}
+
+type diffStatFile struct {
+	Name      string
+	Anchor    string
+	Binary    bool
+	Additions int
+	Deletions int
+	AddWidth  int // Percentage of the bar showing additions
+	DelWidth  int // Percentage of the bar showing deletions
+}
+
+type tagInfo struct {
+	Name       string
+	Annotated  bool
+	SHA        string
+	Target     string
+	Tagger     string
+	Avatar     template.URL
+	Time       string
+	Annotation template.HTML
+	Signed     bool
+	SigStatus  string
+	SigMessage string
+	Archives   []*archiveLink
+}
+
+type archiveLink struct {
+	URL  template.URL
+	Name string
+}
+
+type shortlogEntry struct {
+	Name   string
+	Email  string
+	Avatar template.URL
+	Count  int
+	Logs   []*gitLog
 }
 
 type dirList struct {
-	URL   template.URL
-	Name  string
-	Link  string
-	Query template.URL
+	URL         template.URL
+	Name        string
+	Link        string
+	Query       template.URL
+	Description string    // Description of the repository, if any
+	Tip         string    // Short SHA of the repository's HEAD, if any
+	Topics      []string  // Topics of the repository, if any
+	Updated     time.Time // Time the repository was last updated, if known
+}
+
+// repoGroup is a subdirectory of a directory listing which contains
+// repositories, which are listed along with it.
+type repoGroup struct {
+	Name  string       // Name of the subdirectory
+	URL   template.URL // Link to the subdirectory's own listing
+	Repos []*dirList   // Repositories within it, named relative to it
+	More  int          // Number of repositories not listed
 }
 
 const (
-	defaultRef     = "HEAD" // Default git reference
-	defaultCommits = 10     // Default number of commits to show
+	groupRepos = 10 // Most repositories listed in each group
+
+	binarySniffLength = 8000      // Bytes checked by isBinary, as by git
+	maxHexdumpSize    = 64 * 1024 // Largest file shown as a hex dump
+)
+
+const (
+	SortName    = "name"    // Sort directory listings by name
+	SortUpdated = "updated" // Sort by the time of the last update
+)
+
+const (
+	defaultRef     = "HEAD"            // Default git reference
+	diffCookie     = "grove-diff-view" // Cookie remembering the diff layout
+	defaultCommits = 10                // Default number of commits to show
+
+	// Default maximum number of commits which may be requested
+	defaultMaxCommits = 1000
+
+	// Default number of commits to summarize in the shortlog
+	defaultShortlogCommits = 100
+
+	// Default template for the names of archives
+	defaultArchiveName = "{repo}-{ref}"
+)
+
+var (
+	// archiveFormats maps the file extensions of downloadable
+	// archives to their `git archive` formats and Content-Types.
+	archiveFormats = map[string][2]string{
+		".tar.gz": {"tar.gz", "application/gzip"},
+		".tgz":    {"tgz", "application/gzip"},
+		".tar":    {"tar", "application/x-tar"},
+		".zip":    {"zip", "application/zip"},
+	}
+
+	// archiveExts lists the archive extensions in the order in which
+	// they are offered for download.
+	archiveExts = []string{".tar.gz", ".zip"}
 )
 
 var (
@@ -63,40 +290,175 @@ var (
 		http.StatusText(http.StatusForbidden))
 	notFound = errors.New(
 		http.StatusText(http.StatusNotFound))
+	badRequest = errors.New(
+		http.StatusText(http.StatusBadRequest))
+	methodNotAllowed = errors.New(
+		http.StatusText(http.StatusMethodNotAllowed))
 )
 
-// Check for a .git directory in the repository argument. If one does
-// not exist, we will generate a directory listing, rather than a
-// repository view.
+// Check for a .git directory in the repository argument, or whether it
+// is a bare repository. If neither, we will generate a directory
+// listing, rather than a repository view. The index is consulted
+// first, and the filesystem only if the repository is outside of it.
+// The gitDir is ".git", or empty for bare repositories, which are
+// their own git directories.
 func isGit(repository string) (git bool, gitDir string) {
-	_, err := os.Stat(path.Join(repository, ".git"))
-	if err == nil {
-		// Note that err EQUALS nil
-		git = true
+	git, known := index.IsRepo(repository)
+	if !known {
+		git = len(gitDirOf(repository)) > 0
+	}
+	if git && !isBare(repository) {
 		gitDir = ".git"
 	}
 	return
 }
 
+// validRef reports whether ref names a commit in the repository. Refs
+// beginning with a dash are rejected, so that they can't be mistaken
+// for options.
+func validRef(g *git, ref string) bool {
+	return !strings.HasPrefix(ref, "-") && g.RefExists(ref)
+}
+
+// The views of repositories are registered with repoRouter, which
+// selects them by the first segment of the path within the repository.
+func init() {
+	for _, v := range []*View{
+		// The main page of a repository shows its log and README.
+		{Name: "", Arg: ArgNone, Make: func(v *ViewRequest) (error, int) {
+			return MakeGitPage(v.w, v.pageinfo, v.g, v.ref, v.arg,
+				v.maxCommits, pickaxeOptions(v.req))
+		}},
+		{Name: "tree", Arg: ArgDir, Make: func(v *ViewRequest) (error, int) {
+			return MakeTreePage(v.w, v.pageinfo, v.g, v.ref, v.arg)
+		}},
+		// Markup files are rendered unless ?render=0 is given, and
+		// small binary files are shown as a hex dump if ?hex=1 is
+		// given. With ?download=1, files are downloaded as
+		// attachments, rather than shown in the browser.
+		{Name: "blob", Arg: ArgFile, Make: func(v *ViewRequest) (error, int) {
+			if v.req.FormValue("download") == "1" {
+				return MakeRawPage(v.w, v.arg, v.ref, v.g, true)
+			}
+			render := v.req.FormValue("render") != "0"
+			hexdump := v.req.FormValue("hex") == "1"
+			return MakeFilePage(v.w, v.pageinfo, v.g, v.ref, v.arg,
+				render, hexdump)
+		}},
+		{Name: "raw", Arg: ArgFile, Make: func(v *ViewRequest) (error, int) {
+			download := v.req.FormValue("download") == "1"
+			return MakeRawPage(v.w, v.arg, v.ref, v.g, download)
+		}},
+		{Name: "blame", Arg: ArgFile, Make: func(v *ViewRequest) (error, int) {
+			return MakeBlamePage(v.w, v.pageinfo, v.g, v.ref, v.arg)
+		}},
+		{Name: "archive", Arg: ArgName, Make: func(v *ViewRequest) (error, int) {
+			return MakeArchive(v.w, v.g, path.Base(v.repository), v.arg)
+		}},
+		{Name: "tag", Arg: ArgName, Make: func(v *ViewRequest) (error, int) {
+			return MakeTagPage(v.w, v.pageinfo, v.g, v.arg)
+		}},
+		// Anything other than a full SHA, including the q form value
+		// from the search box, is resolved and redirected to the
+		// canonical URL of the commit.
+		{Name: "commit", Arg: ArgName, Make: func(v *ViewRequest) (error, int) {
+			file := v.arg
+			if len(file) == 0 {
+				file = v.req.FormValue("q")
+			}
+			if sha := v.g.ResolveCommit(file); len(sha) == 0 {
+				return notFound, http.StatusNotFound
+			} else if sha != file {
+				query := v.req.URL.Query()
+				query.Del("q")
+				target := prefix + v.pageinfo.Path + "commit/" + sha
+				if len(query) > 0 {
+					target += "?" + query.Encode()
+				}
+				http.Redirect(v.w, v.req, target, http.StatusFound)
+				reqLog(v.req).Debugf("Redirected %q from %q to %q\n",
+					v.req.URL.Path, v.req.RemoteAddr, target)
+				return nil, http.StatusFound
+			}
+			v.pageinfo.Split = diffSplit(v.w, v.req)
+			parent, _ := strconv.Atoi(v.req.FormValue("parent"))
+			return MakeCommitPage(v.w, v.pageinfo, v.g, file, parent,
+				diffOptions(v.req))
+		}},
+		{Name: "compare", Arg: ArgName, Make: func(v *ViewRequest) (error, int) {
+			v.pageinfo.Split = diffSplit(v.w, v.req)
+			return MakeComparePage(v.w, v.pageinfo, v.g, v.arg,
+				diffOptions(v.req))
+		}},
+		// Branches are listed, or stale branches reported. Which are
+		// stale depends on the time, so the page is volatile.
+		{Name: "branches", Arg: ArgName, Volatile: true, Make: func(v *ViewRequest) (error, int) {
+			switch v.arg {
+			case "":
+				return MakeBranchesPage(v.w, v.pageinfo, v.g, false)
+			case "stale":
+				return MakeBranchesPage(v.w, v.pageinfo, v.g, true)
+			}
+			return notFound, http.StatusNotFound
+		}},
+		// The reflogs are shown to administrators, who may restore
+		// branches from them.
+		{Name: "reflog", Arg: ArgNone, Volatile: true, Make: func(v *ViewRequest) (error, int) {
+			return MakeReflogPage(v.w, v.req, v.pageinfo, v.g)
+		}},
+		// The shortlog summarizes commits by author. It uses a larger
+		// default number of commits than the log.
+		{Name: "shortlog", Arg: ArgNone, Make: func(v *ViewRequest) (error, int) {
+			maxCommits := v.maxCommits
+			if len(v.req.FormValue("c")) == 0 {
+				maxCommits = conf().Commits("", defaultShortlogCommits)
+			}
+			return MakeShortlogPage(v.w, v.pageinfo, v.g, v.ref, maxCommits)
+		}},
+		// Authors are found by their email addresses, so their pages
+		// are not served if those may not be shown.
+		{Name: "author", Arg: ArgName, Make: func(v *ViewRequest) (error, int) {
+			if emailsHidden(v.pageinfo.emails) {
+				return notFound, http.StatusNotFound
+			}
+			page, _ := strconv.Atoi(v.req.FormValue("page"))
+			return MakeAuthorPage(v.w, v.pageinfo, v.g, v.ref, v.arg,
+				v.maxCommits, page)
+		}},
+	} {
+		repoRouter.Register(v)
+	}
+}
+
 // MakePage acts as a multiplexer for the various complex http
-// functions. It handles logging and web error reporting.
-func MakePage(w http.ResponseWriter, req *http.Request, repository string, file string, isFile bool) {
+// functions. It handles logging and web error reporting. Directories
+// which are not repositories are listed, and repositories are shown by
+// the view which the route selects.
+func MakePage(w http.ResponseWriter, req *http.Request, repository string, route Route) {
+	file := route.Arg
+	ctx, span := tracer.Start(req.Context(), "MakePage", trace.WithAttributes(
+		attribute.String("grove.repository", repository),
+		attribute.String("grove.view", route.View.Name),
+		attribute.String("grove.file", file)))
+	defer span.End()
+	req = req.WithContext(ctx)
+
 	g := &git{
 		Path: repository,
+		ctx:  ctx,
 	}
 	// First, establish the template and fill out some of the gitPage.
 	pageinfo := &gitPage{
 		Prefix:     prefix,
 		Owner:      gitVarUser(),
 		InRepoPath: path.Join(path.Base(repository), file),
-		Path:       repository[len(handler.Dir):] + "/", // Path without in-git
+		Path:       relPath(repository) + "/", // Path without in-git
 		Version:    Version,
+		Nonce:      requestNonce(req),
+		ctx:        ctx,
+		state:      loaded(),
 	}
-	if len(*fHost) > 0 {
-		pageinfo.RootLink = "http://" + *fHost
-	} else {
-		pageinfo.RootLink = "http://" + req.Host
-	}
+	pageinfo.RootLink = rootLink(req)
 	pageinfo.URL = prefix + strings.TrimRight(
 		req.URL.Path, "/") + "/" // Full URL with assured trailing slash
 
@@ -112,140 +474,381 @@ func MakePage(w http.ResponseWriter, req *http.Request, repository string, file
 	var maxCommits int
 	git, gitDir := isGit(repository)
 	if git {
-		// ref is the git commit reference. If the form is not submitted,
-		// (or is invalid), it is set to "HEAD".
+		// ref is the git commit reference, which may be any
+		// expression understood by git rev-parse, such as HEAD~3 or
+		// main@{2.weeks.ago}. It is resolved to a SHA here, so that it
+		// names the same commit throughout the page, but ranges are
+		// left as they are. If the form is not submitted, (or is
+		// invalid), it is set to "HEAD".
 		ref = req.FormValue("ref")
-		if len(ref) == 0 || !g.RefExists(ref) {
+		if sha := g.ResolveCommit(ref); len(sha) > 0 {
+			ref = sha
+		} else if len(ref) == 0 || !validRef(g, ref) {
 			ref = "HEAD" // The commit or branch reference
 		}
 
-		// The form value since is just a shortcut for
-		// "?ref=<ref>..<since>", so we check it here. Note that the
-		// results will include <ref> and exclude <since>.
-		if since := req.FormValue("since"); g.RefExists(since) {
+		// The form values since and until are shortcuts for
+		// "?ref=<since>..<until>", so we check them here. Note that
+		// the results will include <until> and exclude <since>. If
+		// until is not given, ref is the end of the range. Refs which
+		// don't exist are reported, rather than showing a range which
+		// wasn't asked for.
+		since, until := req.FormValue("since"), req.FormValue("until")
+		if (len(since) > 0 && !validRef(g, since)) ||
+			(len(until) > 0 && !validRef(g, until)) {
+			reqLog(req).Debugf("Invalid range %q..%q from %q\n",
+				since, until, req.RemoteAddr)
+			Error(w, http.StatusBadRequest)
+			return
+		}
+		if len(until) > 0 {
+			ref = until
+		}
+		if len(since) > 0 {
 			ref = since + ".." + ref
 		}
 
 		// maxCommits is the maximum number of commits to be loaded via
 		// the log.
-		var err error
-		maxCommits, err = strconv.Atoi(req.FormValue("c"))
-		if err != nil {
-			maxCommits = 10
-		}
+		maxCommits = pageinfo.state.conf.Commits(req.FormValue("c"), pageinfo.state.conf.DefaultCommits)
+		pageinfo.emails = pageinfo.state.conf.RepoEmailPrivacy(relPath(repository))
 
 		// Now, switch to using the API if it is requested. We access
 		// req.Form directly because the form can be empty. (In this
 		// case, we would fall back to checking the Accept field in
 		// the header.)
 		if _, useAPI := req.Form["api"]; useAPI {
-			err = ServeAPI(w, req, g, ref, maxCommits)
+			err := ServeAPI(w, req, g, ref, maxCommits, pickaxeOptions(req))
 			if err != nil {
-				l.Errf("API request %q from %q failed: %s",
+				reqLog(req).Errf("API request %q from %q failed: %s",
 					req.URL, req.RemoteAddr, err)
 			} else {
-				l.Debugf("API request %q from %q\n",
+				reqLog(req).Debugf("API request %q from %q\n",
 					req.URL, req.RemoteAddr)
 			}
 			return
 		}
 
-		pageinfo.Branch = g.Branch("HEAD")
-		pageinfo.TagNum = strconv.Itoa(len(g.Tags()))
-		pageinfo.CommitNum = strconv.Itoa(g.TotalCommits())
-		pageinfo.SHA = g.SHA(ref)
+		// The details shown at the top of every page of the
+		// repository are independent, so they are found concurrently.
+		// The numbers of tags and commits are slow to find in large
+		// repositories, and so they are only counted if the page
+		// shows them.
+		var wg sync.WaitGroup
+		for _, query := range []func(){
+			func() { pageinfo.Branch = g.Branch("HEAD") },
+			func() { pageinfo.SHA = g.SHA(ref) },
+			func() { pageinfo.RepoLogo = repoLogo(pageinfo, g) },
+		} {
+			wg.Add(1)
+			go func(query func()) {
+				defer wg.Done()
+				query()
+			}(query)
+		}
+		pageinfo.counts = &repoCounts{g: g}
 		pageinfo.GitDir = gitDir
+		pageinfo.CloneURLs = cloneURLs(pageinfo, repository)
+		pageinfo.Topics = repoTopics(repository)
+		wg.Wait()
+	}
+
+	if git && notModified(w, req, pageinfo, g, route, repository, ref) {
+		reqLog(req).Debugf("View of %q from %q not modified\n",
+			req.URL.Path, req.RemoteAddr)
+		return
 	}
 
-	// TODO: all of the below case blocks may misbehave if the URL
-	// contains a keyword.
 	var err error
 	var status int
-	switch {
-	case !git:
-		// This will catch all non-git cases, eliminating the need for
-		// them below.
-		err, status = MakeDirPage(w, pageinfo, repository)
-	case strings.Contains(req.URL.Path, "/tree/"):
-		// This will catch cases needing to serve directories within
-		// git repositories.
-		err, status = MakeTreePage(w, pageinfo, g, ref, file)
-	case strings.Contains(req.URL.Path, "/blob/"):
-		// This will catch cases needing to serve files.
-		err, status = MakeFilePage(w, pageinfo, g, ref, file)
-	case strings.Contains(req.URL.Path, "/raw/"):
-		// This will catch cases needing to serve files directly.
-		err, status = MakeRawPage(w, file, ref, g)
-	case git:
-		// This will catch cases serving the main page of a repository
-		// directory. This needs to be last because the above cases
-		// for "tree" and "blob" will also have `git` as true.
-		err, status = MakeGitPage(w, pageinfo, g, ref, file, maxCommits)
+	if !git {
+		pageinfo.Sort = req.FormValue("sort")
+		err, status = MakeDirPage(w, pageinfo, repository,
+			strings.ToLower(req.FormValue("topic")))
+	} else {
+		err, status = route.View.Make(&ViewRequest{
+			w:          w,
+			req:        req,
+			pageinfo:   pageinfo,
+			g:          g,
+			repository: repository,
+			ref:        ref,
+			arg:        file,
+			maxCommits: maxCommits,
+		})
 	}
 
 	// If an error was encountered, ensure that an error page is
 	// displayed, then close the connection and return.
 	if err != nil {
-		l.Errf("View of %q from %q caused error: %s",
+		reqLog(req).Errf("View of %q from %q caused error: %s",
 			req.URL.Path, req.RemoteAddr, err)
 		Error(w, status)
 	} else {
-		l.Debugf("View of %q from %q\n",
+		reqLog(req).Debugf("View of %q from %q\n",
 			req.URL.Path, req.RemoteAddr)
 	}
 }
 
+// rootLink returns the URL at which the top level of Grove is reached
+// by visitors, without a trailing slash.
+func rootLink(req *http.Request) string {
+	if len(conf().ExternalURL) > 0 {
+		return strings.TrimRight(conf().ExternalURL, "/")
+	}
+	scheme := "http://"
+	if req.TLS != nil {
+		scheme = "https://"
+	}
+	if len(conf().Host) > 0 {
+		return scheme + conf().Host
+	}
+	return scheme + req.Host
+}
+
+// cloneURLs lists the URLs from which the repository can be cloned.
+// The first is always the HTTP(S) URL served by Grove, and the second,
+// if the SSHHost setting is present, is an SSH URL.
+func cloneURLs(pageinfo *gitPage, repository string) (urls []*dirList) {
+	scheme := "HTTP"
+	if strings.HasPrefix(pageinfo.RootLink, "https://") {
+		scheme = "HTTPS"
+	}
+	urls = append(urls, &dirList{
+		Name: scheme,
+		URL:  template.URL(pageinfo.RootLink + pageinfo.Path + pageinfo.GitDir),
+	})
+
+	if len(conf().SSHHost) > 0 {
+		// If SSHRoot is set, it is where the served directories are
+		// found on the SSH host, merged as they are here. Otherwise,
+		// the repository is assumed to be at the same path.
+		p := repository
+		if root := rootOf(repository); len(conf().SSHRoot) > 0 && isWithin(root, repository) {
+			p = path.Join(conf().SSHRoot, strings.TrimPrefix(repository, root))
+		}
+		urls = append(urls, &dirList{
+			Name: "SSH",
+			URL:  template.URL(conf().SSHHost + ":" + p),
+		})
+	}
+	return
+}
+
+// executeTemplate renders the named template with the page, tracing
+// it as part of the page's request. The page is rendered completely
+// before any of it is written, so that if the template fails, nothing
+// has been sent and an error page can be shown in its place.
+func executeTemplate(w http.ResponseWriter, name string, pageinfo *gitPage) (err error) {
+	buf, err := renderTemplate(name, pageinfo)
+	if err != nil {
+		return err
+	}
+	writePage(w, http.StatusOK, buf)
+	return nil
+}
+
+// renderTemplate renders the named template with the page into a
+// buffer. With --dev, the templates are read from disk again first, so
+// that changes to them are seen without restarting.
+func renderTemplate(name string, pageinfo *gitPage) (buf *bytes.Buffer, err error) {
+	if pageinfo.ctx != nil {
+		_, span := tracer.Start(pageinfo.ctx, "template "+name)
+		defer func() { endSpan(span, err) }()
+	}
+	s := pageinfo.state
+	if s == nil {
+		s = loaded()
+	}
+	tmpl := s.t
+	if s.conf.Dev {
+		if tmpl, err = getTemplate(s.conf); err != nil {
+			return nil, err
+		}
+	}
+	pageinfo.hideEmails()
+	buf = new(bytes.Buffer)
+	if err = tmpl.ExecuteTemplate(buf, name, pageinfo); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// writePage writes a rendered page to the connection with the given
+// status. Errors in writing it are only logged, because they mean
+// that the client has already gone away.
+func writePage(w http.ResponseWriter, status int, buf *bytes.Buffer) {
+	// The Content-Type must be set before the header is written,
+	// because it cannot be detected later through gzipHandler.
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if _, err := buf.WriteTo(w); err != nil {
+		l.Debugf("Page could not be written: %s\n", err)
+	}
+}
+
 // Error reports an error of the given status to the given http
 // connection using http.StatusText().
 func Error(w http.ResponseWriter, status int) {
+	// Errors are not the page which the validators describe.
+	w.Header().Del("ETag")
+	w.Header().Del("Last-Modified")
+
 	pageinfo := &gitPage{
-			Owner:      gitVarUser(),
-			Status:     strconv.Itoa(status)+" - "+http.StatusText(status),
-			Version:    Version,
-		}
-		
-	t.ExecuteTemplate(w, "error.html", pageinfo)
+		Prefix:    prefix,
+		Owner:     gitVarUser(),
+		Status:    strconv.Itoa(status) + " - " + http.StatusText(status),
+		RequestID: w.Header().Get(requestIDHeader),
+		Version:   Version,
+	}
+
+	buf, err := renderTemplate("error.html", pageinfo)
+	if err != nil {
+		// If even the error page cannot be rendered, fall back to
+		// plain text.
+		l.Errf("Error page failed to render: %s\n", err)
+		http.Error(w, pageinfo.Status, status)
+		return
+	}
+	writePage(w, status, buf)
 }
 
-func MakeAboutPage(w http.ResponseWriter) {
+func MakeAboutPage(w http.ResponseWriter, req *http.Request) {
 	pageinfo := &gitPage{
-		Owner:      gitVarUser(),
-		Version:    Version,
+		Prefix:  prefix,
+		Owner:   gitVarUser(),
+		Version: Version,
+		Nonce:   requestNonce(req),
 	}
-	
-	t.ExecuteTemplate(w, "about.html", pageinfo)
+
+	executeTemplate(w, "about.html", pageinfo)
 }
 
 // MakeRawPAge makes the raw page of which the files are shown as
-// completely raw files.
-func MakeRawPage(w http.ResponseWriter, file, ref string, g *git) (err error, status int) {
+// completely raw files. If download is true, the file is sent as an
+// attachment, so that browsers save it rather than showing it.
+func MakeRawPage(w http.ResponseWriter, file, ref string, g *git, download bool) (err error, status int) {
 	f := g.GetFile(ref, file)
 	if len(f) == 0 {
 		// If the file is not retrieved from git, return the error.
 		return notFound, http.StatusNotFound
 	}
+	if download {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType(
+			"attachment", map[string]string{"filename": path.Base(file)}))
+	}
 	// If it is found, write the contents to the connection directly.
 	w.Write(f)
 	return
 }
 
+// MakeArchive serves an archive of the repository at a ref. The file
+// is the ref followed by one of the extensions in archiveFormats, such
+// as "v1.0.tar.gz", or by a directory within the repository and then
+// the extension, such as "v1.0/src/vendor.tar.gz", to include only
+// that directory. The archive contains a single directory named as
+// the archive is, by archiveName.
+func MakeArchive(w http.ResponseWriter, g *git, name, file string) (err error, status int) {
+	var rest, ext string
+	for e := range archiveFormats {
+		if strings.HasSuffix(file, e) && len(e) > len(ext) {
+			rest, ext = strings.TrimSuffix(file, e), e
+		}
+	}
+	if len(ext) == 0 {
+		return notFound, http.StatusNotFound
+	}
+	ref, dir, ok := splitArchiveRef(g, rest)
+	if !ok {
+		return notFound, http.StatusNotFound
+	}
+
+	base := archiveName(g, name, ref)
+	var paths []string
+	if len(dir) > 0 {
+		base += "-" + strings.Replace(dir, "/", "-", -1)
+		paths = []string{dir}
+	}
+	w.Header().Set("Content-Type", archiveFormats[ext][1])
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(
+		"attachment", map[string]string{"filename": base + ext}))
+	if err = g.Archive(throttle(w), ref, archiveFormats[ext][0], base, paths...); err != nil {
+		// The headers have already been sent, so there is no way to
+		// report the error to the client.
+		return err, http.StatusInternalServerError
+	}
+	return
+}
+
+// archiveName names an archive of the repository at ref, without its
+// extension, by filling in the ArchiveName setting. Slashes in the ref
+// are replaced with dashes, and an extension in the setting is
+// dropped, as the one requested is used instead.
+func archiveName(g *git, repo, ref string) string {
+	sha := g.FullSHA(ref)
+	// {tag} is the ref if it names a tag, and otherwise the tag at
+	// the commit, or a description relative to the most recent tag,
+	// falling back to an abbreviated SHA if there are none.
+	tag := ref
+	if !g.RefExists("refs/tags/" + ref) {
+		tag, _ = g.execute("describe", "--tags", "--always",
+			"--abbrev="+strconv.Itoa(shortSHALength), sha)
+		tag = strings.TrimRight(tag, "\n")
+	}
+	name := strings.NewReplacer(
+		"{repo}", repo,
+		"{ref}", ref,
+		"{tag}", tag,
+		"{sha}", sha,
+		"{shortsha}", shortSHA(sha),
+	).Replace(conf().ArchiveName)
+	for ext := range archiveFormats {
+		name = strings.TrimSuffix(name, ext)
+	}
+	return strings.Replace(name, "/", "-", -1)
+}
+
+// splitArchiveRef splits the name of an archive, without its
+// extension, into a ref and a directory within the repository. Refs
+// may contain slashes too, so the longest leading part which names a
+// ref is used, and the remainder must be a directory at that ref.
+func splitArchiveRef(g *git, s string) (ref, dir string, ok bool) {
+	for i := len(s); i > 0; i = strings.LastIndex(s[:i], "/") {
+		ref, dir = s[:i], strings.Trim(s[i:], "/")
+		if !validRef(g, ref) {
+			continue
+		}
+		if len(dir) == 0 {
+			return ref, "", true
+		}
+		if strings.HasPrefix(dir, "-") {
+			return "", "", false
+		}
+		_, objType := g.ObjectAt(ref, dir)
+		return ref, dir, objType == "tree"
+	}
+	return "", "", false
+}
+
 // MakeDirPage makes filesystem directory listings, which are not
 // contained within git projects. It writes the webpage to the
 // provided http.ResponseWriter.
-func MakeDirPage(w http.ResponseWriter, pageinfo *gitPage, directory string) (err error, status int) {
+func MakeDirPage(w http.ResponseWriter, pageinfo *gitPage, directory, topic string) (err error, status int) {
 
 	// First, check the permissions of the file to be displayed.
-	fi, err := os.Stat(directory)
+	fi, err := index.Stat(directory)
 	if err != nil {
 		return err, http.StatusNotFound
 	}
-	if !CheckPerms(fi) {
+	if !CheckPerms(directory, fi) {
 		return forbidden, http.StatusForbidden
 	}
 	// We only get beyond this point if we are allowed to serve the
 	// directory.
 
 	// We begin the template here so that we can fill it out.
+	pageinfo.Crumbs = breadcrumbs(pageinfo.Path)
 
 	pageinfo.List = make([]*dirList, 0, 2)
 	if pageinfo.Path != "/" {
@@ -261,29 +864,90 @@ func MakeDirPage(w http.ResponseWriter, pageinfo *gitPage, directory string) (er
 			})
 	}
 
-	// Open the file so that it can be read.
-	f, err := os.Open(directory)
-	if err != nil {
-		return err, http.StatusNotFound
+	// If the directory is indexed, list its subdirectories from the
+	// index, along with the descriptions and tips of repositories.
+	// Files are not listed, as they can't be viewed outside of a
+	// repository.
+	if entry, ok := index.Lookup(directory); ok && entry.Scanned {
+		// If a topic is given, list every repository within the
+		// directory which has it, rather than the subdirectories.
+		if len(topic) > 0 {
+			list := reposWithin(directory, topic)
+			sortDirList(list, pageinfo.Sort)
+			pageinfo.Topic = topic
+			pageinfo.List = append(pageinfo.List, list...)
+			pageinfo.Topics = allTopics(list)
+			return executeTemplate(w, "dir.html", pageinfo),
+				http.StatusInternalServerError
+		}
+
+		// Subdirectories which contain repositories, rather than being
+		// repositories themselves, are shown as groups listing those
+		// repositories, so that nested namespaces can be seen at a
+		// glance. Each links to its own page.
+		// The top level lists those of every served directory.
+		var all []*dirList
+		children := make([]string, 0, len(entry.Children))
+		for _, n := range entry.Children {
+			children = append(children, directory+"/"+n)
+		}
+		if directory == handler.Dir {
+			children = rootChildren()
+		}
+		dirbuf := make([]*dirList, 0, len(children))
+		for _, p := range children {
+			n := path.Base(p)
+			child, ok := index.Lookup(p)
+			if !ok || !CheckPerms(p, child.Info) {
+				continue
+			}
+			item := &dirList{
+				URL:  template.URL(prefix + pageinfo.Path + n + "/"),
+				Name: n,
+			}
+			if child.Repo != nil {
+				item.Description = child.Repo.Description
+				item.Tip = child.Repo.Tip
+				item.Topics = repoTopics(p)
+				item.Updated = child.Repo.Updated
+			} else if repos := reposWithin(p, ""); len(repos) > 0 {
+				sortDirList(repos, pageinfo.Sort)
+				all = append(all, repos...)
+				group := &repoGroup{Name: n, URL: item.URL, Repos: repos}
+				if len(repos) > groupRepos {
+					group.Repos, group.More = repos[:groupRepos], len(repos)-groupRepos
+				}
+				pageinfo.Groups = append(pageinfo.Groups, group)
+				continue
+			}
+			dirbuf = append(dirbuf, item)
+		}
+		sortDirList(dirbuf, pageinfo.Sort)
+		pageinfo.List = append(pageinfo.List, dirbuf...)
+		pageinfo.Topics = allTopics(append(all, dirbuf...))
+		if directory == handler.Dir {
+			pageinfo.Pinned = pinnedList()
+		}
+		return executeTemplate(w, "dir.html", pageinfo),
+			http.StatusInternalServerError
 	}
 
 	// To list the directory properly, we have to do it in two
 	// steps. First, retrieve the names, then perform os.Stat() on the
 	// result. This is so that simlinks are followed. We will also
 	// check file permissions.
-	dirnames, err := f.Readdirnames(0)
-	f.Close()
+	children, err := listDir(directory)
 	if err != nil {
-		return err, http.StatusInternalServerError
+		return err, http.StatusNotFound
 	}
 	// We have the directory names; go on to calling os.Stat() and
 	// checking their permissions. If they should be listed, add
 	// them to a buffer, then append that to the dirlist at the
 	// end.
-	dirbuf := make([]*dirList, 0, len(dirnames))
-	for _, n := range dirnames {
-		info, err := os.Stat(directory + "/" + n)
-		if err == nil && CheckPerms(info) {
+	dirbuf := make([]*dirList, 0, len(children))
+	for _, p := range children {
+		info, err := os.Stat(p)
+		if err == nil && CheckPerms(p, info) {
 			dirbuf = append(dirbuf, &dirList{
 				URL: template.URL(prefix + pageinfo.Path +
 					info.Name() + "/"),
@@ -292,23 +956,37 @@ func MakeDirPage(w http.ResponseWriter, pageinfo *gitPage, directory string) (er
 
 		}
 	}
+	sortDirList(dirbuf, SortName)
 	pageinfo.List = append(pageinfo.List, dirbuf...)
 
 	// We return 500 here because the error will only be reported
-	// if t.ExecuteTemplate() results in an error.
-	return t.ExecuteTemplate(w, "dir.html", pageinfo),
+	// if executeTemplate() results in an error.
+	return executeTemplate(w, "dir.html", pageinfo),
 		http.StatusInternalServerError
 }
 
-// MakeFilePage shows the contents of a file within a git project. It
-// writes the webpage to the provided http.ResponseWriter.
-func MakeFilePage(w http.ResponseWriter, pageinfo *gitPage, g *git, ref string, file string) (err error, status int) {
+// MakeFilePage shows the contents of a file within a git project. If
+// the file is markup, (see isMarkup,) and render is true, then it is
+// rendered rather than shown as source, and a link to toggle between
+// the two is provided. It writes the webpage to the provided
+// http.ResponseWriter.
+func MakeFilePage(w http.ResponseWriter, pageinfo *gitPage, g *git, ref string, file string, render, hexdump bool) (err error, status int) {
 	// First we need to get the content,
-	pageinfo.Content = template.HTML(string(g.GetFile(ref, file)))
-	if len(pageinfo.Content) == 0 {
+	contents := g.GetFile(ref, file)
+	if len(contents) == 0 {
 		// If there is no content, return an error.
 		return notFound, http.StatusNotFound
 	}
+	// and convert text to UTF-8 from whatever charset it is in, as
+	// declared in .gitattributes or else as detected.
+	ext := path.Ext(file)
+	image := ext == ".png" || ext == ".jpg" || ext == ".jpeg" || ext == ".gif"
+	var charset string
+	if !image {
+		declared, hint := g.TextAttributes(tipOf(ref), file)
+		contents, charset = decodeText(contents, declared, hint)
+	}
+	pageinfo.Content = template.HTML(string(contents))
 	// then we need to figure out how many lines there are.
 	lines := strings.Count(string(pageinfo.Content), "\n")
 	// For each of the lines, we want to prepend
@@ -320,16 +998,56 @@ func MakeFilePage(w http.ResponseWriter, pageinfo *gitPage, g *git, ref string,
 	temp_html := ""
 	temp_content := strings.SplitAfter(string(pageinfo.Content), "\n")
 
+	// Set up the link to toggle rendering, keeping the rest of the
+	// query intact so that it persists.
+	// .gitmodules is rendered as a table of the submodules it
+	// declares.
+	gitmodules := file == ".gitmodules"
+	if pageinfo.Markup = isMarkup(file) || gitmodules; pageinfo.Markup {
+		if render {
+			pageinfo.Toggle = setQuery(pageinfo.Query, "render", "0")
+		} else {
+			pageinfo.Toggle = setQuery(pageinfo.Query, "render", "1")
+		}
+	}
+
+	pageinfo.Download = setQuery(pageinfo.Query, "download", "1")
+	pageinfo.Blob = makeBlobInfo(pageinfo, g, ref, file,
+		[]byte(pageinfo.Content))
+	pageinfo.Blob.Charset = charset
+
 	// Image support
-	if extention := path.Ext(file); extention == ".png" ||
-		extention == ".jpg" ||
-		extention == ".jpeg" ||
-		extention == ".gif" {
-
-		var image []byte = []byte(pageinfo.Content)
-		img := base64.StdEncoding.EncodeToString(image)
-		temp_html = "<img src=\"data:image/" + strings.TrimLeft(extention, ".") + ";base64," + img + "\"/>"
+	if pageinfo.Markup && render {
+		pageinfo.Rendered = true
+		if gitmodules {
+			pageinfo.Submodules = g.Submodules(ref,
+				strings.TrimSuffix(pageinfo.Path, "/"))
+		} else {
+			temp_html = string(renderMarkup(file, []byte(pageinfo.Content)))
+		}
+	} else if image {
+		img := base64.StdEncoding.EncodeToString([]byte(pageinfo.Content))
+		temp_html = "<img src=\"data:image/" + strings.TrimLeft(ext, ".") + ";base64," + img + "\"/>"
+	} else if isBinary([]byte(pageinfo.Content)) {
+		// Binary files aren't shown as text. Small ones may be viewed
+		// as a hex dump instead, with offsets and the printable
+		// characters alongside.
+		pageinfo.Binary = true
+		pageinfo.Size = len(pageinfo.Content)
+		if pageinfo.Size <= maxHexdumpSize {
+			pageinfo.Toggle = setQuery(pageinfo.Query, "hex", "1")
+			if hexdump {
+				pageinfo.Hexdump = true
+				pageinfo.Toggle = setQuery(pageinfo.Query, "hex", "")
+				temp_html = html.EscapeString(hex.Dump([]byte(pageinfo.Content)))
+			}
+		}
 	} else {
+		// Tabs are shown at the width set by the repository's
+		// .editorconfig files, if any.
+		if pageinfo.TabWidth = g.TabWidth(ref, file); pageinfo.TabWidth == 0 {
+			pageinfo.TabWidth = defaultTabWidth
+		}
 		for j := 1; j <= lines+1; j++ {
 			temp_html += "<div id=\"L-" + strconv.Itoa(j) + "\">" +
 				html.EscapeString(temp_content[j-1]) + "</div>"
@@ -339,60 +1057,569 @@ func MakeFilePage(w http.ResponseWriter, pageinfo *gitPage, g *git, ref string,
 	}
 
 	pageinfo.Content = template.HTML(temp_html)
+	pageinfo.Lines = template.HTML(temp)
+
+	// We return 500 here because the error will only be reported
+	// if executeTemplate() results in an error.
+	return executeTemplate(w, "file.html", pageinfo),
+		http.StatusInternalServerError
+
+}
+
+// isBinary guesses whether the contents of a file are binary, rather
+// than text, in the same way as git: by looking for a NUL byte near the
+// beginning.
+func isBinary(contents []byte) bool {
+	if len(contents) > binarySniffLength {
+		contents = contents[:binarySniffLength]
+	}
+	return bytes.IndexByte(contents, 0) >= 0
+}
+
+// setQuery returns the query with the given key set to the value, or
+// removed if the value is empty, keeping the rest of it intact.
+func setQuery(q template.URL, key, value string) template.URL {
+	query, _ := url.ParseQuery(strings.TrimPrefix(string(q), "?"))
+	if len(value) > 0 {
+		query.Set(key, value)
+	} else {
+		query.Del(key)
+	}
+	if len(query) == 0 {
+		return "?"
+	}
+	return template.URL("?" + query.Encode())
+}
+
+// pickaxeOptions parses the pickaxe given in the request: S (or
+// pickaxe) for a string whose occurrences were added or removed, G for
+// a regular expression matching changed lines, and path to limit
+// either to a path.
+func pickaxeOptions(req *http.Request) Pickaxe {
+	p := Pickaxe{
+		S:    req.FormValue("S"),
+		G:    req.FormValue("G"),
+		Path: req.FormValue("path"),
+	}
+	if len(p.S) == 0 {
+		p.S = req.FormValue("pickaxe")
+	}
+	return p
+}
+
+// diffOptions parses the diff options given in the request: w=1 to
+// ignore whitespace, and blank=1 to ignore blank lines.
+func diffOptions(req *http.Request) DiffOptions {
+	return DiffOptions{
+		IgnoreWhitespace: req.FormValue("w") == "1",
+		IgnoreBlankLines: req.FormValue("blank") == "1",
+	}
+}
+
+// makeDiffStat summarizes the numbers of lines added and removed in
+// each file. The bars are scaled so that the file with the most
+// changes fills the whole bar.
+func makeDiffStat(files []*DiffFile) (stat *diffStat) {
+	stat = &diffStat{Files: make([]*diffStatFile, len(files))}
+	most := 0
+	for _, f := range files {
+		if changes := f.Additions + f.Deletions; changes > most {
+			most = changes
+		}
+	}
+	for n, f := range files {
+		name := f.NewPath
+		if name == "/dev/null" {
+			name = f.OldPath
+		}
+		stat.Files[n] = &diffStatFile{
+			Name:      name,
+			Anchor:    "diff-" + strconv.Itoa(n),
+			Binary:    f.Binary,
+			Additions: f.Additions,
+			Deletions: f.Deletions,
+		}
+		if most > 0 {
+			stat.Files[n].AddWidth = f.Additions * 100 / most
+			stat.Files[n].DelWidth = f.Deletions * 100 / most
+		}
+		stat.Additions += f.Additions
+		stat.Deletions += f.Deletions
+	}
+	return
+}
+
+// diffSplit determines whether diffs should be shown side by side.
+// The layout is chosen with ?view=split or ?view=unified, and is
+// remembered with a cookie for later requests which do not specify
+// it.
+func diffSplit(w http.ResponseWriter, req *http.Request) bool {
+	view := req.FormValue("view")
+	switch view {
+	case "split", "unified":
+		http.SetCookie(w, &http.Cookie{
+			Name:   diffCookie,
+			Value:  view,
+			Path:   prefix + "/",
+			MaxAge: 365 * 24 * 60 * 60,
+		})
+	default:
+		if c, err := req.Cookie(diffCookie); err == nil {
+			view = c.Value
+		}
+	}
+	return view == "split"
+}
+
+// diffLinks creates links to toggle each of the diff options and the
+// layout, keeping the rest of the query intact.
+func diffLinks(q template.URL, opts DiffOptions, split bool) []*dirList {
+	toggle := func(on bool, key, name string) *dirList {
+		if on {
+			return &dirList{URL: setQuery(q, key, ""),
+				Name: "Show " + name}
+		}
+		return &dirList{URL: setQuery(q, key, "1"),
+			Name: "Ignore " + name}
+	}
+	layout := &dirList{URL: setQuery(q, "view", "split"),
+		Name: "Side-by-side view"}
+	if split {
+		layout = &dirList{URL: setQuery(q, "view", "unified"),
+			Name: "Unified view"}
+	}
+	return []*dirList{
+		toggle(opts.IgnoreWhitespace, "w", "whitespace"),
+		toggle(opts.IgnoreBlankLines, "blank", "blank lines"),
+		layout,
+	}
+}
+
+// MakeCommitPage shows a single commit, along with the changes it
+// introduced, and links to its parents. For merges, the changes are
+// shown as a combined diff against every parent, unless parent gives
+// the number of one of them, starting from 1, to show the diff
+// against that parent alone. It writes the webpage to the provided
+// http.ResponseWriter.
+func MakeCommitPage(w http.ResponseWriter, pageinfo *gitPage, g *git, sha string, parent int, opts DiffOptions) (err error, status int) {
+	commits := g.Commits(sha, 1)
+	if len(commits) == 0 || len(commits[0].SHA) == 0 {
+		return notFound, http.StatusNotFound
+	}
+	pageinfo.Commit = makeLog(commits[0], pageinfo.Owner)
+	markReplaced(g, pageinfo.Commit)
+
+	// Trailers, such as Signed-off-by, are shown separately from the
+	// rest of the message, so that people and commits can be linked.
+	body, trailers := parseTrailers(commits[0].Body)
+	pageinfo.Commit.Body = template.HTML(strings.Replace(
+		html.EscapeString(body), "\n", "<br/>", -1))
+	pageinfo.Commit.Trailers = trailers
+
+	parents := g.Parents(commits[0].SHA)
+	for n, p := range parents {
+		link := &parentLink{SHA: p}
+		if c := g.Commits(p, 1); len(c) > 0 {
+			link.Subject = c[0].Subject
+		}
+		if len(parents) > 1 {
+			link.Diff = setQuery(pageinfo.Query, "parent", strconv.Itoa(n+1))
+			link.Selected = parent == n+1
+		}
+		pageinfo.Parents = append(pageinfo.Parents, link)
+	}
+	if len(parents) > 1 && parent >= 1 && parent <= len(parents) {
+		pageinfo.Diff = g.Diff(parents[parent-1], commits[0].SHA, false, opts)
+	} else {
+		pageinfo.Diff = g.CommitDiff(commits[0].SHA, opts)
+		parent = 0
+	}
+	if len(parents) > 1 {
+		pageinfo.Combined = &parentLink{
+			Diff:     setQuery(pageinfo.Query, "parent", ""),
+			Selected: parent == 0,
+		}
+	}
+	pageinfo.DiffStat = makeDiffStat(pageinfo.Diff)
+	pageinfo.DiffLinks = diffLinks(pageinfo.Query, opts, pageinfo.Split)
+
+	// We return 500 here because the error will only be reported
+	// if executeTemplate() results in an error.
+	return executeTemplate(w, "commit.html", pageinfo),
+		http.StatusInternalServerError
+}
+
+// MakeComparePage shows the changes between two commits. The range is
+// given as "<from>...<to>" to compare against their merge base, or
+// "<from>..<to>" to compare them directly. It writes the webpage to
+// the provided http.ResponseWriter.
+func MakeComparePage(w http.ResponseWriter, pageinfo *gitPage, g *git, spec string, opts DiffOptions) (err error, status int) {
+	mergeBase := strings.Contains(spec, "...")
+	refs := strings.SplitN(strings.Replace(spec, "...", "..", 1), "..", 2)
+	if len(refs) != 2 || !validRef(g, refs[0]) || !validRef(g, refs[1]) {
+		return notFound, http.StatusNotFound
+	}
+	pageinfo.Compare = spec
+	pageinfo.Diff = g.Diff(refs[0], refs[1], mergeBase, opts)
+	pageinfo.DiffStat = makeDiffStat(pageinfo.Diff)
+	pageinfo.DiffLinks = diffLinks(pageinfo.Query, opts, pageinfo.Split)
 
 	// We return 500 here because the error will only be reported
-	// if t.ExecuteTemplate() results in an error.
-	return t.ExecuteTemplate(w, "file.html", pageinfo),
+	// if executeTemplate() results in an error.
+	return executeTemplate(w, "commit.html", pageinfo),
 		http.StatusInternalServerError
+}
+
+// isMarkup checks whether the file is in a markup language which can
+// be rendered, based on its extension. This includes those with
+// external renderers.
+func isMarkup(file string) bool {
+	if len(renderer(file)) > 0 {
+		return true
+	}
+	switch strings.ToLower(path.Ext(file)) {
+	case ".md", ".markdown", ".mdown", ".mkd":
+		return true
+	}
+	return false
+}
+
+// renderMarkup renders the contents of a markup file as HTML, using
+// the external renderer for its extension if there is one, and
+// Markdown otherwise. If the external renderer fails, the escaped
+// source is shown instead.
+func renderMarkup(file string, contents []byte) []byte {
+	if len(renderer(file)) > 0 {
+		if rendered, ok := renderExternal(file, contents); ok {
+			return rendered
+		}
+		return []byte("<pre>" + html.EscapeString(string(contents)) + "</pre>")
+	}
+	return renderMarkdown(contents)
+}
+
+// breadcrumbs links to the served directory and to each directory
+// below it leading to the URL path p.
+func breadcrumbs(p string) (crumbs []*dirList) {
+	crumbs = append(crumbs, &dirList{Name: "/", URL: template.URL(prefix + "/")})
+	parts := strings.Split(strings.Trim(p, "/"), "/")
+	for n, part := range parts {
+		if len(part) == 0 {
+			continue
+		}
+		crumbs = append(crumbs, &dirList{
+			Name: part,
+			URL:  template.URL(prefix + "/" + strings.Join(parts[:n+1], "/") + "/"),
+		})
+	}
+	return
+}
+
+// sortDirList sorts a directory listing in place. With SortUpdated,
+// the most recently updated repositories come first, followed by
+// anything whose last update isn't known. Otherwise, or to break ties,
+// it is sorted by name.
+func sortDirList(list []*dirList, by string) {
+	sort.SliceStable(list, func(i, j int) bool {
+		if by == SortUpdated && !list[i].Updated.Equal(list[j].Updated) {
+			return list[i].Updated.After(list[j].Updated)
+		}
+		return list[i].Name < list[j].Name
+	})
+}
+
+// pinnedList lists the repositories named by the Pinned setting which
+// may be served, in the order given, for showing at the top of the
+// index.
+func pinnedList() (list []*dirList) {
+	for _, p := range conf().Pinned {
+		toplevel, repo := locate(path.Clean("/" + p))
+		if git, _ := isGit(repo); !git || !isWithin(toplevel, repo) {
+			continue
+		}
+		if _, _, _, status := SplitRepository(toplevel, repo); status != http.StatusOK ||
+			!listable(handler.Dir, repo) {
+			continue
+		}
+		item := &dirList{
+			URL:    template.URL(prefix + relPath(repo) + "/"),
+			Name:   strings.Trim(p, "/"),
+			Topics: repoTopics(repo),
+		}
+		if entry, ok := index.Lookup(repo); ok && entry.Repo != nil {
+			item.Description = entry.Repo.Description
+			item.Tip = entry.Repo.Tip
+			item.Updated = entry.Repo.Updated
+		}
+		list = append(list, item)
+	}
+	return
+}
 
+// findReadme picks the README from a directory listing, such as
+// README.md or readme.txt, preferring one which can be rendered. It
+// returns an empty string if there is none.
+func findReadme(files []string) (readme string) {
+	for _, f := range files {
+		if strings.HasSuffix(f, "/") ||
+			!strings.HasPrefix(strings.ToUpper(f), "README") {
+			continue
+		}
+		if isMarkup(f) {
+			return f
+		}
+		if len(readme) == 0 {
+			readme = f
+		}
+	}
+	return
 }
 
 // MakeGitPage shows the "front page" that is the main directory of a
 // git reposiory, including the README and a directory listing. It
 // writes the webpage to the provided http.ResponseWriter.
-func MakeGitPage(w http.ResponseWriter, pageinfo *gitPage, g *git, ref, file string, maxCommits int) (err error, status int) {
-	// Parse the log to retrieve the commits.
-	commits := g.Commits(ref, maxCommits)
+func MakeGitPage(w http.ResponseWriter, pageinfo *gitPage, g *git, ref, file string, maxCommits int, pickaxe Pickaxe) (err error, status int) {
+	// Parse the log to retrieve the commits, or only those found by
+	// the pickaxe, if one is given.
+	if pickaxe.Active() {
+		pageinfo.Pickaxe = &pickaxe
+		pageinfo.Logs = makeLogs(g.CommitsPickaxe(ref, maxCommits, pickaxe),
+			pageinfo.Owner)
+	} else if len(file) == 0 {
+		front := g.FrontPage(ref, maxCommits)
+		pageinfo.Logs = makeLogs(front.Commits, pageinfo.Owner)
+		pageinfo.Content = front.Readme
+	} else {
+		pageinfo.Logs = makeLogs(g.Commits(ref, maxCommits), pageinfo.Owner)
+	}
+	markReplaced(g, pageinfo.Logs...)
+
+	if len(file) == 0 {
+		pageinfo.Activity = activityBars(g.Activity())
+		pageinfo.Submodules = g.Submodules(ref,
+			strings.TrimSuffix(pageinfo.Path, "/"))
+		if pickaxe.Active() {
+			pageinfo.Content = g.Readme(ref)
+		}
+	}
+
+	// We return 500 here because the error will only be reported
+	// if executeTemplate() results in an error.
+	return executeTemplate(w, "gitpage.html", pageinfo),
+		http.StatusInternalServerError
+}
 
-	pageinfo.Logs = make([]*gitLog, len(commits))
-	for i, c := range commits {
+// makeLogs prepares the given commits for display in templates. The
+// owner is used to highlight commits made by the owner of the grove
+// instance.
+func makeLogs(commits []*Commit, owner string) (logs []*gitLog) {
+	logs = make([]*gitLog, 0, len(commits))
+	for _, c := range commits {
 		if len(c.SHA) == 0 {
 			// If, for some reason, the commit doesn't have content,
 			// skip it.
 			continue
 		}
-		var classtype string
-		if c.Author == pageinfo.Owner {
-			classtype = "-owner"
+		logs = append(logs, makeLog(c, owner))
+	}
+	return
+}
+
+// makeLog prepares a single commit for display in templates.
+func makeLog(c *Commit, owner string) *gitLog {
+	var classtype string
+	if c.Author == owner {
+		classtype = "-owner"
+	}
+	return &gitLog{
+		Author:    c.Author,
+		Email:     c.Email,
+		Avatar:    avatarURL(c.Email),
+		Classtype: classtype,
+		SHA:       c.SHA,
+		Time:      c.Time,
+		Subject:   template.HTML(html.EscapeString(c.Subject)),
+		Body:      template.HTML(strings.Replace(html.EscapeString(c.Body), "\n", "<br/>", -1)),
+	}
+}
+
+// MakeAuthorPage lists the commits made by the author with the given
+// email address, maxCommits at a time, along with a short summary of
+// their history. It writes the webpage to the provided
+// http.ResponseWriter.
+func MakeAuthorPage(w http.ResponseWriter, pageinfo *gitPage, g *git, ref, email string, maxCommits, page int) (err error, status int) {
+	if maxCommits <= 0 {
+		maxCommits = conf().DefaultCommits
+	}
+	if page < 1 {
+		page = 1
+	}
+
+	count := g.CountByAuthor(ref, email)
+	if count == 0 {
+		return notFound, http.StatusNotFound
+	}
+	pageinfo.Logs = makeLogs(g.CommitsByAuthor(ref, email,
+		maxCommits, (page-1)*maxCommits), pageinfo.Owner)
+
+	pageinfo.Author = &authorSummary{
+		Email:   email,
+		Avatar:  avatarURL(email),
+		Commits: strconv.Itoa(count),
+	}
+	if last := g.CommitsByAuthor(ref, email, 1, 0); len(last) > 0 {
+		pageinfo.Author.Last = makeLog(last[0], pageinfo.Owner)
+		pageinfo.Author.Name = last[0].Author
+	}
+	if first := g.FirstByAuthor(ref, email); first != nil {
+		pageinfo.Author.First = makeLog(first, pageinfo.Owner)
+	}
+
+	// Link to the neighboring pages, if there are any, keeping the
+	// ref and number of commits per page.
+	query := url.Values{"c": {strconv.Itoa(maxCommits)}}
+	if ref != defaultRef {
+		query.Set("ref", ref)
+	}
+	if page > 1 {
+		query.Set("page", strconv.Itoa(page-1))
+		pageinfo.PrevPage = template.URL("?" + query.Encode())
+	}
+	if page*maxCommits < count {
+		query.Set("page", strconv.Itoa(page+1))
+		pageinfo.NextPage = template.URL("?" + query.Encode())
+	}
+
+	// We return 500 here because the error will only be reported
+	// if executeTemplate() results in an error.
+	return executeTemplate(w, "author.html", pageinfo),
+		http.StatusInternalServerError
+}
+
+// MakeTagPage shows the tag with the given name, including the
+// tagger, the annotation as Markdown, the status of its signature, and
+// links to the commit it points to and to archives. It writes the
+// webpage to the provided http.ResponseWriter.
+func MakeTagPage(w http.ResponseWriter, pageinfo *gitPage, g *git, name string) (err error, status int) {
+	tag := g.Tag(name)
+	if tag == nil {
+		return notFound, http.StatusNotFound
+	}
+
+	pageinfo.Tag = &tagInfo{
+		Name:       tag.Name,
+		Annotated:  tag.Annotated,
+		SHA:        tag.SHA,
+		Target:     tag.Target,
+		Tagger:     tag.Tagger,
+		Avatar:     avatarURL(tag.Email),
+		Time:       tag.Time,
+		Signed:     tag.SigStatus != sigNone,
+		SigStatus:  tag.SigStatus,
+		SigMessage: tag.SigMessage,
+	}
+	if tag.Annotated {
+		pageinfo.Tag.Annotation = template.HTML(renderMarkdown(
+			[]byte(tag.Subject + "\n\n" + tag.Body)))
+	}
+	for _, ext := range archiveExts {
+		pageinfo.Tag.Archives = append(pageinfo.Tag.Archives,
+			&archiveLink{
+				URL:  template.URL(prefix + pageinfo.Path + "archive/" + tag.Name + ext),
+				Name: path.Base(pageinfo.Path) + "-" + strings.Replace(tag.Name, "/", "-", -1) + ext,
+			})
+	}
+
+	// We return 500 here because the error will only be reported
+	// if executeTemplate() results in an error.
+	return executeTemplate(w, "tag.html", pageinfo),
+		http.StatusInternalServerError
+}
+
+// MakeBranchesPage lists the branches in the repository, along with
+// how far ahead of and behind the default branch (that is, the one
+// HEAD refers to) they are, and marks those which are merged into the
+// default branch. If stale is true, then the branches are ordered
+// from the least to the most recently committed to, so that branches
+// which may need pruning are listed first. It writes the webpage to
+// the provided http.ResponseWriter.
+func MakeBranchesPage(w http.ResponseWriter, pageinfo *gitPage, g *git, stale bool) (err error, status int) {
+	def := g.Branch(defaultRef)
+	defSHA := g.FullSHA(defaultRef)
+	branches := g.Branches(def)
+	if len(branches) == 0 {
+		return notFound, http.StatusNotFound
+	}
+	if stale {
+		// Branches are retrieved most recent first, so reverse them.
+		for i, j := 0, len(branches)-1; i < j; i, j = i+1, j-1 {
+			branches[i], branches[j] = branches[j], branches[i]
 		}
+	}
 
-		pageinfo.Logs[i] = &gitLog{
-			Author:    c.Author,
-			Classtype: classtype,
-			SHA:       c.SHA,
-			Time:      c.Time,
-			Subject:   template.HTML(html.EscapeString(c.Subject)),
-			Body:      template.HTML(strings.Replace(html.EscapeString(c.Body), "\n", "<br/>", -1)),
+	pageinfo.Stale = stale
+	pageinfo.Branches = make([]*branchInfo, len(branches))
+	for n, b := range branches {
+		pageinfo.Branches[n] = &branchInfo{
+			Name:    b.Name,
+			SHA:     b.SHA,
+			Author:  b.Author,
+			Time:    b.Time,
+			Subject: b.Subject,
+			Default: b.Name == def,
+			Merged:  b.Merged && b.Name != def,
+		}
+		if b.Name != def {
+			pageinfo.Branches[n].Ahead, pageinfo.Branches[n].Behind =
+				g.AheadBehind(defSHA, b.SHA)
 		}
 	}
 
-	if len(file) == 0 {
-		// Load the README if it can be located. To locate, go through
-		// a list of possible names and break the loop at the first
-		// one.
-		for _, fn := range []string{"README", "README.txt", "README.md"} {
-			readme := g.GetFile(ref, fn)
-			if len(readme) != 0 {
-				pageinfo.Content = template.HTML(
-					blackfriday.MarkdownCommon(readme))
-				break
+	// We return 500 here because the error will only be reported
+	// if executeTemplate() results in an error.
+	return executeTemplate(w, "branches.html", pageinfo),
+		http.StatusInternalServerError
+}
+
+// MakeShortlogPage groups the most recent commits by author, in the
+// manner of `git shortlog`, and lists the authors in order of the
+// number of commits they made. It writes the webpage to the provided
+// http.ResponseWriter.
+func MakeShortlogPage(w http.ResponseWriter, pageinfo *gitPage, g *git, ref string, maxCommits int) (err error, status int) {
+	commits := g.Commits(ref, maxCommits)
+	if len(commits) == 0 {
+		return notFound, http.StatusNotFound
+	}
+
+	// Group the commits by email address, keeping them in the order
+	// they appear in the log.
+	authors := make(map[string]*shortlogEntry)
+	for _, c := range commits {
+		if len(c.SHA) == 0 {
+			continue
+		}
+		entry, ok := authors[c.Email]
+		if !ok {
+			entry = &shortlogEntry{
+				Name:   c.Author,
+				Email:  c.Email,
+				Avatar: avatarURL(c.Email),
 			}
+			authors[c.Email] = entry
+			pageinfo.Shortlog = append(pageinfo.Shortlog, entry)
 		}
+		entry.Count++
+		entry.Logs = append(entry.Logs, makeLog(c, pageinfo.Owner))
 	}
+	// Authors with the same number of commits remain ordered by their
+	// most recent commit.
+	sort.SliceStable(pageinfo.Shortlog, func(i, j int) bool {
+		return pageinfo.Shortlog[i].Count > pageinfo.Shortlog[j].Count
+	})
 
 	// We return 500 here because the error will only be reported
-	// if t.ExecuteTemplate() results in an error.
-	return t.ExecuteTemplate(w, "gitpage.html", pageinfo),
+	// if executeTemplate() results in an error.
+	return executeTemplate(w, "shortlog.html", pageinfo),
 		http.StatusInternalServerError
 }
 
@@ -410,7 +1637,7 @@ func MakeTreePage(w http.ResponseWriter, pageinfo *gitPage, g *git, ref, file st
 	pageinfo.List = make([]*dirList, len(files))
 	for n, f := range files {
 		d := &dirList{
-			URL:  template.URL(f)+pageinfo.Query,
+			URL:  template.URL(escapePath(f)) + pageinfo.Query,
 			Name: f,
 		}
 
@@ -420,12 +1647,25 @@ func MakeTreePage(w http.ResponseWriter, pageinfo *gitPage, g *git, ref, file st
 		} else {
 			t = "blob"
 		}
-		d.Link = prefix + pageinfo.Path + t + "/" + path.Join(file, f) + string(pageinfo.Query)
+		d.Link = prefix + pageinfo.Path + t + "/" + escapePath(path.Join(file, f)) +
+			string(pageinfo.Query)
 		pageinfo.List[n] = d
 	}
 
+	// Show the README of the directory, if it has one, below the
+	// listing, as on the front page.
+	if readme := findReadme(files); len(readme) > 0 {
+		contents := g.GetFile(ref, path.Join(file, readme))
+		if isMarkup(readme) {
+			pageinfo.Content = template.HTML(renderMarkup(readme, contents))
+		} else {
+			pageinfo.Content = template.HTML("<pre>" +
+				html.EscapeString(string(contents)) + "</pre>")
+		}
+	}
+
 	// We return 500 here because the error will only be reported
-	// if t.ExecuteTemplate() results in an error.
-	return t.ExecuteTemplate(w, "tree.html", pageinfo),
+	// if executeTemplate() results in an error.
+	return executeTemplate(w, "tree.html", pageinfo),
 		http.StatusInternalServerError
 }